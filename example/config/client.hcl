@@ -11,6 +11,12 @@ client {
       state_dir = "/var/lib/nomad/filewatcher"
       log_level = "INFO"
 
+      # Run handler commands chrooted into the task directory
+      fs_isolation = "chroot"
+
+      # Serve Prometheus metrics on /metrics
+      metrics_address = "127.0.0.1:9464"
+
       # Default settings for all watchers
       default_recursive = true
       max_watch_paths = 100
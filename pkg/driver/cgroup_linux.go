@@ -0,0 +1,400 @@
+//go:build linux
+
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/sagoresarker/nomad-filewatcher-driver/pkg/watcher"
+)
+
+const (
+	cgroupRoot   = "/sys/fs/cgroup"
+	cgroupParent = "nomad-filewatcher"
+
+	// userHZ is the unit of the v1 cpuacct.stat counters
+	userHZ = 100
+
+	// minCPUQuota is the smallest CFS quota in microseconds the kernel accepts
+	minCPUQuota = 1000
+)
+
+// cgroup confines the handler commands of a task. It implements
+// watcher.ProcessHook so every spawned command is placed into it.
+type cgroup struct {
+	v2    bool
+	path  string            // Unified hierarchy path (v2)
+	paths map[string]string // Per controller paths (v1)
+	dir   *os.File          // Open v2 directory used to start commands in the cgroup
+
+	lock      sync.Mutex
+	oomKills  uint64
+	onOOM     func(event *watcher.Event)
+	lastCPU   uint64
+	lastCheck time.Time
+}
+
+// cgroupLimits are the resource limits of a task's cgroup, 0 for none
+type cgroupLimits struct {
+	memory    int64 // Memory limit in bytes
+	shares    int64 // Relative CPU weight as v1 cpu shares
+	cpuQuota  int64 // CPU time in microseconds per period with a hard limit
+	cpuPeriod int64 // CFS period in microseconds
+}
+
+// newCgroup creates the cgroup of a task sized from its resources, using
+// cgroups v2 when available and falling back to the v1 hierarchies. With
+// cpuHardLimit the commands are throttled to the task's CPU reservation
+// over every cpuPeriod instead of only being weighted against other tasks.
+func newCgroup(name string, resources *drivers.Resources, cpuHardLimit bool, cpuPeriod int64) (*cgroup, error) {
+	limits := taskCgroupLimits(resources, cpuHardLimit, cpuPeriod)
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		return newCgroupV2(name, limits)
+	}
+	return newCgroupV1(name, limits)
+}
+
+func newCgroupV2(name string, limits cgroupLimits) (*cgroup, error) {
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %v", parent, err)
+	}
+
+	// Delegate the controllers down to the task cgroups
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+			return nil, err
+		}
+	}
+
+	path := filepath.Join(parent, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %v", path, err)
+	}
+
+	cg := &cgroup{v2: true, path: path}
+	if err := cg.limitV2(limits); err != nil {
+		cg.destroy()
+		return nil, err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		cg.destroy()
+		return nil, fmt.Errorf("failed to open cgroup %s: %v", path, err)
+	}
+	cg.dir = dir
+	cg.oomKills = cg.readOOMKills()
+	return cg, nil
+}
+
+func (c *cgroup) limitV2(limits cgroupLimits) error {
+	if limits.memory > 0 {
+		if err := writeCgroupFile(c.path, "memory.max", strconv.FormatInt(limits.memory, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.shares > 0 {
+		if err := writeCgroupFile(c.path, "cpu.weight", strconv.FormatInt(sharesToWeight(limits.shares), 10)); err != nil {
+			return err
+		}
+	}
+	if limits.cpuQuota > 0 {
+		value := fmt.Sprintf("%d %d", limits.cpuQuota, limits.cpuPeriod)
+		if err := writeCgroupFile(c.path, "cpu.max", value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCgroupV1 creates the v1 cgroups of a task. Unlike v2 commands cannot be
+// started inside them, PostStart moves each command in right after it
+// started. Processes the command forks before that stay outside the limits.
+func newCgroupV1(name string, limits cgroupLimits) (*cgroup, error) {
+	cg := &cgroup{paths: make(map[string]string)}
+	for _, controller := range []string{"memory", "cpu", "cpuacct"} {
+		path := filepath.Join(cgroupRoot, controller, cgroupParent, name)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			cg.destroy()
+			return nil, fmt.Errorf("failed to create cgroup %s: %v", path, err)
+		}
+		cg.paths[controller] = path
+	}
+
+	if err := cg.limitV1(limits); err != nil {
+		cg.destroy()
+		return nil, err
+	}
+
+	cg.oomKills = cg.readOOMKills()
+	return cg, nil
+}
+
+func (c *cgroup) limitV1(limits cgroupLimits) error {
+	if limits.memory > 0 {
+		if err := writeCgroupFile(c.paths["memory"], "memory.limit_in_bytes", strconv.FormatInt(limits.memory, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.shares > 0 {
+		if err := writeCgroupFile(c.paths["cpu"], "cpu.shares", strconv.FormatInt(limits.shares, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.cpuQuota > 0 {
+		if err := writeCgroupFile(c.paths["cpu"], "cpu.cfs_period_us", strconv.FormatInt(limits.cpuPeriod, 10)); err != nil {
+			return err
+		}
+		if err := writeCgroupFile(c.paths["cpu"], "cpu.cfs_quota_us", strconv.FormatInt(limits.cpuQuota, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreStart starts v2 commands directly inside the cgroup
+func (c *cgroup) PreStart(cmd *exec.Cmd) error {
+	if !c.v2 {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+	return nil
+}
+
+// PostStart moves v1 commands into the cgroup. Until then they run outside
+// of it, see newCgroupV1.
+func (c *cgroup) PostStart(pid int) error {
+	if c.v2 {
+		return nil
+	}
+	for _, path := range c.paths {
+		if err := writeCgroupFile(path, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PostExit reports commands killed by the OOM killer
+func (c *cgroup) PostExit(event *watcher.Event, state *os.ProcessState) {
+	kills := c.readOOMKills()
+
+	c.lock.Lock()
+	oom := kills > c.oomKills
+	c.oomKills = kills
+	onOOM := c.onOOM
+	c.lock.Unlock()
+
+	if oom && onOOM != nil {
+		onOOM(event)
+	}
+}
+
+func (c *cgroup) readOOMKills() uint64 {
+	if c.v2 {
+		return readCgroupKey(c.path, "memory.events", "oom_kill")
+	}
+	return readCgroupKey(c.paths["memory"], "memory.oom_control", "oom_kill")
+}
+
+// stats samples the resource usage of the commands in the cgroup
+func (c *cgroup) stats() *drivers.TaskResourceUsage {
+	memory := &drivers.MemoryStats{}
+	cpu := &drivers.CpuStats{}
+	var usage, user, system uint64
+
+	if c.v2 {
+		memory.Usage = readCgroupUint(c.path, "memory.current")
+		memory.MaxUsage = readCgroupUint(c.path, "memory.peak")
+		memory.RSS = readCgroupKey(c.path, "memory.stat", "anon")
+		memory.Cache = readCgroupKey(c.path, "memory.stat", "file")
+		memory.Swap = readCgroupUint(c.path, "memory.swap.current")
+		memory.Measured = []string{"RSS", "Cache", "Swap", "Usage", "Max Usage"}
+
+		usage = readCgroupKey(c.path, "cpu.stat", "usage_usec")
+		user = readCgroupKey(c.path, "cpu.stat", "user_usec")
+		system = readCgroupKey(c.path, "cpu.stat", "system_usec")
+		cpu.ThrottledPeriods = readCgroupKey(c.path, "cpu.stat", "nr_throttled")
+		cpu.ThrottledTime = readCgroupKey(c.path, "cpu.stat", "throttled_usec")
+	} else {
+		memory.Usage = readCgroupUint(c.paths["memory"], "memory.usage_in_bytes")
+		memory.MaxUsage = readCgroupUint(c.paths["memory"], "memory.max_usage_in_bytes")
+		memory.RSS = readCgroupKey(c.paths["memory"], "memory.stat", "rss")
+		memory.Cache = readCgroupKey(c.paths["memory"], "memory.stat", "cache")
+		memory.Measured = []string{"RSS", "Cache", "Usage", "Max Usage"}
+
+		usage = readCgroupUint(c.paths["cpuacct"], "cpuacct.usage") / 1000
+		user = readCgroupKey(c.paths["cpuacct"], "cpuacct.stat", "user") * 1000000 / userHZ
+		system = readCgroupKey(c.paths["cpuacct"], "cpuacct.stat", "system") * 1000000 / userHZ
+	}
+
+	now := time.Now()
+
+	c.lock.Lock()
+	if !c.lastCheck.IsZero() && usage >= c.lastCPU {
+		elapsed := float64(now.Sub(c.lastCheck).Microseconds())
+		if elapsed > 0 {
+			cpu.Percent = float64(usage-c.lastCPU) / elapsed * 100
+		}
+	}
+	c.lastCPU = usage
+	c.lastCheck = now
+	c.lock.Unlock()
+
+	if usage > 0 {
+		cpu.UserMode = float64(user) / float64(usage) * cpu.Percent
+		cpu.SystemMode = float64(system) / float64(usage) * cpu.Percent
+	}
+	cpu.Measured = []string{"System Mode", "User Mode", "Percent", "Throttled Periods", "Throttled Time"}
+
+	return &drivers.TaskResourceUsage{
+		ResourceUsage: &drivers.ResourceUsage{
+			MemoryStats: memory,
+			CpuStats:    cpu,
+		},
+		Timestamp: now.UTC().UnixNano(),
+	}
+}
+
+// destroy kills the remaining processes and removes the cgroup
+func (c *cgroup) destroy() error {
+	if c.v2 {
+		if c.dir != nil {
+			c.dir.Close()
+		}
+		writeCgroupFile(c.path, "cgroup.kill", "1")
+		return removeCgroup(c.path)
+	}
+
+	var firstErr error
+	for _, path := range c.paths {
+		for _, pid := range strings.Fields(readCgroupString(path, "cgroup.procs")) {
+			if id, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(id, syscall.SIGKILL)
+			}
+		}
+		if err := removeCgroup(path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// removeCgroup removes a cgroup directory, retrying briefly while killed
+// processes are still exiting
+func removeCgroup(path string) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup %s: %v", path, err)
+}
+
+// taskCgroupLimits returns the cgroup limits of a task's resources
+func taskCgroupLimits(resources *drivers.Resources, cpuHardLimit bool, cpuPeriod int64) cgroupLimits {
+	var limits cgroupLimits
+	if resources == nil {
+		return limits
+	}
+
+	linux := resources.LinuxResources
+	if linux != nil {
+		limits.memory = linux.MemoryLimitBytes
+		limits.shares = linux.CPUShares
+	}
+
+	// memory_max allows tasks to burst above their reserved memory
+	if resources.NomadResources != nil {
+		if max := resources.NomadResources.Memory.MemoryMaxMB * 1024 * 1024; max > limits.memory {
+			limits.memory = max
+		}
+	}
+
+	// The reservation is a share of all cores of the client, like the hard
+	// limit of the docker driver
+	if cpuHardLimit && linux != nil && linux.PercentTicks > 0 {
+		if cpuPeriod <= 0 {
+			cpuPeriod = linux.CPUPeriod
+		}
+		if cpuPeriod <= 0 {
+			cpuPeriod = defaultCPUPeriod
+		}
+		limits.cpuPeriod = cpuPeriod
+		limits.cpuQuota = int64(linux.PercentTicks*float64(cpuPeriod)) * int64(runtime.NumCPU())
+		if limits.cpuQuota < minCPUQuota {
+			limits.cpuQuota = minCPUQuota
+		}
+	}
+	return limits
+}
+
+// sharesToWeight converts v1 cpu shares into a v2 cpu weight
+func sharesToWeight(shares int64) int64 {
+	if shares < 2 {
+		shares = 2
+	}
+	if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Join(dir, name), err)
+	}
+	return nil
+}
+
+func readCgroupString(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readCgroupUint(dir, name string) uint64 {
+	value, _ := strconv.ParseUint(readCgroupString(dir, name), 10, 64)
+	return value
+}
+
+// readCgroupKey reads a value from a flat keyed cgroup file such as
+// memory.stat or cpu.stat
+func readCgroupKey(dir, name, key string) uint64 {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseUint(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/sagoresarker/nomad-filewatcher-driver/pkg/watcher"
+)
+
+type cgroup struct {
+	onOOM func(event *watcher.Event)
+}
+
+func newCgroup(name string, resources *drivers.Resources, cpuHardLimit bool, cpuPeriod int64) (*cgroup, error) {
+	return nil, fmt.Errorf("cgroups are only supported on linux")
+}
+
+func (c *cgroup) PreStart(cmd *exec.Cmd) error                          { return nil }
+func (c *cgroup) PostStart(pid int) error                               { return nil }
+func (c *cgroup) PostExit(event *watcher.Event, state *os.ProcessState) {}
+func (c *cgroup) stats() *drivers.TaskResourceUsage                     { return nil }
+func (c *cgroup) destroy() error                                        { return nil }
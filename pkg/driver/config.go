@@ -2,8 +2,10 @@ package driver
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+	"github.com/sagoresarker/nomad-filewatcher-driver/pkg/watcher"
 )
 
 // FileWatcherConfig is the driver configuration
@@ -13,20 +15,198 @@ type FileWatcherConfig struct {
 	LogLevel        string `codec:"log_level"`
 	MaxWatchPaths   int    `codec:"max_watch_paths"`
 	EventBufferSize int    `codec:"event_buffer_size"`
+	FSIsolation     string `codec:"fs_isolation"`
+	MetricsAddress  string `codec:"metrics_address"` // Address of the Prometheus listener, disabled when empty
 }
 
+const (
+	fsIsolationNone   = "none"
+	fsIsolationChroot = "chroot"
+
+	// defaultCPUPeriod is the CFS period in microseconds of the CPU hard limit
+	defaultCPUPeriod = 100000
+)
+
 // TaskConfig is the individual task configuration
 type TaskConfig struct {
-	Paths          []string          `codec:"paths"`           // Paths to watch
-	Events         []string          `codec:"events"`          // Events to watch (create, modify, remove)
-	ExecCommand    string            `codec:"exec_command"`    // Command to execute on events
-	ExecArgs       []string          `codec:"exec_args"`       // Arguments for the command
-	Environment    map[string]string `codec:"environment"`     // Environment variables
-	RecursiveWatch bool              `codec:"recursive_watch"` // Watch subdirectories
-	IgnorePatterns []string          `codec:"ignore_patterns"` // Patterns to ignore
-	RetryInterval  int               `codec:"retry_interval"`  // Interval between retries in seconds
-	MaxRetries     int               `codec:"max_retries"`     // Maximum number of retries
-	Timeout        int               `codec:"timeout"`         // Timeout for command execution in seconds
+	Paths          []string          `codec:"paths"`              // Paths to watch
+	Events         []string          `codec:"events"`             // Events to watch (create, modify, remove)
+	ExecCommand    string            `codec:"exec_command"`       // Command to execute on events
+	ExecArgs       []string          `codec:"exec_args"`          // Arguments for the command
+	Environment    map[string]string `codec:"environment"`        // Environment variables
+	InheritEnv     bool              `codec:"inherit_plugin_env"` // Pass the plugin's own environment to commands
+	WorkingDir     string            `codec:"working_dir"`        // Working directory of the command
+	Stdin          string            `codec:"stdin"`              // Data written to the command's stdin (none, event_json)
+	OutputPrefix   bool              `codec:"output_prefix"`      // Prefix command output lines with the event sequence number
+	RecursiveWatch bool              `codec:"recursive_watch"`    // Watch subdirectories
+	FollowSymlinks bool              `codec:"follow_symlinks"`    // Follow symlinked paths and directories
+	PathsReadOnly  bool              `codec:"paths_read_only"`    // Mount watched paths read-only into the chroot
+	IgnorePatterns []string          `codec:"ignore_patterns"`    // Patterns to ignore
+	RetryInterval  int               `codec:"retry_interval"`     // Interval between retries in seconds
+	MaxRetries     int               `codec:"max_retries"`        // Maximum number of retries
+	Timeout        int               `codec:"timeout"`            // Timeout for command execution in seconds
+	DrainOnStop    bool              `codec:"drain_on_stop"`      // Handle already received events before stopping
+	Concurrency    string            `codec:"concurrency"`        // Policy for events of a path while its command runs
+	MaxConcurrent  int               `codec:"max_concurrent"`     // Commands running at once across all paths, 0 for no limit
+
+	CPUHardLimit bool  `codec:"cpu_hard_limit"` // Throttle handler commands to the task's CPU reservation
+	CPUCFSPeriod int64 `codec:"cpu_cfs_period"` // Period of the CPU hard limit in microseconds
+
+	ContentHash          string `codec:"content_hash"`            // Suppress unchanged modify events (sha256, xxhash)
+	ContentHashMaxSize   int    `codec:"content_hash_max_size"`   // Maximum file size in bytes to hash
+	ContentHashCacheSize int    `codec:"content_hash_cache_size"` // Maximum number of cached digests
+
+	Tail          bool `codec:"tail"`            // Pass newly appended lines to the command on stdin
+	TailBatchSize int  `codec:"tail_batch_size"` // Maximum lines per command invocation in tail mode
+	DrainRotated  bool `codec:"drain_rotated"`   // Finish reading rotated files in tail mode
+
+	Match *MatchConfig `codec:"match"` // Only run the command for tailed lines matching these patterns
+
+	ServiceCommand      string   `codec:"service_command"`       // Long-running process supervised instead of exec_command
+	ServiceArgs         []string `codec:"service_args"`          // Arguments of the service
+	ServiceOnChange     string   `codec:"service_on_change"`     // Action on events (restart, reload)
+	ServiceStopSignal   string   `codec:"service_stop_signal"`   // Signal stopping the service on restart
+	ServiceReloadSignal string   `codec:"service_reload_signal"` // Signal sent to the service on reload
+	ServiceGracePeriod  int      `codec:"service_grace_period"`  // Seconds to wait for the service to stop before killing it
+	ServiceDebounceMS   int      `codec:"service_debounce_ms"`   // Quiet period in milliseconds after an event before acting
+
+	Webhook *WebhookConfig `codec:"webhook"` // Send the event documents to an HTTP endpoint
+
+	FileOps []FileOpConfig `codec:"file_op"` // Pipeline of built-in file operations run per event
+
+	Sync *SyncConfig `codec:"sync"` // Mirror the watched paths into a destination directory
+
+	Sink *SinkConfig `codec:"sink"` // Stream the event documents as JSON lines
+
+	Syslog *SyslogConfig `codec:"syslog"` // Write the events to syslog or journald
+
+	NomadDispatch []NomadDispatchConfig `codec:"nomad_dispatch"` // Parameterized jobs dispatched per event
+	NomadRestart  []NomadTaskConfig     `codec:"nomad_restart"`  // Tasks of the allocation restarted per event
+	NomadSignal   []NomadTaskConfig     `codec:"nomad_signal"`   // Tasks of the allocation signalled per event
+
+	NATS *NATSConfig `codec:"nats"` // Publish the events to NATS
+
+	Redis *RedisConfig `codec:"redis"` // Write the events to a Redis stream or list
+}
+
+// MatchConfig selects the tailed lines that trigger the command
+type MatchConfig struct {
+	Patterns           []string `codec:"patterns"`             // Regular expressions, named groups are exported
+	MultilineStart     string   `codec:"multiline_start"`      // Regular expression starting a multiline record
+	MultilineMaxLines  int      `codec:"multiline_max_lines"`  // Maximum lines grouped into one record
+	MultilineTimeoutMS int      `codec:"multiline_timeout_ms"` // Wait for further lines of the last record
+}
+
+// WebhookConfig describes the HTTP endpoint receiving the event documents
+type WebhookConfig struct {
+	URL             string            `codec:"url"`               // Endpoint URL
+	Method          string            `codec:"method"`            // HTTP method (POST, PUT, PATCH)
+	Headers         map[string]string `codec:"headers"`           // Extra request headers
+	Body            string            `codec:"body"`              // Body template, defaults to the event JSON
+	AuthHeader      string            `codec:"auth_header"`       // Header carrying the credential
+	AuthEnv         string            `codec:"auth_env"`          // Task environment variable holding the credential
+	TLSCACert       string            `codec:"tls_ca_cert"`       // CA verifying the server
+	TLSClientCert   string            `codec:"tls_client_cert"`   // Client certificate
+	TLSClientKey    string            `codec:"tls_client_key"`    // Client key
+	TLSServerName   string            `codec:"tls_server_name"`   // Server name used for verification
+	TLSSkipVerify   bool              `codec:"tls_skip_verify"`   // Do not verify the server certificate
+	Timeout         int               `codec:"timeout"`           // Request timeout in seconds
+	MaxRetries      int               `codec:"max_retries"`       // Retries on timeouts, 429 and 5xx responses
+	RetryBackoffMS  int               `codec:"retry_backoff_ms"`  // Delay before the first retry in milliseconds
+	BatchSize       int               `codec:"batch_size"`        // Events sent per request
+	BatchIntervalMS int               `codec:"batch_interval_ms"` // Maximum time an event waits for its batch in milliseconds
+}
+
+// FileOpConfig is one step of the file operation pipeline
+type FileOpConfig struct {
+	Op         string `codec:"op"`          // copy, move, compress, tar, checksum or delete
+	Dest       string `codec:"dest"`        // Destination template of copy, move and tar
+	Format     string `codec:"format"`      // Compression of compress and tar (gzip, zstd)
+	Algorithm  string `codec:"algorithm"`   // Checksum algorithm (sha256, sha512)
+	KeepSource bool   `codec:"keep_source"` // Keep the uncompressed file after compress
+}
+
+// SyncConfig describes the directory mirroring the watched paths
+type SyncConfig struct {
+	Dest           string `codec:"dest"`            // Destination directory
+	VerifyInterval int    `codec:"verify_interval"` // Seconds between verification sweeps, 0 disables them
+	DryRun         bool   `codec:"dry_run"`         // Only log the changes that would be made
+}
+
+// SinkConfig describes where the event documents are streamed as JSON lines
+type SinkConfig struct {
+	Type       string   `codec:"type"`        // file, socket or pipe
+	Path       string   `codec:"path"`        // Path of the file, socket or pipe
+	Fields     []string `codec:"fields"`      // Fields of the event document to write, all when empty
+	MaxSizeMB  int      `codec:"max_size_mb"` // Size in megabytes at which the file is rotated, 0 disables rotation
+	MaxFiles   int      `codec:"max_files"`   // Rotated files kept
+	BufferSize int      `codec:"buffer_size"` // Events buffered while the target is slow or unavailable
+}
+
+// SyslogConfig describes the syslog or journald destination of the events
+type SyslogConfig struct {
+	Transport string             `codec:"transport"` // unix, udp or journald
+	Address   string             `codec:"address"`   // Socket path or host:port
+	Tag       string             `codec:"tag"`       // Application name of the messages
+	Facility  string             `codec:"facility"`  // Default facility
+	Severity  string             `codec:"severity"`  // Default severity
+	Rules     []SyslogRuleConfig `codec:"rule"`      // Facility and severity overrides
+}
+
+// SyslogRuleConfig overrides the facility and severity of matching events
+type SyslogRuleConfig struct {
+	Pattern  string   `codec:"pattern"`  // Glob matched against the file name
+	Events   []string `codec:"events"`   // Event types
+	Facility string   `codec:"facility"` // Facility of matching events
+	Severity string   `codec:"severity"` // Severity of matching events
+}
+
+// NomadDispatchConfig describes a parameterized job dispatched per event
+type NomadDispatchConfig struct {
+	Job     string            `codec:"job"`     // Parameterized job ID
+	Meta    map[string]string `codec:"meta"`    // Dispatch meta, values are templates
+	Payload bool              `codec:"payload"` // Send the event JSON as the payload
+}
+
+// NomadTaskConfig targets another task of the allocation
+type NomadTaskConfig struct {
+	Task   string `codec:"task"`   // Task name
+	Signal string `codec:"signal"` // Signal sent by nomad_signal
+}
+
+// NATSConfig describes the NATS server and subjects events are published to
+type NATSConfig struct {
+	URL           string              `codec:"url"`             // Server URLs, comma separated
+	JetStream     bool                `codec:"jetstream"`       // Wait for the acknowledgement of a JetStream stream
+	Stream        string              `codec:"stream"`          // Stream expected to store the messages
+	CredsFile     string              `codec:"creds_file"`      // Credentials file of the user
+	TokenEnv      string              `codec:"token_env"`       // Task environment variable holding the token
+	TLSCACert     string              `codec:"tls_ca_cert"`     // CA verifying the server
+	TLSClientCert string              `codec:"tls_client_cert"` // Client certificate
+	TLSClientKey  string              `codec:"tls_client_key"`  // Client key
+	Subject       string              `codec:"subject"`         // Subject template
+	Rules         []PublishRuleConfig `codec:"rule"`            // Subject overrides
+	SpoolLimitMB  int                 `codec:"spool_limit_mb"`  // Maximum size of the spool in megabytes
+}
+
+// RedisConfig describes the Redis server and keys events are written to
+type RedisConfig struct {
+	Address      string              `codec:"address"`        // host:port, or a redis:// or rediss:// URL
+	Username     string              `codec:"username"`       // ACL user
+	PasswordEnv  string              `codec:"password_env"`   // Task environment variable holding the password
+	DB           int                 `codec:"db"`             // Database number
+	Mode         string              `codec:"mode"`           // stream or list
+	Key          string              `codec:"key"`            // Key template
+	MaxLen       int                 `codec:"maxlen"`         // Entries kept per key, 0 keeps all of them
+	Rules        []PublishRuleConfig `codec:"rule"`           // Key overrides, the subject of a rule is the key
+	SpoolLimitMB int                 `codec:"spool_limit_mb"` // Maximum size of the spool in megabytes
+}
+
+// PublishRuleConfig publishes matching events to another subject
+type PublishRuleConfig struct {
+	Pattern string   `codec:"pattern"` // Glob matched against the file name
+	Events  []string `codec:"events"`  // Event types
+	Subject string   `codec:"subject"` // Subject template
 }
 
 // ConfigSpec is the specification of the plugin configuration
@@ -67,6 +247,20 @@ var configSpec = &hclspec.Spec{
 						},
 					},
 				},
+				"fs_isolation": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{
+							Default: "none",
+						},
+					},
+				},
+				"metrics_address": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{
+							Default: "",
+						},
+					},
+				},
 			},
 		},
 	},
@@ -122,11 +316,43 @@ var taskConfigSpec = &hclspec.Spec{
 						},
 					},
 				},
+				"inherit_plugin_env": {
+					Block: &hclspec.Spec_Bool{
+						Bool: false,
+					},
+				},
+				"working_dir": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{},
+					},
+				},
+				"stdin": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{
+							Default: "none",
+						},
+					},
+				},
+				"output_prefix": {
+					Block: &hclspec.Spec_Bool{
+						Bool: false,
+					},
+				},
 				"recursive_watch": {
 					Block: &hclspec.Spec_Bool{
 						Bool: false,
 					},
 				},
+				"paths_read_only": {
+					Block: &hclspec.Spec_Bool{
+						Bool: true,
+					},
+				},
+				"follow_symlinks": {
+					Block: &hclspec.Spec_Bool{
+						Bool: false,
+					},
+				},
 				"ignore_patterns": {
 					Block: &hclspec.Spec_Array{
 						Array: &hclspec.Array{
@@ -159,6 +385,728 @@ var taskConfigSpec = &hclspec.Spec{
 						},
 					},
 				},
+				"concurrency": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{
+							Default: "queue",
+						},
+					},
+				},
+				"max_concurrent": {
+					Block: &hclspec.Spec_Number{
+						Number: &hclspec.Number{
+							Default: 0,
+						},
+					},
+				},
+				"cpu_hard_limit": {
+					Block: &hclspec.Spec_Bool{
+						Bool: false,
+					},
+				},
+				"cpu_cfs_period": {
+					Block: &hclspec.Spec_Number{
+						Number: &hclspec.Number{
+							Default: 100000,
+						},
+					},
+				},
+				"drain_on_stop": {
+					Block: &hclspec.Spec_Bool{
+						Bool: false,
+					},
+				},
+				"content_hash": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{},
+					},
+				},
+				"content_hash_max_size": {
+					Block: &hclspec.Spec_Number{
+						Number: &hclspec.Number{
+							Default: 1048576,
+						},
+					},
+				},
+				"content_hash_cache_size": {
+					Block: &hclspec.Spec_Number{
+						Number: &hclspec.Number{
+							Default: 10000,
+						},
+					},
+				},
+				"tail": {
+					Block: &hclspec.Spec_Bool{
+						Bool: false,
+					},
+				},
+				"tail_batch_size": {
+					Block: &hclspec.Spec_Number{
+						Number: &hclspec.Number{
+							Default: 0,
+						},
+					},
+				},
+				"drain_rotated": {
+					Block: &hclspec.Spec_Bool{
+						Bool: false,
+					},
+				},
+				"service_command": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{},
+					},
+				},
+				"service_args": {
+					Block: &hclspec.Spec_Array{
+						Array: &hclspec.Array{
+							Values: []*hclspec.Spec{{
+								Block: &hclspec.Spec_String{
+									String_: &hclspec.String{},
+								},
+							}},
+						},
+					},
+				},
+				"service_on_change": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{
+							Default: "restart",
+						},
+					},
+				},
+				"service_stop_signal": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{
+							Default: "SIGTERM",
+						},
+					},
+				},
+				"service_reload_signal": {
+					Block: &hclspec.Spec_String{
+						String_: &hclspec.String{
+							Default: "SIGHUP",
+						},
+					},
+				},
+				"service_grace_period": {
+					Block: &hclspec.Spec_Number{
+						Number: &hclspec.Number{
+							Default: 5,
+						},
+					},
+				},
+				"service_debounce_ms": {
+					Block: &hclspec.Spec_Number{
+						Number: &hclspec.Number{
+							Default: 500,
+						},
+					},
+				},
+				"webhook": {
+					Block: &hclspec.Spec_Object{
+						Object: &hclspec.Object{
+							Attributes: map[string]*hclspec.Spec{
+								"url": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"method": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "POST",
+										},
+									},
+								},
+								"headers": {
+									Block: &hclspec.Spec_Object{
+										Object: &hclspec.Object{
+											Attributes: map[string]*hclspec.Spec{},
+										},
+									},
+								},
+								"body": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"auth_header": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"auth_env": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_ca_cert": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_client_cert": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_client_key": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_server_name": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_skip_verify": {
+									Block: &hclspec.Spec_Bool{
+										Bool: false,
+									},
+								},
+								"timeout": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 10,
+										},
+									},
+								},
+								"max_retries": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 3,
+										},
+									},
+								},
+								"retry_backoff_ms": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 1000,
+										},
+									},
+								},
+								"batch_size": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 1,
+										},
+									},
+								},
+								"batch_interval_ms": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 1000,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"file_op": {
+					Block: &hclspec.Spec_BlockList{
+						BlockList: &hclspec.BlockList{
+							Name: "file_op",
+							Nested: &hclspec.Spec{
+								Block: &hclspec.Spec_Object{
+									Object: &hclspec.Object{
+										Attributes: map[string]*hclspec.Spec{
+											"op": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											},
+											"dest": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											},
+											"format": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											},
+											"algorithm": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											},
+											"keep_source": {
+												Block: &hclspec.Spec_Bool{
+													Bool: false,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"sync": {
+					Block: &hclspec.Spec_Object{
+						Object: &hclspec.Object{
+							Attributes: map[string]*hclspec.Spec{
+								"dest": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"verify_interval": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 300,
+										},
+									},
+								},
+								"dry_run": {
+									Block: &hclspec.Spec_Bool{
+										Bool: false,
+									},
+								},
+							},
+						},
+					},
+				},
+				"sink": {
+					Block: &hclspec.Spec_Object{
+						Object: &hclspec.Object{
+							Attributes: map[string]*hclspec.Spec{
+								"type": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "file",
+										},
+									},
+								},
+								"path": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"fields": {
+									Block: &hclspec.Spec_Array{
+										Array: &hclspec.Array{
+											Values: []*hclspec.Spec{{
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											}},
+										},
+									},
+								},
+								"max_size_mb": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{},
+									},
+								},
+								"max_files": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{},
+									},
+								},
+								"buffer_size": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 4096,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"syslog": {
+					Block: &hclspec.Spec_Object{
+						Object: &hclspec.Object{
+							Attributes: map[string]*hclspec.Spec{
+								"transport": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "unix",
+										},
+									},
+								},
+								"address": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tag": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "nomad-filewatcher",
+										},
+									},
+								},
+								"facility": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "user",
+										},
+									},
+								},
+								"severity": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "notice",
+										},
+									},
+								},
+								"rule": {
+									Block: &hclspec.Spec_BlockList{
+										BlockList: &hclspec.BlockList{
+											Name: "rule",
+											Nested: &hclspec.Spec{
+												Block: &hclspec.Spec_Object{
+													Object: &hclspec.Object{
+														Attributes: map[string]*hclspec.Spec{
+															"pattern": {
+																Block: &hclspec.Spec_String{
+																	String_: &hclspec.String{},
+																},
+															},
+															"events": {
+																Block: &hclspec.Spec_Array{
+																	Array: &hclspec.Array{
+																		Values: []*hclspec.Spec{{
+																			Block: &hclspec.Spec_String{
+																				String_: &hclspec.String{},
+																			},
+																		}},
+																	},
+																},
+															},
+															"facility": {
+																Block: &hclspec.Spec_String{
+																	String_: &hclspec.String{},
+																},
+															},
+															"severity": {
+																Block: &hclspec.Spec_String{
+																	String_: &hclspec.String{},
+																},
+															},
+														},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"nomad_dispatch": {
+					Block: &hclspec.Spec_BlockList{
+						BlockList: &hclspec.BlockList{
+							Name: "nomad_dispatch",
+							Nested: &hclspec.Spec{
+								Block: &hclspec.Spec_Object{
+									Object: &hclspec.Object{
+										Attributes: map[string]*hclspec.Spec{
+											"job": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											},
+											"meta": {
+												Block: &hclspec.Spec_Object{
+													Object: &hclspec.Object{
+														Attributes: map[string]*hclspec.Spec{},
+													},
+												},
+											},
+											"payload": {
+												Block: &hclspec.Spec_Bool{
+													Bool: true,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"nomad_restart": {
+					Block: &hclspec.Spec_BlockList{
+						BlockList: &hclspec.BlockList{
+							Name: "nomad_restart",
+							Nested: &hclspec.Spec{
+								Block: &hclspec.Spec_Object{
+									Object: &hclspec.Object{
+										Attributes: map[string]*hclspec.Spec{
+											"task": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"nomad_signal": {
+					Block: &hclspec.Spec_BlockList{
+						BlockList: &hclspec.BlockList{
+							Name: "nomad_signal",
+							Nested: &hclspec.Spec{
+								Block: &hclspec.Spec_Object{
+									Object: &hclspec.Object{
+										Attributes: map[string]*hclspec.Spec{
+											"task": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											},
+											"signal": {
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{
+														Default: "SIGHUP",
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"nats": {
+					Block: &hclspec.Spec_Object{
+						Object: &hclspec.Object{
+							Attributes: map[string]*hclspec.Spec{
+								"url": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"jetstream": {
+									Block: &hclspec.Spec_Bool{
+										Bool: false,
+									},
+								},
+								"stream": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"creds_file": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"token_env": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_ca_cert": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_client_cert": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"tls_client_key": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"subject": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "filewatcher.{{ .Op }}",
+										},
+									},
+								},
+								"spool_limit_mb": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 100,
+										},
+									},
+								},
+								"rule": {
+									Block: &hclspec.Spec_BlockList{
+										BlockList: &hclspec.BlockList{
+											Name: "rule",
+											Nested: &hclspec.Spec{
+												Block: &hclspec.Spec_Object{
+													Object: &hclspec.Object{
+														Attributes: map[string]*hclspec.Spec{
+															"pattern": {
+																Block: &hclspec.Spec_String{
+																	String_: &hclspec.String{},
+																},
+															},
+															"events": {
+																Block: &hclspec.Spec_Array{
+																	Array: &hclspec.Array{
+																		Values: []*hclspec.Spec{{
+																			Block: &hclspec.Spec_String{
+																				String_: &hclspec.String{},
+																			},
+																		}},
+																	},
+																},
+															},
+															"subject": {
+																Block: &hclspec.Spec_String{
+																	String_: &hclspec.String{},
+																},
+															},
+														},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"redis": {
+					Block: &hclspec.Spec_Object{
+						Object: &hclspec.Object{
+							Attributes: map[string]*hclspec.Spec{
+								"address": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "127.0.0.1:6379",
+										},
+									},
+								},
+								"username": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"password_env": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"db": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{},
+									},
+								},
+								"mode": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "stream",
+										},
+									},
+								},
+								"key": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{
+											Default: "filewatcher:events",
+										},
+									},
+								},
+								"maxlen": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{},
+									},
+								},
+								"spool_limit_mb": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 100,
+										},
+									},
+								},
+								"rule": {
+									Block: &hclspec.Spec_BlockList{
+										BlockList: &hclspec.BlockList{
+											Name: "rule",
+											Nested: &hclspec.Spec{
+												Block: &hclspec.Spec_Object{
+													Object: &hclspec.Object{
+														Attributes: map[string]*hclspec.Spec{
+															"pattern": {
+																Block: &hclspec.Spec_String{
+																	String_: &hclspec.String{},
+																},
+															},
+															"events": {
+																Block: &hclspec.Spec_Array{
+																	Array: &hclspec.Array{
+																		Values: []*hclspec.Spec{{
+																			Block: &hclspec.Spec_String{
+																				String_: &hclspec.String{},
+																			},
+																		}},
+																	},
+																},
+															},
+															"subject": {
+																Block: &hclspec.Spec_String{
+																	String_: &hclspec.String{},
+																},
+															},
+														},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"match": {
+					Block: &hclspec.Spec_Object{
+						Object: &hclspec.Object{
+							Attributes: map[string]*hclspec.Spec{
+								"patterns": {
+									Block: &hclspec.Spec_Array{
+										Array: &hclspec.Array{
+											Values: []*hclspec.Spec{{
+												Block: &hclspec.Spec_String{
+													String_: &hclspec.String{},
+												},
+											}},
+										},
+									},
+								},
+								"multiline_start": {
+									Block: &hclspec.Spec_String{
+										String_: &hclspec.String{},
+									},
+								},
+								"multiline_max_lines": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 100,
+										},
+									},
+								},
+								"multiline_timeout_ms": {
+									Block: &hclspec.Spec_Number{
+										Number: &hclspec.Number{
+											Default: 1000,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
 			},
 		},
 	},
@@ -174,25 +1122,47 @@ func (tc *TaskConfig) Validate() error {
 		return fmt.Errorf("at least one event type must be specified")
 	}
 
-	if tc.ExecCommand == "" {
-		return fmt.Errorf("exec_command must be specified")
+	if tc.ExecCommand == "" && tc.ServiceCommand == "" && tc.Webhook == nil && len(tc.FileOps) == 0 && tc.Sync == nil && tc.Sink == nil && tc.Syslog == nil && len(tc.nomadActions()) == 0 && tc.NATS == nil && tc.Redis == nil {
+		return fmt.Errorf("exec_command, service_command, webhook, file_op, sync, sink, syslog, nats, redis or a nomad action must be specified")
 	}
 
-	// Validate event types
-	validEvents := map[string]bool{
-		"create": true,
-		"modify": true,
-		"remove": true,
-		"rename": true,
-		"chmod":  true,
+	if tc.ExecCommand != "" && tc.ServiceCommand != "" {
+		return fmt.Errorf("exec_command and service_command are mutually exclusive")
 	}
 
+	// Validate event types
 	for _, event := range tc.Events {
-		if !validEvents[event] {
+		if !watcher.IsValidEventType(event) {
 			return fmt.Errorf("invalid event type: %s", event)
 		}
 	}
 
+	// Validate templates
+	for _, arg := range tc.ExecArgs {
+		if err := watcher.ValidateTemplate(arg); err != nil {
+			return fmt.Errorf("invalid exec_args: %v", err)
+		}
+	}
+
+	for k, v := range tc.Environment {
+		if err := watcher.ValidateTemplate(v); err != nil {
+			return fmt.Errorf("invalid environment %s: %v", k, err)
+		}
+	}
+
+	if err := watcher.ValidateTemplate(tc.WorkingDir); err != nil {
+		return fmt.Errorf("invalid working_dir: %v", err)
+	}
+
+	// Validate stdin
+	if !watcher.IsValidStdin(tc.Stdin) {
+		return fmt.Errorf("invalid stdin: %s", tc.Stdin)
+	}
+
+	if tc.Stdin == watcher.StdinEventJSON && tc.Tail {
+		return fmt.Errorf("stdin = %q cannot be combined with tail", tc.Stdin)
+	}
+
 	// Validate timeout
 	if tc.Timeout < 0 {
 		return fmt.Errorf("timeout must be non-negative")
@@ -207,6 +1177,166 @@ func (tc *TaskConfig) Validate() error {
 		return fmt.Errorf("max_retries must be non-negative")
 	}
 
+	// Validate content hashing
+	if tc.ContentHash != "" && !watcher.IsValidHashAlgorithm(tc.ContentHash) {
+		return fmt.Errorf("invalid content_hash algorithm: %s", tc.ContentHash)
+	}
+
+	if tc.ContentHashMaxSize < 0 {
+		return fmt.Errorf("content_hash_max_size must be non-negative")
+	}
+
+	if tc.ContentHashCacheSize < 0 {
+		return fmt.Errorf("content_hash_cache_size must be non-negative")
+	}
+
+	// Validate the concurrency policy
+	if !watcher.IsValidConcurrency(tc.Concurrency) {
+		return fmt.Errorf("invalid concurrency: %s", tc.Concurrency)
+	}
+
+	if tc.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent must be non-negative")
+	}
+
+	if tc.CPUCFSPeriod < 0 || tc.CPUCFSPeriod > 1000000 {
+		return fmt.Errorf("cpu_cfs_period must be between 0 and 1000000")
+	}
+
+	if tc.Tail && tc.Concurrency != "" && tc.Concurrency != watcher.ConcurrencyQueue {
+		return fmt.Errorf("tail requires concurrency = %q", watcher.ConcurrencyQueue)
+	}
+
+	if tc.TailBatchSize < 0 {
+		return fmt.Errorf("tail_batch_size must be non-negative")
+	}
+
+	// Validate line matching
+	if tc.Match != nil {
+		if !tc.Tail {
+			return fmt.Errorf("match requires tail to be enabled")
+		}
+
+		if tc.Match.MultilineMaxLines < 0 {
+			return fmt.Errorf("match multiline_max_lines must be non-negative")
+		}
+
+		if tc.Match.MultilineTimeoutMS < 0 {
+			return fmt.Errorf("match multiline_timeout_ms must be non-negative")
+		}
+
+		if err := tc.Match.watcherConfig().Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the webhook
+	if tc.Webhook != nil {
+		if tc.ServiceCommand != "" {
+			return fmt.Errorf("webhook cannot be combined with service_command")
+		}
+
+		if err := tc.Webhook.watcherConfig().Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the file operations
+	if len(tc.FileOps) > 0 {
+		if tc.ServiceCommand != "" {
+			return fmt.Errorf("file_op cannot be combined with service_command")
+		}
+
+		if err := tc.fileOpsConfig().Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the sync destination
+	if tc.Sync != nil {
+		if tc.ServiceCommand != "" {
+			return fmt.Errorf("sync cannot be combined with service_command")
+		}
+		if tc.Sync.Dest == "" {
+			return fmt.Errorf("sync dest must be specified")
+		}
+		if tc.Sync.VerifyInterval < 0 {
+			return fmt.Errorf("sync verify_interval must be non-negative")
+		}
+	}
+
+	// Validate the event sink
+	if tc.Sink != nil {
+		if err := tc.Sink.watcherConfig().Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the syslog output
+	if tc.Syslog != nil {
+		if tc.ServiceCommand != "" {
+			return fmt.Errorf("syslog cannot be combined with service_command")
+		}
+
+		if err := tc.Syslog.watcherConfig().Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the Nomad API actions
+	if actions := tc.nomadActions(); len(actions) > 0 {
+		if tc.ServiceCommand != "" {
+			return fmt.Errorf("nomad actions cannot be combined with service_command")
+		}
+
+		for _, action := range actions {
+			if err := action.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Validate the NATS publisher
+	if tc.NATS != nil {
+		if tc.ServiceCommand != "" {
+			return fmt.Errorf("nats cannot be combined with service_command")
+		}
+
+		natsConfig, publishConfig := tc.NATS.watcherConfig("", "spool")
+		if err := natsConfig.Validate(); err != nil {
+			return err
+		}
+		if err := publishConfig.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the Redis publisher
+	if tc.Redis != nil {
+		if tc.ServiceCommand != "" {
+			return fmt.Errorf("redis cannot be combined with service_command")
+		}
+
+		redisConfig, publishConfig := tc.Redis.watcherConfig("", "spool")
+		if err := redisConfig.Validate(); err != nil {
+			return err
+		}
+		if err := publishConfig.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the supervised service
+	if tc.ServiceCommand != "" {
+		if tc.Tail {
+			return fmt.Errorf("service_command cannot be combined with tail")
+		}
+
+		if _, err := tc.serviceConfig(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -214,10 +1344,23 @@ func (tc *TaskConfig) Validate() error {
 func DefaultTaskConfig() *TaskConfig {
 	return &TaskConfig{
 		RecursiveWatch: false,
+		PathsReadOnly:  true,
 		RetryInterval:  30,
 		MaxRetries:     3,
 		Timeout:        60,
 		Environment:    make(map[string]string),
+
+		ContentHashMaxSize:   1048576,
+		ContentHashCacheSize: 10000,
+		Concurrency:          watcher.ConcurrencyQueue,
+		MaxConcurrent:        0,
+		CPUCFSPeriod:         defaultCPUPeriod,
+
+		ServiceOnChange:     watcher.ServiceRestart,
+		ServiceStopSignal:   "SIGTERM",
+		ServiceReloadSignal: "SIGHUP",
+		ServiceGracePeriod:  5,
+		ServiceDebounceMS:   500,
 	}
 }
 
@@ -250,10 +1393,34 @@ func (tc *TaskConfig) Merge(other *TaskConfig) *TaskConfig {
 		}
 	}
 
+	if other.InheritEnv {
+		result.InheritEnv = true
+	}
+
+	if other.WorkingDir != "" {
+		result.WorkingDir = other.WorkingDir
+	}
+
+	if other.Stdin != "" {
+		result.Stdin = other.Stdin
+	}
+
+	if other.OutputPrefix {
+		result.OutputPrefix = true
+	}
+
 	if other.RecursiveWatch {
 		result.RecursiveWatch = true
 	}
 
+	if other.PathsReadOnly {
+		result.PathsReadOnly = true
+	}
+
+	if other.FollowSymlinks {
+		result.FollowSymlinks = true
+	}
+
 	if len(other.IgnorePatterns) > 0 {
 		result.IgnorePatterns = other.IgnorePatterns
 	}
@@ -270,5 +1437,313 @@ func (tc *TaskConfig) Merge(other *TaskConfig) *TaskConfig {
 		result.Timeout = other.Timeout
 	}
 
+	if other.DrainOnStop {
+		result.DrainOnStop = true
+	}
+
+	if other.Concurrency != "" {
+		result.Concurrency = other.Concurrency
+	}
+
+	if other.MaxConcurrent > 0 {
+		result.MaxConcurrent = other.MaxConcurrent
+	}
+
+	if other.ContentHash != "" {
+		result.ContentHash = other.ContentHash
+	}
+
+	if other.ContentHashMaxSize > 0 {
+		result.ContentHashMaxSize = other.ContentHashMaxSize
+	}
+
+	if other.ContentHashCacheSize > 0 {
+		result.ContentHashCacheSize = other.ContentHashCacheSize
+	}
+
+	if other.Tail {
+		result.Tail = true
+	}
+
+	if other.TailBatchSize > 0 {
+		result.TailBatchSize = other.TailBatchSize
+	}
+
+	if other.DrainRotated {
+		result.DrainRotated = true
+	}
+
+	if other.Match != nil {
+		result.Match = other.Match
+	}
+
+	if other.Webhook != nil {
+		result.Webhook = other.Webhook
+	}
+
+	if len(other.FileOps) > 0 {
+		result.FileOps = other.FileOps
+	}
+
+	if other.Sync != nil {
+		result.Sync = other.Sync
+	}
+
+	if other.Sink != nil {
+		result.Sink = other.Sink
+	}
+
+	if other.Syslog != nil {
+		result.Syslog = other.Syslog
+	}
+
+	if len(other.NomadDispatch) > 0 {
+		result.NomadDispatch = other.NomadDispatch
+	}
+
+	if len(other.NomadRestart) > 0 {
+		result.NomadRestart = other.NomadRestart
+	}
+
+	if len(other.NomadSignal) > 0 {
+		result.NomadSignal = other.NomadSignal
+	}
+
+	if other.NATS != nil {
+		result.NATS = other.NATS
+	}
+
+	if other.Redis != nil {
+		result.Redis = other.Redis
+	}
+
+	if other.ServiceCommand != "" {
+		result.ServiceCommand = other.ServiceCommand
+	}
+
+	if len(other.ServiceArgs) > 0 {
+		result.ServiceArgs = other.ServiceArgs
+	}
+
+	if other.ServiceOnChange != "" {
+		result.ServiceOnChange = other.ServiceOnChange
+	}
+
+	if other.ServiceStopSignal != "" {
+		result.ServiceStopSignal = other.ServiceStopSignal
+	}
+
+	if other.ServiceReloadSignal != "" {
+		result.ServiceReloadSignal = other.ServiceReloadSignal
+	}
+
+	if other.ServiceGracePeriod > 0 {
+		result.ServiceGracePeriod = other.ServiceGracePeriod
+	}
+
+	if other.ServiceDebounceMS > 0 {
+		result.ServiceDebounceMS = other.ServiceDebounceMS
+	}
+
 	return &result
 }
+
+// watcherConfig converts the match block into its watcher representation
+func (mc *MatchConfig) watcherConfig() watcher.MatchConfig {
+	return watcher.MatchConfig{
+		Patterns:          mc.Patterns,
+		MultilineStart:    mc.MultilineStart,
+		MultilineMaxLines: mc.MultilineMaxLines,
+		MultilineTimeout:  time.Duration(mc.MultilineTimeoutMS) * time.Millisecond,
+	}
+}
+
+// serviceConfig converts the service options into their watcher
+// representation
+func (tc *TaskConfig) serviceConfig() (watcher.ServiceConfig, error) {
+	stopSignal, err := parseSignal(tc.ServiceStopSignal)
+	if err != nil {
+		return watcher.ServiceConfig{}, fmt.Errorf("invalid service_stop_signal: %v", err)
+	}
+
+	reloadSignal, err := parseSignal(tc.ServiceReloadSignal)
+	if err != nil {
+		return watcher.ServiceConfig{}, fmt.Errorf("invalid service_reload_signal: %v", err)
+	}
+
+	cfg := watcher.ServiceConfig{
+		Command:      tc.ServiceCommand,
+		Args:         tc.ServiceArgs,
+		OnChange:     tc.ServiceOnChange,
+		StopSignal:   stopSignal,
+		ReloadSignal: reloadSignal,
+		GracePeriod:  time.Duration(tc.ServiceGracePeriod) * time.Second,
+		Debounce:     time.Duration(tc.ServiceDebounceMS) * time.Millisecond,
+	}
+	return cfg, cfg.Validate()
+}
+
+// watcherConfig converts the webhook block into its watcher representation
+func (wc *WebhookConfig) watcherConfig() watcher.WebhookConfig {
+	return watcher.WebhookConfig{
+		URL:        wc.URL,
+		Method:     wc.Method,
+		Headers:    wc.Headers,
+		Body:       wc.Body,
+		AuthHeader: wc.AuthHeader,
+		AuthEnv:    wc.AuthEnv,
+		TLS: watcher.WebhookTLSConfig{
+			CACert:     wc.TLSCACert,
+			ClientCert: wc.TLSClientCert,
+			ClientKey:  wc.TLSClientKey,
+			ServerName: wc.TLSServerName,
+			SkipVerify: wc.TLSSkipVerify,
+		},
+		Timeout:       time.Duration(wc.Timeout) * time.Second,
+		MaxRetries:    wc.MaxRetries,
+		RetryBackoff:  time.Duration(wc.RetryBackoffMS) * time.Millisecond,
+		BatchSize:     wc.BatchSize,
+		BatchInterval: time.Duration(wc.BatchIntervalMS) * time.Millisecond,
+	}
+}
+
+// fileOpsConfig converts the file_op blocks into their watcher
+// representation
+func (tc *TaskConfig) fileOpsConfig() watcher.FileOpsConfig {
+	var cfg watcher.FileOpsConfig
+	for _, op := range tc.FileOps {
+		cfg.Steps = append(cfg.Steps, watcher.FileStep{
+			Op:         op.Op,
+			Dest:       op.Dest,
+			Format:     op.Format,
+			Algorithm:  op.Algorithm,
+			KeepSource: op.KeepSource,
+		})
+	}
+	return cfg
+}
+
+// watcherConfig converts the sync block into its watcher representation
+func (sc *SyncConfig) watcherConfig() watcher.SyncConfig {
+	return watcher.SyncConfig{
+		Dest:           sc.Dest,
+		VerifyInterval: time.Duration(sc.VerifyInterval) * time.Second,
+		DryRun:         sc.DryRun,
+	}
+}
+
+// watcherConfig converts the sink block into its watcher representation
+func (sc *SinkConfig) watcherConfig() watcher.SinkConfig {
+	return watcher.SinkConfig{
+		Type:       sc.Type,
+		Path:       sc.Path,
+		Fields:     sc.Fields,
+		MaxSize:    int64(sc.MaxSizeMB) * 1024 * 1024,
+		MaxFiles:   sc.MaxFiles,
+		BufferSize: sc.BufferSize,
+	}
+}
+
+// watcherConfig converts the syslog block into its watcher representation
+func (sc *SyslogConfig) watcherConfig() watcher.SyslogConfig {
+	cfg := watcher.SyslogConfig{
+		Transport: sc.Transport,
+		Address:   sc.Address,
+		Tag:       sc.Tag,
+		Facility:  sc.Facility,
+		Severity:  sc.Severity,
+	}
+	for _, rule := range sc.Rules {
+		cfg.Rules = append(cfg.Rules, watcher.SyslogRule{
+			Pattern:  rule.Pattern,
+			Events:   rule.Events,
+			Facility: rule.Facility,
+			Severity: rule.Severity,
+		})
+	}
+	return cfg
+}
+
+// nomadActions converts the nomad_dispatch, nomad_restart and nomad_signal
+// blocks into their watcher representation
+func (tc *TaskConfig) nomadActions() []watcher.NomadActionConfig {
+	var actions []watcher.NomadActionConfig
+	for _, d := range tc.NomadDispatch {
+		actions = append(actions, watcher.NomadActionConfig{
+			Action:  watcher.NomadDispatch,
+			Job:     d.Job,
+			Meta:    d.Meta,
+			Payload: d.Payload,
+		})
+	}
+	for _, r := range tc.NomadRestart {
+		actions = append(actions, watcher.NomadActionConfig{
+			Action: watcher.NomadRestart,
+			Task:   r.Task,
+		})
+	}
+	for _, sig := range tc.NomadSignal {
+		actions = append(actions, watcher.NomadActionConfig{
+			Action: watcher.NomadSignal,
+			Task:   sig.Task,
+			Signal: sig.Signal,
+		})
+	}
+	return actions
+}
+
+// watcherConfig converts the nats block into its watcher representation,
+// authenticating with token and spooling to spoolFile
+func (nc *NATSConfig) watcherConfig(token, spoolFile string) (watcher.NATSConfig, watcher.PublishConfig) {
+	natsConfig := watcher.NATSConfig{
+		URL:        nc.URL,
+		JetStream:  nc.JetStream,
+		Stream:     nc.Stream,
+		CredsFile:  nc.CredsFile,
+		Token:      token,
+		CACert:     nc.TLSCACert,
+		ClientCert: nc.TLSClientCert,
+		ClientKey:  nc.TLSClientKey,
+	}
+
+	publishConfig := watcher.PublishConfig{
+		Subject:    nc.Subject,
+		SpoolFile:  spoolFile,
+		SpoolLimit: int64(nc.SpoolLimitMB) * 1024 * 1024,
+	}
+	for _, rule := range nc.Rules {
+		publishConfig.Rules = append(publishConfig.Rules, watcher.PublishRule{
+			Pattern: rule.Pattern,
+			Events:  rule.Events,
+			Subject: rule.Subject,
+		})
+	}
+	return natsConfig, publishConfig
+}
+
+// watcherConfig converts the redis block into its watcher representation,
+// authenticating with password and spooling to spoolFile
+func (rc *RedisConfig) watcherConfig(password, spoolFile string) (watcher.RedisConfig, watcher.PublishConfig) {
+	redisConfig := watcher.RedisConfig{
+		Address:  rc.Address,
+		Username: rc.Username,
+		Password: password,
+		DB:       rc.DB,
+		Mode:     rc.Mode,
+		MaxLen:   int64(rc.MaxLen),
+	}
+
+	publishConfig := watcher.PublishConfig{
+		Subject:    rc.Key,
+		SpoolFile:  spoolFile,
+		SpoolLimit: int64(rc.SpoolLimitMB) * 1024 * 1024,
+	}
+	for _, rule := range rc.Rules {
+		publishConfig.Rules = append(publishConfig.Rules, watcher.PublishRule{
+			Pattern: rule.Pattern,
+			Events:  rule.Events,
+			Subject: rule.Subject,
+		})
+	}
+	return redisConfig, publishConfig
+}
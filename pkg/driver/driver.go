@@ -3,10 +3,12 @@ package driver
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/lib/fifo"
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
@@ -24,6 +26,7 @@ type Driver struct {
 	eventer        *eventer.Eventer
 	config         *Config
 	tasks          map[string]*TaskHandle
+	metrics        *metrics
 	ctx            context.Context
 	signalShutdown context.CancelFunc
 	logger         hclog.Logger
@@ -34,7 +37,7 @@ func NewFileWatcherDriver(logger hclog.Logger) drivers.DriverPlugin {
 	ctx, cancel := context.WithCancel(context.Background())
 	logger = logger.Named(pluginName)
 
-	return &Driver{
+	d := &Driver{
 		eventer:        eventer.NewEventer(ctx, logger),
 		config:         &Config{},
 		tasks:          make(map[string]*TaskHandle),
@@ -42,6 +45,11 @@ func NewFileWatcherDriver(logger hclog.Logger) drivers.DriverPlugin {
 		signalShutdown: cancel,
 		logger:         logger,
 	}
+
+	// Tasks record their metrics from the start, so that they are reported
+	// once a later SetConfig enables the listener
+	d.metrics = newMetrics(d)
+	return d
 }
 
 func (d *Driver) PluginInfo() (*base.PluginInfoResponse, error) {
@@ -65,8 +73,17 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	switch config.FSIsolation {
+	case "", fsIsolationNone, fsIsolationChroot:
+	default:
+		return fmt.Errorf("invalid fs_isolation: %s", config.FSIsolation)
+	}
+
 	d.config = &config
-	return nil
+
+	// The metrics are shared by all tasks, the listener follows changes of
+	// the configured address
+	return d.metrics.listen(d.ctx, config.MetricsAddress, d.logger)
 }
 
 func (d *Driver) TaskConfigSchema() (*hclspec.Spec, error) {
@@ -75,15 +92,26 @@ func (d *Driver) TaskConfigSchema() (*hclspec.Spec, error) {
 
 func (d *Driver) Capabilities() (*drivers.Capabilities, error) {
 	return &drivers.Capabilities{
-		SendSignals: false,
-		Exec:        false,
+		SendSignals: true,
+		Exec:        true,
+		FSIsolation: d.fsIsolation(),
 	}, nil
 }
 
-func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+// fsIsolation returns the filesystem isolation configured for the plugin.
+// With chroot isolation the Nomad client builds a chroot in every task dir
+// and handler commands are run inside it.
+func (d *Driver) fsIsolation() drivers.FSIsolation {
+	if d.config.FSIsolation == fsIsolationChroot {
+		return drivers.FSIsolationChroot
+	}
+	return drivers.FSIsolationNone
+}
 
+// StartTask starts watching for a task. The driver lock is only taken to
+// register the task, as connecting publishers and starting the watcher may
+// take a while.
+func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
 	var taskConfig TaskConfig
 	if err := cfg.DecodeDriverConfig(&taskConfig); err != nil {
 		return nil, nil, fmt.Errorf("failed to decode driver config: %v", err)
@@ -94,6 +122,195 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		return nil, nil, fmt.Errorf("invalid config: %v", err)
 	}
 
+	// Open the task log FIFOs so command output shows up in nomad alloc logs
+	stdout, err := fifo.OpenWriter(cfg.StdoutPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open stdout: %v", err)
+	}
+
+	stderr, err := fifo.OpenWriter(cfg.StderrPath)
+	if err != nil {
+		stdout.Close()
+		return nil, nil, fmt.Errorf("failed to open stderr: %v", err)
+	}
+
+	h := &TaskHandle{
+		name:       cfg.Name,
+		allocID:    cfg.AllocID,
+		taskConfig: &taskConfig,
+		stdout:     stdout,
+		stderr:     stderr,
+		exitResult: &drivers.ExitResult{},
+		doneCh:     make(chan struct{}),
+	}
+
+	opts := []watcher.Option{
+		watcher.WithTaskInfo(cfg.ID, cfg.AllocID),
+		watcher.WithTaskEvents(func(message string, annotations map[string]string) {
+			d.emitEvent(cfg, message, annotations)
+		}),
+		watcher.WithStdin(taskConfig.Stdin),
+		watcher.WithOutput(watcher.OutputConfig{
+			Stdout:        stdout,
+			Stderr:        stderr,
+			PrefixEventID: taskConfig.OutputPrefix,
+		}),
+	}
+
+	// Handler commands are chrooted into the task dir with the watched paths
+	// bind mounted at their host location. The shared Nomad executor is not
+	// used as it cannot pass stdin, which tail and event_json modes rely on.
+	execConfig := watcher.ExecConfig{
+		Env:        cfg.Env,
+		InheritEnv: taskConfig.InheritEnv,
+		User:       cfg.User,
+		Dir:        cfg.TaskDir().Dir,
+	}
+	if d.fsIsolation() == drivers.FSIsolationChroot {
+		mounts, err := mountPaths(cfg.TaskDir().Dir, taskConfig.Paths, taskConfig.PathsReadOnly)
+		if err != nil {
+			h.closeLogs()
+			return nil, nil, fmt.Errorf("failed to mount watched paths: %v", err)
+		}
+		h.mounts = mounts
+		execConfig.Chroot = cfg.TaskDir().Dir
+		execConfig.Dir = "/"
+	}
+
+	// Confine handler commands to the task's resources
+	cg, err := newCgroup(cgroupName(cfg), cfg.Resources, taskConfig.CPUHardLimit, taskConfig.CPUCFSPeriod)
+	if err != nil {
+		d.logger.Warn("resource limits are not enforced", "task", cfg.Name, "error", err)
+		d.emitEvent(cfg, fmt.Sprintf("Resource limits are not enforced: %v", err), nil)
+	} else {
+		cg.onOOM = func(event *watcher.Event) {
+			h.recordOOM()
+			// Commands not run for an event, such as the service, have none
+			if event == nil {
+				d.emitEvent(cfg, "Process was OOM killed", nil)
+				return
+			}
+			d.emitEvent(cfg, "Handler command was OOM killed", map[string]string{
+				"path":     event.Path,
+				"sequence": fmt.Sprintf("%d", event.Sequence),
+			})
+		}
+		h.cgroup = cg
+		execConfig.Hook = cg
+	}
+	opts = append(opts, watcher.WithExec(execConfig))
+
+	opts = append(opts, watcher.WithConcurrency(taskConfig.Concurrency))
+	opts = append(opts, watcher.WithMaxConcurrent(taskConfig.MaxConcurrent))
+	opts = append(opts, watcher.WithTimeout(time.Duration(taskConfig.Timeout)*time.Second))
+
+	opts = append(opts, watcher.WithMetrics(d.metrics.forTask(cfg)))
+
+	if taskConfig.WorkingDir != "" {
+		opts = append(opts, watcher.WithWorkingDir(taskConfig.WorkingDir))
+	}
+
+	if taskConfig.ContentHash != "" {
+		opts = append(opts, watcher.WithContentHash(watcher.ContentHashConfig{
+			Algorithm:   taskConfig.ContentHash,
+			MaxFileSize: int64(taskConfig.ContentHashMaxSize),
+			CacheSize:   taskConfig.ContentHashCacheSize,
+		}))
+	}
+
+	if taskConfig.FollowSymlinks {
+		opts = append(opts, watcher.WithFollowSymlinks())
+	}
+
+	if taskConfig.Tail {
+		opts = append(opts, watcher.WithTail(watcher.TailConfig{
+			StateFile:    d.taskStatePath(cfg, "tail.json"),
+			BatchSize:    taskConfig.TailBatchSize,
+			DrainRotated: taskConfig.DrainRotated,
+		}))
+	}
+
+	if taskConfig.Match != nil {
+		opts = append(opts, watcher.WithMatch(taskConfig.Match.watcherConfig()))
+	}
+
+	if taskConfig.Webhook != nil {
+		opts = append(opts, watcher.WithWebhook(taskConfig.Webhook.watcherConfig()))
+	}
+
+	if len(taskConfig.FileOps) > 0 {
+		opts = append(opts, watcher.WithFileOps(taskConfig.fileOpsConfig()))
+	}
+
+	if taskConfig.Sync != nil {
+		opts = append(opts, watcher.WithSync(taskConfig.Sync.watcherConfig()))
+	}
+
+	if taskConfig.Sink != nil {
+		// Relative sink paths are resolved against the task dir
+		sinkConfig := taskConfig.Sink.watcherConfig()
+		if !filepath.IsAbs(sinkConfig.Path) {
+			sinkConfig.Path = filepath.Join(cfg.TaskDir().Dir, sinkConfig.Path)
+		}
+		opts = append(opts, watcher.WithSink(sinkConfig))
+	}
+
+	if taskConfig.Syslog != nil {
+		opts = append(opts, watcher.WithSyslog(taskConfig.Syslog.watcherConfig()))
+	}
+
+	for _, action := range taskConfig.nomadActions() {
+		opts = append(opts, watcher.WithNomadAction(action))
+	}
+
+	// Publishers are owned by the watcher once it is created
+	var publishers []watcher.Publisher
+	closePublishers := func() {
+		for _, publisher := range publishers {
+			publisher.Close()
+		}
+	}
+
+	if taskConfig.NATS != nil {
+		natsConfig, publishConfig := taskConfig.NATS.watcherConfig(
+			cfg.Env[taskConfig.NATS.TokenEnv],
+			d.taskStatePath(cfg, "nats-spool.jsonl"),
+		)
+		natsConfig.Name = fmt.Sprintf("nomad-filewatcher %s/%s", cfg.AllocID, cfg.Name)
+		publisher, err := watcher.NewNATSPublisher(natsConfig)
+		if err != nil {
+			h.cleanup()
+			return nil, nil, err
+		}
+		publishers = append(publishers, publisher)
+		opts = append(opts, watcher.WithPublisher("nats", publisher, publishConfig))
+	}
+
+	if taskConfig.Redis != nil {
+		redisConfig, publishConfig := taskConfig.Redis.watcherConfig(
+			cfg.Env[taskConfig.Redis.PasswordEnv],
+			d.taskStatePath(cfg, "redis-spool.jsonl"),
+		)
+		publisher, err := watcher.NewRedisPublisher(redisConfig)
+		if err != nil {
+			closePublishers()
+			h.cleanup()
+			return nil, nil, err
+		}
+		publishers = append(publishers, publisher)
+		opts = append(opts, watcher.WithPublisher("redis", publisher, publishConfig))
+	}
+
+	if taskConfig.ServiceCommand != "" {
+		serviceConfig, err := taskConfig.serviceConfig()
+		if err != nil {
+			closePublishers()
+			h.cleanup()
+			return nil, nil, fmt.Errorf("invalid config: %v", err)
+		}
+		opts = append(opts, watcher.WithService(serviceConfig))
+	}
+
 	// Create file watcher instance
 	fw, err := watcher.NewFileWatcher(
 		d.logger.Named(cfg.Name),
@@ -104,24 +321,27 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		taskConfig.Environment,
 		taskConfig.IgnorePatterns,
 		taskConfig.RecursiveWatch,
+		opts...,
 	)
 	if err != nil {
+		closePublishers()
+		h.cleanup()
 		return nil, nil, fmt.Errorf("failed to create file watcher: %v", err)
 	}
 
 	// Start the watcher
 	if err := fw.Start(); err != nil {
+		fw.Cleanup()
+		h.cleanup()
 		return nil, nil, fmt.Errorf("failed to start file watcher: %v", err)
 	}
 
-	h := &TaskHandle{
-		taskConfig: &taskConfig,
-		watcher:    fw,
-		exitResult: &drivers.ExitResult{},
-		startedAt:  time.Now(),
-	}
+	h.watcher = fw
+	h.startedAt = time.Now()
 
+	d.lock.Lock()
 	d.tasks[cfg.ID] = h
+	d.lock.Unlock()
 
 	driverHandle := drivers.NewTaskHandle(drivers.Version, cfg.ID, pluginName, cfg.AllocID)
 	return driverHandle, nil, nil
@@ -142,43 +362,100 @@ func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.E
 
 	ch := make(chan *drivers.ExitResult)
 	go func() {
-		<-ctx.Done()
-		close(ch)
+		defer close(ch)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-handle.doneCh:
+		}
+
+		select {
+		case <-ctx.Done():
+		case ch <- handle.result():
+		}
 	}()
 
 	return ch, nil
 }
 
+// StopTask stops watching and sends signal to the process groups of the
+// in-flight handler commands, killing those still running after timeout.
+// With drain_on_stop the events already received are handled first.
 func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-
+	d.lock.RLock()
 	handle, exists := d.tasks[taskID]
+	d.lock.RUnlock()
+
 	if !exists {
 		return drivers.ErrTaskNotFound
 	}
 
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+
 	if handle.watcher != nil {
-		handle.watcher.Stop()
+		handle.watcher.Shutdown(sig, timeout, handle.taskConfig.DrainOnStop)
 	}
+	handle.markExited()
 
 	return nil
 }
 
+// SignalTask maps SIGHUP to rescanning the watched paths, SIGUSR1 to dumping
+// the watcher state to the task log and SIGUSR2 to pausing or resuming
+// dispatch. Other signals are forwarded to the running handler commands.
+func (d *Driver) SignalTask(taskID string, signal string) error {
+	d.lock.RLock()
+	handle, exists := d.tasks[taskID]
+	d.lock.RUnlock()
+
+	if !exists {
+		return drivers.ErrTaskNotFound
+	}
+
+	if handle.watcher == nil || !handle.IsRunning() {
+		return fmt.Errorf("task is not running")
+	}
+
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+
+	return signalWatcher(handle.watcher, sig)
+}
+
+// DestroyTask removes a task. It is unregistered under the driver lock and
+// killed after releasing it, so that waiting for its commands does not stall
+// the other tasks.
 func (d *Driver) DestroyTask(taskID string, force bool) error {
 	d.lock.Lock()
-	defer d.lock.Unlock()
-
 	handle, exists := d.tasks[taskID]
 	if !exists {
+		d.lock.Unlock()
 		return drivers.ErrTaskNotFound
 	}
+	if handle.IsRunning() && !force {
+		d.lock.Unlock()
+		return fmt.Errorf("cannot destroy running task")
+	}
+	delete(d.tasks, taskID)
+	d.lock.Unlock()
 
-	if handle.watcher != nil {
-		handle.watcher.Stop()
+	if handle.IsRunning() {
+		if handle.watcher != nil {
+			handle.watcher.Kill()
+		}
+		handle.markExited()
+	}
+	if err := handle.cleanup(); err != nil {
+		d.logger.Warn("failed to clean up task", "task_id", taskID, "error", err)
 	}
 
-	delete(d.tasks, taskID)
+	d.metrics.remove(handle.name, handle.allocID)
 	return nil
 }
 
@@ -191,18 +468,63 @@ func (d *Driver) InspectTask(taskID string) (*drivers.TaskStatus, error) {
 		return nil, drivers.ErrTaskNotFound
 	}
 
+	state := drivers.TaskStateRunning
+	if !handle.IsRunning() {
+		state = drivers.TaskStateExited
+	}
+
 	return &drivers.TaskStatus{
-		ID:          taskID,
-		Name:        handle.taskConfig.Paths[0],
-		State:       drivers.TaskStateRunning,
-		StartedAt:   handle.startedAt,
-		CompletedAt: handle.completedAt,
-		ExitResult:  handle.exitResult,
+		ID:               taskID,
+		Name:             handle.taskConfig.Paths[0],
+		State:            state,
+		StartedAt:        handle.startedAt,
+		CompletedAt:      handle.completedAt,
+		ExitResult:       handle.result(),
+		DriverAttributes: handle.serviceAttributes(),
 	}, nil
 }
 
 func (d *Driver) TaskStats(ctx context.Context, taskID string, interval time.Duration) (<-chan *drivers.TaskResourceUsage, error) {
-	return nil, nil
+	d.lock.RLock()
+	handle, exists := d.tasks[taskID]
+	d.lock.RUnlock()
+
+	if !exists {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	if handle.cgroup == nil {
+		return nil, drivers.DriverStatsNotImplemented
+	}
+
+	ch := make(chan *drivers.TaskResourceUsage)
+	go handle.collectStats(ctx, ch, interval)
+	return ch, nil
+}
+
+// emitEvent emits a task event shown in nomad alloc status
+func (d *Driver) emitEvent(cfg *drivers.TaskConfig, message string, annotations map[string]string) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		TaskName:    cfg.Name,
+		AllocID:     cfg.AllocID,
+		Timestamp:   time.Now(),
+		Message:     message,
+		Annotations: annotations,
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit task event", "task", cfg.Name, "error", err)
+	}
+}
+
+// cgroupName returns the name of the cgroup of a task
+func cgroupName(cfg *drivers.TaskConfig) string {
+	return fmt.Sprintf("%s.%s", cfg.AllocID, cfg.Name)
+}
+
+// taskStatePath returns the path of a per task state file in the state dir
+func (d *Driver) taskStatePath(cfg *drivers.TaskConfig, name string) string {
+	return filepath.Join(d.config.StateDir, cfg.AllocID, cfg.Name, name)
 }
 
 func (d *Driver) validateConfig(config *TaskConfig) error {
@@ -214,5 +536,5 @@ func (d *Driver) validateConfig(config *TaskConfig) error {
 		return fmt.Errorf("at least one event type must be specified")
 	}
 
-	return nil
+	return config.Validate()
 }
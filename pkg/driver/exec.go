@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// ExecTask runs a command in the environment and isolation of the task's
+// handler commands and returns its output
+func (d *Driver) ExecTask(taskID string, command []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	handle, err := d.execHandle(taskID, command)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+
+	cmd, err := handle.watcher.Command(ctx, command[0], command[1:]...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare command: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := handle.watcher.StartCommand(cmd); err != nil {
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+	err = cmd.Wait()
+
+	result, err := commandExitResult(cmd, err)
+	if err != nil {
+		return nil, err
+	}
+	return &drivers.ExecTaskResult{
+		Stdout:     stdout.Bytes(),
+		Stderr:     stderr.Bytes(),
+		ExitResult: result,
+	}, nil
+}
+
+// ExecTaskStreaming runs an interactive command for nomad alloc exec in the
+// environment and isolation of the task's handler commands
+func (d *Driver) ExecTaskStreaming(ctx context.Context, taskID string, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
+	handle, err := d.execHandle(taskID, opts.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := handle.watcher.Command(ctx, opts.Command[0], opts.Command[1:]...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare command: %v", err)
+	}
+
+	if opts.Tty {
+		err = execTTY(handle, cmd, opts)
+	} else {
+		err = execPipes(handle, cmd, opts)
+	}
+	return commandExitResult(cmd, err)
+}
+
+func (d *Driver) execHandle(taskID string, command []string) (*TaskHandle, error) {
+	d.lock.RLock()
+	handle, exists := d.tasks[taskID]
+	d.lock.RUnlock()
+
+	if !exists {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	if len(command) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+
+	if handle.watcher == nil || !handle.IsRunning() {
+		return nil, fmt.Errorf("task is not running")
+	}
+	return handle, nil
+}
+
+// execPipes runs cmd with the exec session streams attached directly
+func execPipes(handle *TaskHandle, cmd *exec.Cmd, opts *drivers.ExecOptions) error {
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+
+	// Stdin is copied by hand so that Wait does not block on a session
+	// that keeps its input open after the command exited
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := handle.watcher.StartCommand(cmd); err != nil {
+		return fmt.Errorf("failed to start command: %v", err)
+	}
+
+	go func() {
+		io.Copy(stdin, opts.Stdin)
+		stdin.Close()
+	}()
+
+	return cmd.Wait()
+}
+
+// commandExitResult converts the exit state of cmd into an exit result.
+// Errors other than the command exiting unsuccessfully are returned.
+func commandExitResult(cmd *exec.Cmd, err error) (*drivers.ExitResult, error) {
+	if cmd.ProcessState == nil {
+		if err == nil {
+			err = fmt.Errorf("command did not run")
+		}
+		return nil, err
+	}
+
+	result := &drivers.ExitResult{
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Err:      err,
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Signal = int(status.Signal())
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		result.Err = nil
+	}
+	return result, nil
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+
+package driver
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"syscall"
+
+	"github.com/creack/pty"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// execTTY runs cmd on a pseudo-terminal attached to the exec session. The
+// terminal is set up by hand rather than with pty.Start so the credential,
+// chroot and cgroup settings already applied to cmd are kept.
+func execTTY(handle *TaskHandle, cmd *exec.Cmd, opts *drivers.ExecOptions) error {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open pty: %v", err)
+	}
+	defer ptmx.Close()
+
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	err = handle.watcher.StartCommand(cmd)
+	tty.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start command: %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case size, ok := <-opts.ResizeCh:
+				if !ok {
+					return
+				}
+				pty.Setsize(ptmx, &pty.Winsize{
+					Rows: uint16(size.Height),
+					Cols: uint16(size.Width),
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go io.Copy(ptmx, opts.Stdin)
+
+	// Reading the terminal fails with EIO once the command and its children
+	// have exited
+	output := make(chan struct{})
+	go func() {
+		io.Copy(opts.Stdout, ptmx)
+		close(output)
+	}()
+
+	err = cmd.Wait()
+	<-output
+	return err
+}
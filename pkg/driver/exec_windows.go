@@ -0,0 +1,14 @@
+//go:build windows
+
+package driver
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func execTTY(handle *TaskHandle, cmd *exec.Cmd, opts *drivers.ExecOptions) error {
+	return fmt.Errorf("tty is not supported on windows")
+}
@@ -1,6 +1,9 @@
 package driver
 
 import (
+	"context"
+	"io"
+	"strconv"
 	"sync"
 	"time"
 
@@ -10,11 +13,19 @@ import (
 
 type TaskHandle struct {
 	mutex       sync.RWMutex
+	name        string
+	allocID     string
 	taskConfig  *TaskConfig
 	watcher     *watcher.FileWatcher
+	stdout      io.WriteCloser
+	stderr      io.WriteCloser
+	mounts      []string
+	cgroup      *cgroup
 	exitResult  *drivers.ExitResult
 	startedAt   time.Time
 	completedAt time.Time
+	doneCh      chan struct{}
+	exited      bool
 }
 
 func (h *TaskHandle) TaskStatus() *drivers.TaskStatus {
@@ -24,9 +35,127 @@ func (h *TaskHandle) TaskStatus() *drivers.TaskStatus {
 	return &drivers.TaskStatus{
 		ID:          h.taskConfig.Paths[0],
 		Name:        "filewatcher",
-		State:       drivers.TaskStateRunning,
+		State:       h.stateLocked(),
 		StartedAt:   h.startedAt,
 		CompletedAt: h.completedAt,
 		ExitResult:  h.exitResult,
 	}
 }
+
+func (h *TaskHandle) stateLocked() drivers.TaskState {
+	if h.exited {
+		return drivers.TaskStateExited
+	}
+	return drivers.TaskStateRunning
+}
+
+// IsRunning reports whether the task has not been stopped yet
+func (h *TaskHandle) IsRunning() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return !h.exited
+}
+
+// markExited records the task as stopped and wakes up WaitTask callers
+func (h *TaskHandle) markExited() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.exited {
+		return
+	}
+	h.exited = true
+	h.completedAt = time.Now()
+	close(h.doneCh)
+}
+
+// result returns a copy of the exit result of the task
+func (h *TaskHandle) result() *drivers.ExitResult {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.exitResult.Copy()
+}
+
+// serviceAttributes reports the health of the supervised service
+func (h *TaskHandle) serviceAttributes() map[string]string {
+	if h.watcher == nil {
+		return nil
+	}
+	status, ok := h.watcher.ServiceStatus()
+	if !ok {
+		return nil
+	}
+
+	attrs := map[string]string{
+		"service_state":     status.State,
+		"service_restarts":  strconv.Itoa(status.Restarts),
+		"service_exit_code": strconv.Itoa(status.ExitCode),
+	}
+	if status.Pid != 0 {
+		attrs["service_pid"] = strconv.Itoa(status.Pid)
+		attrs["service_started_at"] = status.StartedAt.Format(time.RFC3339)
+	}
+	return attrs
+}
+
+// closeLogs closes the task log FIFOs
+func (h *TaskHandle) closeLogs() {
+	if h.stdout != nil {
+		h.stdout.Close()
+	}
+	if h.stderr != nil {
+		h.stderr.Close()
+	}
+}
+
+// cleanup closes the task logs and removes the cgroup and bind mounts of
+// the task
+func (h *TaskHandle) cleanup() error {
+	h.closeLogs()
+
+	var firstErr error
+	if h.cgroup != nil {
+		firstErr = h.cgroup.destroy()
+		h.cgroup = nil
+	}
+
+	mounts := h.mounts
+	h.mounts = nil
+	if err := unmountPaths(mounts); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// recordOOM marks the task as having had a handler command OOM killed
+func (h *TaskHandle) recordOOM() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.exitResult.OOMKilled = true
+}
+
+// collectStats sends the resource usage of the task's cgroup every interval
+func (h *TaskHandle) collectStats(ctx context.Context, ch chan<- *drivers.TaskResourceUsage, interval time.Duration) {
+	defer close(ch)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- h.cgroup.stats():
+		}
+	}
+}
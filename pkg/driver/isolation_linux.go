@@ -0,0 +1,97 @@
+//go:build linux
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// mountPaths bind mounts the watched paths into the task's chroot at the
+// same location, so event paths resolve identically inside the chroot. It
+// returns the mount points created, in mount order.
+func mountPaths(taskDir string, paths []string, readOnly bool) ([]string, error) {
+	sources, err := mountSources(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []string
+	for _, path := range sources {
+		target := filepath.Join(taskDir, path)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			unmountPaths(mounts)
+			return nil, err
+		}
+
+		if err := syscall.Mount(path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			unmountPaths(mounts)
+			return nil, fmt.Errorf("failed to bind mount %s: %v", path, err)
+		}
+		mounts = append(mounts, target)
+
+		if readOnly {
+			flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_REC)
+			if err := syscall.Mount("", target, "", flags, ""); err != nil {
+				unmountPaths(mounts)
+				return nil, fmt.Errorf("failed to remount %s read-only: %v", path, err)
+			}
+		}
+	}
+	return mounts, nil
+}
+
+// unmountPaths removes mounts created by mountPaths in reverse order
+func unmountPaths(mounts []string) error {
+	var firstErr error
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(mounts[i], syscall.MNT_DETACH); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to unmount %s: %v", mounts[i], err)
+		}
+	}
+	return firstErr
+}
+
+// mountSources returns the directories to bind mount for the watched paths.
+// Watched files are covered by their directory: a bind mount of the file
+// itself pins its inode, so a rotated or atomically replaced file would no
+// longer be visible in the chroot. Directories within another mounted one
+// are covered by its recursive mount.
+func mountSources(paths []string) ([]string, error) {
+	var dirs []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %s: %v", path, err)
+		}
+
+		dir := filepath.Clean(path)
+		if !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var sources []string
+	for _, dir := range dirs {
+		if !coveredBy(dir, sources) {
+			sources = append(sources, dir)
+		}
+	}
+	return sources, nil
+}
+
+// coveredBy reports whether dir is one of dirs or inside one of them
+func coveredBy(dir string, dirs []string) bool {
+	for _, parent := range dirs {
+		if dir == parent || parent == "/" || strings.HasPrefix(dir, parent+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package driver
+
+import "fmt"
+
+func mountPaths(taskDir string, paths []string, readOnly bool) ([]string, error) {
+	return nil, fmt.Errorf("filesystem isolation is only supported on linux")
+}
+
+func unmountPaths(mounts []string) error {
+	return nil
+}
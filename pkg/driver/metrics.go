@@ -0,0 +1,237 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sagoresarker/nomad-filewatcher-driver/pkg/watcher"
+)
+
+const metricsNamespace = "nomad_filewatcher"
+
+var (
+	eventLabels   = []string{"task", "alloc", "rule", "op"}
+	commandLabels = []string{"task", "alloc", "rule"}
+	actionLabels  = []string{"task", "alloc", "action"}
+	taskLabels    = []string{"task", "alloc"}
+
+	// Handler commands range from quick notifications to builds
+	commandBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+	queueDepthDesc = prometheus.NewDesc(metricsNamespace+"_queue_depth",
+		"Events received but not handled yet.", taskLabels, nil)
+	runningDesc = prometheus.NewDesc(metricsNamespace+"_running_commands",
+		"Handler commands currently running.", taskLabels, nil)
+	watchesDesc = prometheus.NewDesc(metricsNamespace+"_watches",
+		"Directories registered with inotify.", taskLabels, nil)
+	pausedDesc = prometheus.NewDesc(metricsNamespace+"_paused",
+		"Whether dispatch is paused.", taskLabels, nil)
+)
+
+// metrics exports the measurements of the watchers of all tasks in the
+// Prometheus format
+type metrics struct {
+	registry   *prometheus.Registry
+	received   *prometheus.CounterVec
+	filtered   *prometheus.CounterVec
+	dispatched *prometheus.CounterVec
+	dropped    *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	exits      *prometheus.CounterVec
+	retries    *prometheus.CounterVec
+	timeouts   *prometheus.CounterVec
+	overflows  *prometheus.CounterVec
+
+	lock    sync.Mutex
+	address string
+	server  *http.Server
+}
+
+func newMetrics(d *Driver) *metrics {
+	counter := func(name, help string, labels []string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, labels)
+	}
+
+	m := &metrics{
+		registry:   prometheus.NewRegistry(),
+		received:   counter("events_received_total", "Events received on the watched paths.", eventLabels),
+		filtered:   counter("events_filtered_total", "Events skipped by the event types, ignore patterns, content hashes or while paused.", eventLabels),
+		dispatched: counter("events_dispatched_total", "Events handed to the command, service, sink and actions.", eventLabels),
+		dropped:    counter("events_dropped_total", "Events discarded by the concurrency policy, a full sink buffer or a full spool.", eventLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_duration_seconds",
+			Help:      "Run time of the handler commands.",
+			Buckets:   commandBuckets,
+		}, commandLabels),
+		exits:     counter("command_exits_total", "Handler commands by exit code, -1 when killed by a signal.", []string{"task", "alloc", "rule", "code"}),
+		retries:   counter("retries_total", "Delivery retries of the actions.", actionLabels),
+		timeouts:  counter("timeouts_total", "Requests of the actions and handler commands (action \"command\") that timed out.", actionLabels),
+		overflows: counter("overflows_total", "Kernel event queue overflows, events were lost.", taskLabels),
+	}
+
+	m.registry.MustRegister(
+		m.received, m.filtered, m.dispatched, m.dropped,
+		m.duration, m.exits, m.retries, m.timeouts, m.overflows,
+		&taskCollector{d: d},
+	)
+	return m
+}
+
+// listen exposes the metrics on /metrics of address until ctx is done. A
+// listener on a previous address is closed, an empty address only closes it.
+func (m *metrics) listen(ctx context.Context, address string, logger hclog.Logger) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if address == m.address {
+		return nil
+	}
+
+	if m.server != nil {
+		m.server.Close()
+		logger.Info("stopped serving metrics", "address", m.address)
+		m.server = nil
+		m.address = ""
+	}
+	if address == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("metrics listener failed", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	m.address = address
+	m.server = server
+	logger.Info("serving metrics", "address", listener.Addr().String())
+	return nil
+}
+
+// forTask returns the recorder of the watcher of a task
+func (m *metrics) forTask(cfg *drivers.TaskConfig) watcher.Metrics {
+	return &taskMetrics{m: m, task: cfg.Name, alloc: cfg.AllocID}
+}
+
+// remove deletes the series of a destroyed task
+func (m *metrics) remove(task, alloc string) {
+	labels := prometheus.Labels{"task": task, "alloc": alloc}
+	for _, vec := range []interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}{
+		m.received, m.filtered, m.dispatched, m.dropped,
+		m.duration, m.exits, m.retries, m.timeouts, m.overflows,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+// taskMetrics records the measurements of a watcher with the labels of its
+// task
+type taskMetrics struct {
+	m     *metrics
+	task  string
+	alloc string
+}
+
+func (t *taskMetrics) EventReceived(rule, op string) {
+	t.m.received.WithLabelValues(t.task, t.alloc, rule, op).Inc()
+}
+
+func (t *taskMetrics) EventFiltered(rule, op string) {
+	t.m.filtered.WithLabelValues(t.task, t.alloc, rule, op).Inc()
+}
+
+func (t *taskMetrics) EventDispatched(rule, op string) {
+	t.m.dispatched.WithLabelValues(t.task, t.alloc, rule, op).Inc()
+}
+
+func (t *taskMetrics) EventDropped(rule, op string) {
+	t.m.dropped.WithLabelValues(t.task, t.alloc, rule, op).Inc()
+}
+
+func (t *taskMetrics) CommandFinished(rule string, duration time.Duration, exitCode int) {
+	t.m.duration.WithLabelValues(t.task, t.alloc, rule).Observe(duration.Seconds())
+	t.m.exits.WithLabelValues(t.task, t.alloc, rule, strconv.Itoa(exitCode)).Inc()
+}
+
+func (t *taskMetrics) Retry(action string) {
+	t.m.retries.WithLabelValues(t.task, t.alloc, action).Inc()
+}
+
+func (t *taskMetrics) Timeout(action string) {
+	t.m.timeouts.WithLabelValues(t.task, t.alloc, action).Inc()
+}
+
+func (t *taskMetrics) Overflow() {
+	t.m.overflows.WithLabelValues(t.task, t.alloc).Inc()
+}
+
+// taskCollector reports the current state of the running watchers when
+// scraped
+type taskCollector struct {
+	d *Driver
+}
+
+func (c *taskCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- runningDesc
+	ch <- watchesDesc
+	ch <- pausedDesc
+}
+
+func (c *taskCollector) Collect(ch chan<- prometheus.Metric) {
+	c.d.lock.RLock()
+	handles := make([]*TaskHandle, 0, len(c.d.tasks))
+	for _, h := range c.d.tasks {
+		handles = append(handles, h)
+	}
+	c.d.lock.RUnlock()
+
+	for _, h := range handles {
+		if h.watcher == nil || !h.IsRunning() {
+			continue
+		}
+
+		stats := h.watcher.Stats()
+		paused := 0.0
+		if stats.Paused {
+			paused = 1
+		}
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(stats.Queued), h.name, h.allocID)
+		ch <- prometheus.MustNewConstMetric(runningDesc, prometheus.GaugeValue, float64(stats.Running), h.name, h.allocID)
+		ch <- prometheus.MustNewConstMetric(watchesDesc, prometheus.GaugeValue, float64(stats.Watches), h.name, h.allocID)
+		ch <- prometheus.MustNewConstMetric(pausedDesc, prometheus.GaugeValue, paused, h.name, h.allocID)
+	}
+}
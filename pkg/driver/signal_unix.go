@@ -0,0 +1,43 @@
+//go:build !windows
+
+package driver
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sagoresarker/nomad-filewatcher-driver/pkg/watcher"
+	"golang.org/x/sys/unix"
+)
+
+// parseSignal returns the signal named by a kill_signal such as SIGTERM
+func parseSignal(name string) (os.Signal, error) {
+	if name == "" {
+		return unix.SIGINT, nil
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return nil, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// signalWatcher runs the watcher action mapped to sig or forwards it to the
+// running handler commands
+func signalWatcher(fw *watcher.FileWatcher, sig os.Signal) error {
+	switch sig {
+	case unix.SIGHUP:
+		return fw.Rescan()
+	case unix.SIGUSR1:
+		fw.DumpState()
+	case unix.SIGUSR2:
+		if fw.Paused() {
+			fw.Resume()
+		} else {
+			fw.Pause()
+		}
+	default:
+		fw.Signal(sig)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package driver
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sagoresarker/nomad-filewatcher-driver/pkg/watcher"
+)
+
+// parseSignal returns the signal named by a kill_signal. Only SIGKILL and
+// SIGINT can be delivered on windows.
+func parseSignal(name string) (os.Signal, error) {
+	switch name {
+	case "", "SIGINT":
+		return os.Interrupt, nil
+	case "SIGKILL":
+		return os.Kill, nil
+	}
+	return nil, fmt.Errorf("unsupported signal %q", name)
+}
+
+// signalWatcher forwards sig to the running handler commands
+func signalWatcher(fw *watcher.FileWatcher, sig os.Signal) error {
+	fw.Signal(sig)
+	return nil
+}
@@ -0,0 +1,83 @@
+package watcher
+
+import (
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Action handles events natively instead of forking a command per event
+type Action interface {
+	// Handle processes an event. It is called concurrently for events of
+	// different paths.
+	Handle(event *Event) error
+	// Close flushes pending work when the watcher stops
+	Close() error
+}
+
+// actionStarter is implemented by actions with work to do once the watches
+// are registered
+type actionStarter interface {
+	start() error
+}
+
+// TaskEventFunc records a message in the task events shown by nomad alloc
+// status
+type TaskEventFunc func(message string, annotations map[string]string)
+
+// emitTaskEvent records a task event when a callback is configured
+func (fw *FileWatcher) emitTaskEvent(message string, annotations map[string]string) {
+	if fw.taskEvents != nil {
+		fw.taskEvents(message, annotations)
+	}
+}
+
+// eventLog returns the logger writing structured lines to the task log, or
+// the plugin log when command output is not routed to the task
+func (fw *FileWatcher) eventLog() hclog.Logger {
+	if fw.output != nil {
+		return fw.output.events
+	}
+	return fw.logger
+}
+
+// runActions passes event to the configured actions
+func (fw *FileWatcher) runActions(event *Event) {
+	for _, action := range fw.actions {
+		if err := action.Handle(event); err != nil {
+			fw.logger.Error("action failed", "path", event.Path, "error", err)
+		}
+	}
+}
+
+// startActions starts the actions that run in the background
+func (fw *FileWatcher) startActions() error {
+	for _, action := range fw.actions {
+		if starter, ok := action.(actionStarter); ok {
+			if err := starter.start(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeActions flushes and closes the configured actions
+func (fw *FileWatcher) closeActions() {
+	for _, action := range fw.actions {
+		if err := action.Close(); err != nil {
+			fw.logger.Error("failed to close action", "error", err)
+		}
+	}
+}
+
+// lookupEnv looks up a variable in the environment commands run with
+func (fw *FileWatcher) lookupEnv(name string) (string, bool) {
+	env := fw.baseEnv()
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, ok := strings.Cut(env[i], "="); ok && k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
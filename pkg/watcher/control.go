@@ -0,0 +1,169 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the dispatch counters of a watcher
+type Stats struct {
+	Events     uint64 // Events dispatched to the command
+	Suppressed uint64 // Events skipped while dispatch was paused
+	Skipped    uint64 // Events dropped by the concurrency policy
+	Cancelled  uint64 // Commands cancelled by a newer event
+	Commands   uint64 // Commands started
+	Failed     uint64 // Commands that exited with an error
+	Running    int    // Commands currently running
+	Queued     int    // Events received but not run yet
+	Watches    int    // Directories registered with the kernel
+	Paused     bool   // Whether dispatch is paused
+}
+
+type counters struct {
+	events     atomic.Uint64
+	suppressed atomic.Uint64
+	skipped    atomic.Uint64
+	cancelled  atomic.Uint64
+	commands   atomic.Uint64
+	failed     atomic.Uint64
+}
+
+// runningCommand is an in-flight command and the event it handles
+type runningCommand struct {
+	event     *Event
+	started   time.Time
+	cancelled bool
+}
+
+// Pause stops dispatching events to the command. Events received while
+// paused are skipped, tailed files resume from their last offset.
+func (fw *FileWatcher) Pause() {
+	if !fw.paused.Swap(true) {
+		fw.logger.Info("dispatch paused")
+	}
+}
+
+// Resume resumes dispatching events to the command
+func (fw *FileWatcher) Resume() {
+	if fw.paused.Swap(false) {
+		fw.logger.Info("dispatch resumed")
+	}
+}
+
+// Paused reports whether dispatch is paused
+func (fw *FileWatcher) Paused() bool {
+	return fw.paused.Load()
+}
+
+// Rescan re-registers the watches of all configured paths, picking up
+// directories created since the watcher started and paths that were
+// replaced
+func (fw *FileWatcher) Rescan() error {
+	reply := make(chan error, 1)
+	select {
+	case fw.rescanCh <- reply:
+	case <-fw.stopCh:
+		return fmt.Errorf("watcher is stopped")
+	}
+	return <-reply
+}
+
+// rescan runs on the watch loop, which owns the watch state
+func (fw *FileWatcher) rescan() error {
+	var failed []string
+	for _, path := range fw.paths {
+		if err := fw.addWatch(path); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to rescan %s", strings.Join(failed, "; "))
+	}
+	fw.logger.Info("watches re-registered", "paths", len(fw.paths))
+	return nil
+}
+
+// Signal forwards signal to the process groups of the in-flight commands
+func (fw *FileWatcher) Signal(signal os.Signal) {
+	fw.runningLock.Lock()
+	defer fw.runningLock.Unlock()
+
+	fw.signalRunningLocked(signal)
+	if fw.service != nil {
+		fw.service.signal(signal)
+	}
+}
+
+// Stats returns the dispatch counters of the watcher
+func (fw *FileWatcher) Stats() Stats {
+	fw.runningLock.Lock()
+	running := len(fw.running)
+	fw.runningLock.Unlock()
+
+	return Stats{
+		Events:     fw.counters.events.Load(),
+		Suppressed: fw.counters.suppressed.Load(),
+		Skipped:    fw.counters.skipped.Load(),
+		Cancelled:  fw.counters.cancelled.Load(),
+		Commands:   fw.counters.commands.Load(),
+		Failed:     fw.counters.failed.Load(),
+		Running:    running,
+		Queued:     len(fw.watcher.Events) + fw.queued(),
+		Watches:    len(fw.watcher.WatchList()),
+		Paused:     fw.paused.Load(),
+	}
+}
+
+// DumpState writes the stats and in-flight commands to the task log, or the
+// plugin log when command output is not routed to the task
+func (fw *FileWatcher) DumpState() {
+	logger := fw.eventLog()
+	stats := fw.Stats()
+	logger.Info("watcher state",
+		"events", stats.Events,
+		"suppressed", stats.Suppressed,
+		"skipped", stats.Skipped,
+		"cancelled", stats.Cancelled,
+		"commands", stats.Commands,
+		"failed", stats.Failed,
+		"running", stats.Running,
+		"queued", stats.Queued,
+		"watches", stats.Watches,
+		"paused", stats.Paused,
+	)
+
+	if status, ok := fw.ServiceStatus(); ok {
+		logger.Info("service state",
+			"state", status.State,
+			"pid", status.Pid,
+			"restarts", status.Restarts,
+			"exit_code", status.ExitCode,
+		)
+	}
+
+	fw.runningLock.Lock()
+	commands := make([]*runningCommand, 0, len(fw.running))
+	pids := make(map[*runningCommand]int, len(fw.running))
+	for cmd, rc := range fw.running {
+		commands = append(commands, rc)
+		pids[rc] = cmd.Process.Pid
+	}
+	fw.runningLock.Unlock()
+
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].started.Before(commands[j].started)
+	})
+	for _, rc := range commands {
+		logger.Info("running command",
+			"pid", pids[rc],
+			"sequence", rc.event.Sequence,
+			"path", rc.event.Path,
+			"running_for", time.Since(rc.started).Round(time.Millisecond).String(),
+		)
+	}
+}
@@ -0,0 +1,124 @@
+package watcher
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// startControlWatcher starts a watcher reporting the create events of path
+// to metrics
+func startControlWatcher(t *testing.T, path string, metrics Metrics) *FileWatcher {
+	t.Helper()
+
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), []string{path}, []string{"create"}, "true", nil, nil, nil, false,
+		WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+	if err := fw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return fw
+}
+
+func TestPauseSkipsEventsUntilResume(t *testing.T) {
+	dir := t.TempDir()
+	metrics := newRecordingMetrics()
+	fw := startControlWatcher(t, dir, metrics)
+
+	fw.Pause()
+	if !fw.Paused() || !fw.Stats().Paused {
+		t.Fatal("expected dispatch to be paused")
+	}
+	writeTestFile(t, filepath.Join(dir, "a"), "")
+	waitFor(t, 5*time.Second, func() bool { return fw.Stats().Suppressed == 1 })
+	if got := metrics.count("dispatched create"); got != 0 {
+		t.Fatalf("expected no event dispatched while paused, got %d", got)
+	}
+	if got := metrics.count("filtered create"); got != 1 {
+		t.Fatalf("expected the paused event to be filtered, got %d", got)
+	}
+
+	fw.Resume()
+	if fw.Paused() {
+		t.Fatal("expected dispatch to be resumed")
+	}
+	writeTestFile(t, filepath.Join(dir, "b"), "")
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("dispatched create") == 1 })
+}
+
+func TestRescanWatchesReplacedPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "watched")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metrics := newRecordingMetrics()
+	fw := startControlWatcher(t, dir, metrics)
+
+	// The watch of the removed directory is gone with its inode. fsnotify
+	// reads its watches unlocked while reporting the removal, so wait for it
+	// before rescanning.
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("received remove") > 0 })
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fw.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, "a"), "")
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("dispatched create") == 1 })
+}
+
+func TestRescanReportsMissingPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "watched")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metrics := newRecordingMetrics()
+	fw := startControlWatcher(t, dir, metrics)
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("received remove") > 0 })
+	if err := fw.Rescan(); err == nil || !strings.Contains(err.Error(), "failed to rescan "+dir) {
+		t.Fatalf("expected the missing path to be reported, got %v", err)
+	}
+
+	fw.Stop()
+	if err := fw.Rescan(); err == nil {
+		t.Fatal("expected rescan of a stopped watcher to fail")
+	}
+}
+
+func TestDumpStateLogsStats(t *testing.T) {
+	var out bytes.Buffer
+	logger := hclog.New(&hclog.LoggerOptions{Output: &out, Level: hclog.Info})
+	fw, err := NewFileWatcher(logger, nil, nil, "true", nil, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+
+	fw.counters.events.Add(3)
+	fw.Pause()
+	fw.DumpState()
+
+	dump := out.String()
+	for _, want := range []string{"watcher state", "events=3", "paused=true", "running=0"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("expected %q in the state dump, got %q", want, dump)
+		}
+	}
+}
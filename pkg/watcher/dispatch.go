@@ -0,0 +1,166 @@
+package watcher
+
+import (
+	"errors"
+	"os"
+)
+
+const (
+	ConcurrencyQueue          = "queue"           // Run events of a path one after another
+	ConcurrencySkip           = "skip"            // Drop events of a path while its command runs
+	ConcurrencyCancelPrevious = "cancel_previous" // Kill the running command of a path and run the latest event
+	ConcurrencyParallel       = "parallel"        // Run every event immediately
+)
+
+// errCommandCancelled is returned for commands killed by the
+// cancel_previous policy
+var errCommandCancelled = errors.New("command cancelled")
+
+// errCommandTimeout is returned for commands killed after the timeout
+var errCommandTimeout = errors.New("command timed out")
+
+// IsValidConcurrency checks if the concurrency policy is valid
+func IsValidConcurrency(policy string) bool {
+	switch policy {
+	case "", ConcurrencyQueue, ConcurrencySkip, ConcurrencyCancelPrevious, ConcurrencyParallel:
+		return true
+	}
+	return false
+}
+
+// pathQueue holds the events waiting for the command of a path to finish.
+// A path has a queue while a worker is running its commands.
+type pathQueue struct {
+	pending []*Event
+}
+
+// dispatch runs the command for event according to the concurrency policy.
+// Commands of different paths always run concurrently.
+func (fw *FileWatcher) dispatch(event *Event) {
+	if fw.concurrency == ConcurrencyParallel {
+		fw.pending.Add(1)
+		go func() {
+			defer fw.pending.Done()
+			fw.run(event)
+		}()
+		return
+	}
+
+	fw.queueLock.Lock()
+	defer fw.queueLock.Unlock()
+
+	q, busy := fw.queues[event.Path]
+	if !busy {
+		q = &pathQueue{}
+		fw.queues[event.Path] = q
+		fw.pending.Add(1)
+		go fw.work(event.Path, q, event)
+		return
+	}
+
+	switch fw.concurrency {
+	case ConcurrencySkip:
+		fw.counters.skipped.Add(1)
+		fw.metrics.EventDropped(event.Root, string(event.Type))
+		fw.logger.Debug("command still running, skipping event", "path", event.Path)
+	case ConcurrencyCancelPrevious:
+		// Only the latest event is run once the cancelled command exited
+		fw.counters.skipped.Add(uint64(len(q.pending)))
+		for _, dropped := range q.pending {
+			fw.metrics.EventDropped(dropped.Root, string(dropped.Type))
+		}
+		q.pending = []*Event{event}
+		fw.cancel(event.Path)
+	default:
+		q.pending = append(q.pending, event)
+	}
+}
+
+// work runs the commands of a path until its queue is empty
+func (fw *FileWatcher) work(path string, q *pathQueue, event *Event) {
+	defer fw.pending.Done()
+
+	for event != nil {
+		fw.run(event)
+
+		fw.queueLock.Lock()
+		if len(q.pending) == 0 || (fw.stopping() && !fw.draining.Load()) {
+			delete(fw.queues, path)
+			fw.queueLock.Unlock()
+			return
+		}
+		event = q.pending[0]
+		q.pending = q.pending[1:]
+		fw.queueLock.Unlock()
+	}
+}
+
+func (fw *FileWatcher) run(event *Event) {
+	switch {
+	case fw.execCommand == "":
+	case fw.tail != nil:
+		fw.handleTailEvent(event)
+	default:
+		fw.runCommand(event, nil, nil)
+	}
+
+	// Flushes only complete a record of an event that already ran them
+	if event.flushOf == nil {
+		fw.runActions(event)
+	}
+}
+
+// acquire waits for one of the max_concurrent command slots. It gives up
+// when the watcher stops without draining.
+func (fw *FileWatcher) acquire() bool {
+	if fw.slots == nil {
+		return true
+	}
+
+	select {
+	case fw.slots <- struct{}{}:
+		return true
+	case <-fw.stopCh:
+		if !fw.draining.Load() {
+			return false
+		}
+	}
+	fw.slots <- struct{}{}
+	return true
+}
+
+func (fw *FileWatcher) release() {
+	if fw.slots != nil {
+		<-fw.slots
+	}
+}
+
+// cancel kills the process groups of the commands running for path
+func (fw *FileWatcher) cancel(path string) {
+	fw.runningLock.Lock()
+	defer fw.runningLock.Unlock()
+
+	for cmd, rc := range fw.running {
+		if rc.event.Path != path {
+			continue
+		}
+		fw.logger.Info("cancelling previous command", "path", path, "pid", cmd.Process.Pid)
+		rc.cancelled = true
+		if err := signalGroup(cmd.Process, os.Kill); err != nil {
+			fw.logger.Debug("failed to cancel command", "pid", cmd.Process.Pid, "error", err)
+		}
+		fw.counters.cancelled.Add(1)
+	}
+}
+
+// queued returns the number of events waiting for a command to finish
+func (fw *FileWatcher) queued() int {
+	fw.queueLock.Lock()
+	defer fw.queueLock.Unlock()
+
+	n := 0
+	for _, q := range fw.queues {
+		n += len(q.pending)
+	}
+	return n
+}
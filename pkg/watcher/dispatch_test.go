@@ -0,0 +1,132 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// newCommandWatcher returns a watcher running command with args for every
+// event
+func newCommandWatcher(t *testing.T, command string, args []string, opts ...Option) *FileWatcher {
+	t.Helper()
+
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), nil, nil, command, args, nil, nil, false, opts...)
+	if err != nil {
+		t.Fatalf("failed to create watcher: %v", err)
+	}
+	t.Cleanup(fw.Stop)
+	return fw
+}
+
+// runConcurrently runs an event for each path at once and returns how long
+// they took
+func runConcurrently(fw *FileWatcher, paths ...string) time.Duration {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			fw.run(testEvent(path))
+		}(path)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestMaxConcurrentDefaultsToNoLimit(t *testing.T) {
+	fw := newCommandWatcher(t, "sleep", []string{"0.5"})
+
+	if took := runConcurrently(fw, "/data/a", "/data/b", "/data/c"); took >= time.Second {
+		t.Fatalf("expected the commands to run at once, took %s", took)
+	}
+}
+
+func TestMaxConcurrentSerializesCommands(t *testing.T) {
+	fw := newCommandWatcher(t, "sleep", []string{"0.3"}, WithMaxConcurrent(1))
+
+	if took := runConcurrently(fw, "/data/a", "/data/b", "/data/c"); took < 900*time.Millisecond {
+		t.Fatalf("expected the commands to run one after another, took %s", took)
+	}
+}
+
+// dispatchAll dispatches an event for path n times and waits for the
+// commands to finish
+func dispatchAll(t *testing.T, fw *FileWatcher, path string, n int) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		fw.dispatch(testEvent(path))
+	}
+	if !waitGroup(&fw.pending, 10*time.Second) {
+		t.Fatal("commands did not finish")
+	}
+	return time.Since(start)
+}
+
+func TestConcurrencyQueueRunsEventsInTurn(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	fw := newCommandWatcher(t, "sh", []string{"-c", "echo start >> " + out + "; sleep 0.1; echo end >> " + out},
+		WithConcurrency(ConcurrencyQueue))
+
+	dispatchAll(t, fw, "/data/a", 3)
+	if got := readTestFile(t, out); got != strings.Repeat("start\nend\n", 3) {
+		t.Fatalf("expected the commands to run one after another, got %q", got)
+	}
+}
+
+func TestConcurrencySkipDropsEventsWhileRunning(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	fw := newCommandWatcher(t, "sh", []string{"-c", "echo run >> " + out + "; sleep 0.2"},
+		WithConcurrency(ConcurrencySkip))
+
+	dispatchAll(t, fw, "/data/a", 3)
+	if got := readTestFile(t, out); got != "run\n" {
+		t.Fatalf("expected a single run, got %q", got)
+	}
+	if got := fw.Stats().Skipped; got != 2 {
+		t.Fatalf("expected 2 skipped events, got %d", got)
+	}
+}
+
+func TestConcurrencyCancelPreviousRunsLatestEvent(t *testing.T) {
+	dir := t.TempDir()
+	marker, out := filepath.Join(dir, "marker"), filepath.Join(dir, "out")
+
+	// The first run blocks, the run after it completes at once
+	script := "if [ -e " + marker + " ]; then echo latest >> " + out + "; else touch " + marker + "; sleep 30; fi"
+	fw := newCommandWatcher(t, "sh", []string{"-c", script}, WithConcurrency(ConcurrencyCancelPrevious))
+
+	fw.dispatch(testEvent("/data/a"))
+	waitFor(t, 5*time.Second, func() bool {
+		_, err := os.Stat(marker)
+		return err == nil
+	})
+
+	if took := dispatchAll(t, fw, "/data/a", 1); took > 5*time.Second {
+		t.Fatalf("expected the previous command to be cancelled, took %s", took)
+	}
+	if got := readTestFile(t, out); got != "latest\n" {
+		t.Fatalf("expected the latest event to run, got %q", got)
+	}
+	if got := fw.Stats().Cancelled; got != 1 {
+		t.Fatalf("expected 1 cancelled command, got %d", got)
+	}
+}
+
+func TestConcurrencyParallelRunsEventsAtOnce(t *testing.T) {
+	fw := newCommandWatcher(t, "sleep", []string{"0.5"}, WithConcurrency(ConcurrencyParallel))
+
+	if took := dispatchAll(t, fw, "/data/a", 3); took >= time.Second {
+		t.Fatalf("expected the commands of a path to run at once, took %s", took)
+	}
+}
@@ -3,7 +3,13 @@ package watcher
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 type EventType string
@@ -11,15 +17,58 @@ type EventType string
 const (
 	EventCreate EventType = "create"
 	EventModify EventType = "modify"
-	EventDelete EventType = "delete"
+	EventRemove EventType = "remove"
 	EventRename EventType = "rename"
 	EventChmod  EventType = "chmod"
 )
 
+// EventSchemaVersion is the version of the JSON event document. It is
+// incremented whenever a field is renamed or removed.
+const EventSchemaVersion = 1
+
+// StdinEventJSON writes the JSON event document to the command's stdin
+const StdinEventJSON = "event_json"
+
+// renamePairWindow is the time within which a create following a rename is
+// reported as a move
+const renamePairWindow = 100 * time.Millisecond
+
 type Event struct {
-	Type      EventType `json:"type"`
-	Path      string    `json:"path"`
-	Timestamp time.Time `json:"timestamp"`
+	SchemaVersion int       `json:"schema_version"`
+	Sequence      uint64    `json:"sequence"`
+	Type          EventType `json:"type"`
+	Op            string    `json:"op"`
+	Path          string    `json:"path"`
+	RelPath       string    `json:"rel_path"`
+	Root          string    `json:"root"`
+	OldPath       string    `json:"old_path,omitempty"`
+	File          *FileInfo `json:"file,omitempty"`
+	TaskID        string    `json:"task_id,omitempty"`
+	AllocID       string    `json:"alloc_id,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+
+	// Captured when the event is received as commands run concurrently
+	// with the watch loop
+	linkTarget string
+	hashed     bool
+	oldHash    string
+	newHash    string
+
+	// Set on the events flushing the multiline record held back after
+	// reading the lines of another event
+	flushOf *Event
+}
+
+// FileInfo describes the file an event refers to. It is omitted when the
+// file no longer exists.
+type FileInfo struct {
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	IsDir   bool      `json:"is_dir"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
 }
 
 type EventHandler struct {
@@ -48,9 +97,99 @@ func (e Event) String() string {
 
 func IsValidEventType(eventType string) bool {
 	switch EventType(eventType) {
-	case EventCreate, EventModify, EventDelete, EventRename, EventChmod:
+	case EventCreate, EventModify, EventRemove, EventRename, EventChmod:
 		return true
 	default:
 		return false
 	}
 }
+
+// IsValidStdin reports whether mode is a supported stdin mode
+func IsValidStdin(mode string) bool {
+	switch mode {
+	case "", "none", StdinEventJSON:
+		return true
+	default:
+		return false
+	}
+}
+
+// newEvent builds the event document of an fsnotify event
+func (fw *FileWatcher) newEvent(event fsnotify.Event) *Event {
+	root := fw.rootFor(event.Name)
+	base := root
+	if fw.files[root] {
+		base = filepath.Dir(root)
+	}
+
+	relPath, err := filepath.Rel(base, event.Name)
+	if err != nil {
+		relPath = event.Name
+	}
+
+	ev := &Event{
+		SchemaVersion: EventSchemaVersion,
+		Sequence:      atomic.AddUint64(&fw.sequence, 1),
+		Type:          EventType(eventToString(event)),
+		Op:            event.Op.String(),
+		Path:          event.Name,
+		RelPath:       relPath,
+		Root:          root,
+		OldPath:       fw.renamedFrom,
+		TaskID:        fw.taskID,
+		AllocID:       fw.allocID,
+		Timestamp:     time.Now(),
+	}
+
+	ev.linkTarget = fw.links[event.Name]
+	if fw.hashes != nil {
+		ev.hashed = true
+		ev.oldHash, ev.newHash = fw.hashes.digests(event.Name)
+	}
+
+	if info, err := os.Stat(event.Name); err == nil {
+		uid, gid := fileOwner(info)
+		ev.File = &FileInfo{
+			Size:    info.Size(),
+			Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime(),
+			Inode:   fileInode(info),
+			UID:     uid,
+			GID:     gid,
+		}
+	}
+
+	return ev
+}
+
+// templateData returns the data available to command templates
+func (e *Event) templateData() TemplateData {
+	return TemplateData{
+		Path:    e.Path,
+		Dir:     filepath.Dir(e.Path),
+		Base:    filepath.Base(e.Path),
+		Ext:     filepath.Ext(e.Path),
+		RelPath: e.RelPath,
+		Root:    e.Root,
+		Op:      string(e.Type),
+		Time:    e.Timestamp,
+	}
+}
+
+// rootFor returns the configured path covering name, preferring the longest
+func (fw *FileWatcher) rootFor(name string) string {
+	var root string
+	for _, path := range fw.paths {
+		if name != path && !strings.HasPrefix(name, path+string(filepath.Separator)) {
+			continue
+		}
+		if len(path) > len(root) {
+			root = path
+		}
+	}
+	if root == "" {
+		return filepath.Dir(name)
+	}
+	return root
+}
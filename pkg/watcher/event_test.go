@@ -0,0 +1,35 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsValidEventType(t *testing.T) {
+	for _, eventType := range []string{"create", "modify", "remove", "rename", "chmod"} {
+		if !IsValidEventType(eventType) {
+			t.Errorf("expected %q to be valid", eventType)
+		}
+	}
+	for _, eventType := range []string{"delete", "write", ""} {
+		if IsValidEventType(eventType) {
+			t.Errorf("expected %q to be rejected", eventType)
+		}
+	}
+}
+
+func TestSampleEventMatchesEventFileMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	writeTestFile(t, path, "data")
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Templates comparing the mode, e.g. in webhook bodies, are validated
+	// against the sample event
+	event := createEvent(newTestWatcher(t), path)
+	if event.File == nil || event.File.Mode != sampleEvent.File.Mode {
+		t.Fatalf("expected mode %s, got %+v", sampleEvent.File.Mode, event.File)
+	}
+}
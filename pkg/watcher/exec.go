@@ -0,0 +1,230 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ExecConfig describes the environment commands run in
+type ExecConfig struct {
+	Env        map[string]string // Base environment, e.g. the Nomad task environment
+	InheritEnv bool              // Also pass the plugin's own environment
+	User       string            // Run commands as this user
+	Dir        string            // Working directory, relative working_dir templates are joined to it
+	Chroot     string            // Run commands chrooted into this directory
+	Hook       ProcessHook       // Places commands into resource or isolation groups
+}
+
+// ProcessHook is notified around the lifetime of every command, e.g. to
+// place it into a cgroup and inspect the cgroup once it exited
+type ProcessHook interface {
+	// PreStart may adjust the command before it is started
+	PreStart(cmd *exec.Cmd) error
+
+	// PostStart is called with the pid of the started command
+	PostStart(pid int) error
+
+	// PostExit is called once the command exited
+	PostExit(event *Event, state *os.ProcessState)
+}
+
+type execContext struct {
+	env    []string
+	dir    string
+	chroot string
+	cred   *credential
+	hook   ProcessHook
+}
+
+func newExecContext(cfg ExecConfig) (*execContext, error) {
+	ec := &execContext{dir: cfg.Dir, chroot: cfg.Chroot, hook: cfg.Hook}
+
+	if cfg.InheritEnv {
+		ec.env = append(ec.env, os.Environ()...)
+	}
+
+	keys := make([]string, 0, len(cfg.Env))
+	for k := range cfg.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ec.env = append(ec.env, fmt.Sprintf("%s=%s", k, cfg.Env[k]))
+	}
+
+	if cfg.User != "" {
+		cred, err := lookupCredential(cfg.User)
+		if err != nil {
+			return nil, err
+		}
+		ec.cred = cred
+	}
+
+	return ec, nil
+}
+
+// baseEnv returns the environment every command starts with
+func (fw *FileWatcher) baseEnv() []string {
+	if fw.exec == nil {
+		return os.Environ()
+	}
+	return append([]string{}, fw.exec.env...)
+}
+
+// commandDir resolves the rendered working directory of a command
+func (fw *FileWatcher) commandDir(dir string) string {
+	if fw.exec == nil || fw.exec.dir == "" {
+		return dir
+	}
+	if dir == "" {
+		return fw.exec.dir
+	}
+	if !filepath.IsAbs(dir) {
+		return filepath.Join(fw.exec.dir, dir)
+	}
+	return dir
+}
+
+// prepare applies the user and isolation settings to cmd
+func (ec *execContext) prepare(cmd *exec.Cmd) error {
+	if ec.cred != nil {
+		setCredential(cmd, ec.cred)
+	}
+	if ec.chroot != "" {
+		if err := setChroot(cmd, ec.chroot); err != nil {
+			return err
+		}
+	}
+	if ec.hook != nil {
+		return ec.hook.PreStart(cmd)
+	}
+	return nil
+}
+
+// Command returns a command running in the environment, user, working
+// directory and isolation of the handler commands, e.g. for an interactive
+// exec session. It must be started with StartCommand.
+func (fw *FileWatcher) Command(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
+	_, env, dir, err := fw.command.render(TemplateData{Time: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = fw.commandDir(dir)
+	cmd.Env = append(fw.baseEnv(), env...)
+
+	if fw.exec != nil {
+		if err := fw.exec.prepare(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+// StartCommand starts a command returned by Command and hands it to the
+// process hook
+func (fw *FileWatcher) StartCommand(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if fw.exec != nil && fw.exec.hook != nil {
+		if err := fw.exec.hook.PostStart(cmd.Process.Pid); err != nil {
+			fw.logger.Warn("failed to track command", "pid", cmd.Process.Pid, "error", err)
+		}
+	}
+	return nil
+}
+
+// execute starts cmd and waits for it to exit, notifying the process hook
+func (fw *FileWatcher) execute(cmd *exec.Cmd, event *Event) error {
+	// Commands run in their own process group so that stopping the task
+	// also reaches the processes they spawned
+	setProcessGroup(cmd)
+
+	// Only the command holds a max_concurrent slot, actions waiting for
+	// files to settle or retrying deliveries do not block other paths
+	if !fw.acquire() {
+		return fmt.Errorf("watcher is shutting down")
+	}
+	defer fw.release()
+
+	fw.runningLock.Lock()
+	if fw.terminating {
+		fw.runningLock.Unlock()
+		return fmt.Errorf("watcher is shutting down")
+	}
+	if err := cmd.Start(); err != nil {
+		fw.runningLock.Unlock()
+		return err
+	}
+	started := time.Now()
+	fw.running[cmd] = &runningCommand{event: event, started: started}
+	fw.inflight.Add(1)
+	fw.runningLock.Unlock()
+	fw.counters.commands.Add(1)
+
+	defer func() {
+		fw.runningLock.Lock()
+		delete(fw.running, cmd)
+		fw.runningLock.Unlock()
+		fw.inflight.Done()
+	}()
+
+	var hook ProcessHook
+	if fw.exec != nil {
+		hook = fw.exec.hook
+	}
+
+	// The timeout starts once the command runs, not while it waits for a
+	// max_concurrent slot
+	var timedOut atomic.Bool
+	if fw.timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), fw.timeout)
+		defer cancel()
+		stop := context.AfterFunc(ctx, func() {
+			if ctx.Err() != context.DeadlineExceeded {
+				return
+			}
+			timedOut.Store(true)
+			if err := signalGroup(cmd.Process, os.Kill); err != nil {
+				fw.logger.Warn("failed to kill timed out command", "pid", cmd.Process.Pid, "error", err)
+			}
+		})
+		defer stop()
+	}
+
+	if hook != nil {
+		if err := hook.PostStart(cmd.Process.Pid); err != nil {
+			fw.logger.Warn("failed to track command", "pid", cmd.Process.Pid, "error", err)
+		}
+	}
+
+	err := cmd.Wait()
+	if hook != nil {
+		hook.PostExit(event, cmd.ProcessState)
+	}
+	fw.metrics.CommandFinished(event.Root, time.Since(started), cmd.ProcessState.ExitCode())
+	fw.runningLock.Lock()
+	cancelled := fw.running[cmd].cancelled
+	fw.runningLock.Unlock()
+	if cancelled {
+		return errCommandCancelled
+	}
+
+	if timedOut.Load() {
+		fw.counters.failed.Add(1)
+		fw.metrics.Timeout("command")
+		return fmt.Errorf("%w after %s", errCommandTimeout, fw.timeout)
+	}
+	if err != nil {
+		fw.counters.failed.Add(1)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// chrootSearchPath is used to resolve bare command names inside a chroot
+// when the environment of the command has no PATH
+var chrootSearchPath = []string{"/usr/local/bin", "/usr/bin", "/bin", "/usr/local/sbin", "/usr/sbin", "/sbin"}
+
+type credential = syscall.Credential
+
+// lookupCredential resolves the uid, gid and supplementary groups of a user
+func lookupCredential(name string) (*credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user %s: %v", name, err)
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid for user %s: %v", name, err)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid for user %s: %v", name, err)
+	}
+
+	cred := &credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups of user %s: %v", name, err)
+	}
+	for _, group := range groups {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+
+	return cred, nil
+}
+
+// setCredential runs cmd with the given credentials
+func setCredential(cmd *exec.Cmd, cred *credential) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+}
+
+// setChroot runs cmd chrooted into root. The command is resolved inside the
+// chroot, as exec.Command would otherwise look it up on the host: paths
+// such as ./run.sh are relative to the working directory inside the chroot,
+// bare names are searched in the PATH of the command.
+func setChroot(cmd *exec.Cmd, root string) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = root
+
+	name := cmd.Args[0]
+	switch {
+	case filepath.IsAbs(name):
+		cmd.Path = name
+		cmd.Err = nil
+		return nil
+	case strings.ContainsRune(name, filepath.Separator):
+		cmd.Path = filepath.Join("/", cmd.Dir, name)
+		cmd.Err = nil
+		return nil
+	}
+
+	for _, dir := range chrootPath(cmd.Env) {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(filepath.Join(root, path)); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			cmd.Path = path
+			cmd.Err = nil
+			return nil
+		}
+	}
+	return fmt.Errorf("executable %s not found in chroot %s", name, root)
+}
+
+// chrootPath returns the directories bare command names are searched in
+func chrootPath(env []string) []string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if value, ok := strings.CutPrefix(env[i], "PATH="); ok && value != "" {
+			var dirs []string
+			for _, dir := range filepath.SplitList(value) {
+				// Relative entries would depend on the working directory
+				if filepath.IsAbs(dir) {
+					dirs = append(dirs, dir)
+				}
+			}
+			return dirs
+		}
+	}
+	return chrootSearchPath
+}
+
+// setProcessGroup starts cmd in a new process group
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends signal to the process group led by process
+func signalGroup(process *os.Process, signal os.Signal) error {
+	sig, ok := signal.(syscall.Signal)
+	if !ok {
+		return process.Signal(signal)
+	}
+	return syscall.Kill(-process.Pid, sig)
+}
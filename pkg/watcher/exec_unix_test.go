@@ -0,0 +1,241 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// newChroot returns a directory with executables at the given paths
+func newChroot(t *testing.T, executables ...string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for _, path := range executables {
+		writeTestFile(t, filepath.Join(root, path), "#!/bin/sh\n")
+		if err := os.Chmod(filepath.Join(root, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestSetChrootResolvesInsideRoot(t *testing.T) {
+	root := newChroot(t, "/opt/tools/handler", "/work/run.sh", "/usr/bin/convert")
+
+	for _, tc := range []struct {
+		name string
+		dir  string
+		env  []string
+		want string
+	}{
+		{name: "/opt/tools/handler", want: "/opt/tools/handler"},
+		{name: "./run.sh", dir: "/work", want: "/work/run.sh"},
+		{name: "convert", want: "/usr/bin/convert"},
+		{name: "handler", env: []string{"PATH=relative:/opt/tools"}, want: "/opt/tools/handler"},
+	} {
+		cmd := exec.Command(tc.name)
+		cmd.Dir = tc.dir
+		cmd.Env = tc.env
+		if err := setChroot(cmd, root); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if cmd.Path != tc.want || cmd.Err != nil {
+			t.Errorf("%s: expected %s, got %s (%v)", tc.name, tc.want, cmd.Path, cmd.Err)
+		}
+		if cmd.SysProcAttr.Chroot != root {
+			t.Errorf("%s: expected the chroot to be set", tc.name)
+		}
+	}
+}
+
+func TestSetChrootIgnoresHostPath(t *testing.T) {
+	// sh exists on the host but not in the chroot
+	root := newChroot(t, "/bin/other")
+
+	cmd := exec.Command("sh")
+	err := setChroot(cmd, root)
+	if err == nil || !strings.Contains(err.Error(), "not found in chroot") {
+		t.Fatalf("expected the command not to be found, got %v with path %s", err, cmd.Path)
+	}
+}
+
+func TestSetChrootSkipsNonExecutables(t *testing.T) {
+	root := newChroot(t, "/usr/local/bin/tool")
+	writeTestFile(t, filepath.Join(root, "/usr/bin/tool"), "data")
+
+	cmd := exec.Command("tool")
+	cmd.Env = []string{"PATH=/usr/bin:/usr/local/bin"}
+	if err := setChroot(cmd, root); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Path != "/usr/local/bin/tool" {
+		t.Fatalf("expected the executable to be found, got %s", cmd.Path)
+	}
+}
+
+func TestCommandTimeoutKillsProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	metrics := newRecordingMetrics()
+
+	// The child keeps the output pipe open, the command only finishes once
+	// the whole group is killed
+	fw := newCommandWatcher(t, "sh", []string{"-c", "sleep 30 & echo $! > " + pidFile + "; wait"},
+		WithTimeout(200*time.Millisecond), WithMetrics(metrics))
+
+	start := time.Now()
+	fw.run(testEvent("/data/a"))
+	if took := time.Since(start); took > 10*time.Second {
+		t.Fatalf("expected the command to be killed after the timeout, took %s", took)
+	}
+
+	if got := metrics.count("timeout command"); got != 1 {
+		t.Fatalf("expected 1 command timeout, got %d", got)
+	}
+	if got := metrics.exitCodes(); len(got) != 1 || got[0] != -1 {
+		t.Fatalf("expected the command to be killed by a signal, got exit codes %v", got)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return syscall.Kill(pid, 0) != nil })
+}
+
+func TestCommandWithinTimeout(t *testing.T) {
+	metrics := newRecordingMetrics()
+	fw := newCommandWatcher(t, "true", nil, WithTimeout(10*time.Second), WithMetrics(metrics))
+
+	fw.run(testEvent("/data/a"))
+	if got := metrics.count("timeout command"); got != 0 {
+		t.Fatalf("expected no timeout, got %d", got)
+	}
+	if got := metrics.exitCodes(); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("unexpected exit codes %v", got)
+	}
+}
+
+func TestCommandRunsWithTaskEnvironment(t *testing.T) {
+	t.Setenv("FILEWATCHER_TEST_PLUGIN_ENV", "plugin")
+
+	for _, inherit := range []bool{false, true} {
+		dir := t.TempDir()
+		fw := newCommandWatcher(t, "sh", []string{"-c", "env > env.txt"}, WithExec(ExecConfig{
+			Env:        map[string]string{"NOMAD_TASK_NAME": "watch", "PATH": os.Getenv("PATH")},
+			InheritEnv: inherit,
+			Dir:        dir,
+		}))
+		fw.run(testEvent("/data/a"))
+
+		env := readTestFile(t, filepath.Join(dir, "env.txt"))
+		if !strings.Contains(env, "NOMAD_TASK_NAME=watch\n") {
+			t.Errorf("inherit %v: expected the task environment in the task dir, got %q", inherit, env)
+		}
+		if got := strings.Contains(env, "FILEWATCHER_TEST_PLUGIN_ENV=plugin\n"); got != inherit {
+			t.Errorf("inherit %v: expected the plugin environment passed %v, got %v", inherit, inherit, got)
+		}
+	}
+}
+
+func TestCommandDirJoinsTaskDir(t *testing.T) {
+	fw := newCommandWatcher(t, "true", nil, WithExec(ExecConfig{Dir: "/alloc/task"}))
+
+	for dir, want := range map[string]string{
+		"":          "/alloc/task",
+		"work":      "/alloc/task/work",
+		"/var/data": "/var/data",
+	} {
+		if got := fw.commandDir(dir); got != want {
+			t.Errorf("%q: expected %s, got %s", dir, want, got)
+		}
+	}
+}
+
+func TestLookupCredential(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	cred, err := lookupCredential(current.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strconv.Itoa(int(cred.Uid)) != current.Uid || strconv.Itoa(int(cred.Gid)) != current.Gid {
+		t.Fatalf("expected uid %s and gid %s, got %d and %d", current.Uid, current.Gid, cred.Uid, cred.Gid)
+	}
+
+	if _, err := lookupCredential("filewatcher-no-such-user"); err == nil {
+		t.Fatal("expected an unknown user to be rejected")
+	}
+}
+
+// recordingHook records the commands passed to a ProcessHook
+type recordingHook struct {
+	prepared []string
+	started  []int
+}
+
+func (h *recordingHook) PreStart(cmd *exec.Cmd) error {
+	h.prepared = append(h.prepared, cmd.Path)
+	return nil
+}
+
+func (h *recordingHook) PostStart(pid int) error {
+	h.started = append(h.started, pid)
+	return nil
+}
+
+func (h *recordingHook) PostExit(*Event, *os.ProcessState) {}
+
+func TestCommandForExecSession(t *testing.T) {
+	dir := t.TempDir()
+	hook := &recordingHook{}
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), nil, nil, "true", nil, map[string]string{"STAGE": "exec"}, nil, false,
+		WithExec(ExecConfig{
+			Env:  map[string]string{"NOMAD_TASK_NAME": "watch", "PATH": os.Getenv("PATH")},
+			Dir:  dir,
+			Hook: hook,
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+
+	cmd, err := fw.Command(context.Background(), "sh", "-c", "echo $NOMAD_TASK_NAME $STAGE; pwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := fw.StartCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := out.String(), "watch exec\n"+dir+"\n"; got != want {
+		t.Fatalf("expected the task environment and dir %q, got %q", want, got)
+	}
+	if len(hook.prepared) != 1 || len(hook.started) != 1 || hook.started[0] != cmd.Process.Pid {
+		t.Fatalf("expected the hook to see the command, got %+v", hook)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+type credential struct{}
+
+func lookupCredential(name string) (*credential, error) {
+	return nil, fmt.Errorf("running commands as user %s is not supported on windows", name)
+}
+
+func setCredential(cmd *exec.Cmd, cred *credential) {}
+
+func setChroot(cmd *exec.Cmd, root string) error {
+	return fmt.Errorf("chroot is not supported on windows")
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalGroup(process *os.Process, signal os.Signal) error {
+	return process.Signal(signal)
+}
@@ -0,0 +1,636 @@
+package watcher
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	FileOpCopy     = "copy"     // Copy the file to dest
+	FileOpMove     = "move"     // Move the file to dest
+	FileOpCompress = "compress" // Compress the file next to itself
+	FileOpTar      = "tar"      // Archive the file or directory to dest
+	FileOpChecksum = "checksum" // Write a checksum sidecar next to the file
+	FileOpDelete   = "delete"   // Delete the file
+
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+
+	// fileSettleDelay is how long the size and modification time of a file
+	// must stay unchanged before the pipeline works on it
+	fileSettleDelay = 500 * time.Millisecond
+
+	// ownWriteWindow is how long events on a file written by the pipeline
+	// are ignored after the write finished
+	ownWriteWindow = 2 * time.Second
+)
+
+// FileStep is one step of a file operation pipeline. Every step works on the
+// file produced by the previous one, starting with the event path.
+type FileStep struct {
+	Op         string
+	Dest       string // Destination template of copy, move and tar
+	Format     string // Compression of compress (gzip, zstd) and tar (none, gzip, zstd)
+	Algorithm  string // Checksum algorithm (sha256, sha512)
+	KeepSource bool   // Keep the uncompressed file after compress
+}
+
+// FileOpsConfig is a pipeline of built-in file operations run per event
+type FileOpsConfig struct {
+	Steps []FileStep
+}
+
+// Validate reports whether the pipeline is usable
+func (c FileOpsConfig) Validate() error {
+	if len(c.Steps) == 0 {
+		return fmt.Errorf("file operations require at least one step")
+	}
+
+	for i, step := range c.Steps {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("invalid file operation step %d: %v", i, err)
+		}
+		if step.Op == FileOpDelete && i != len(c.Steps)-1 {
+			return fmt.Errorf("invalid file operation step %d: delete must be the last step", i)
+		}
+	}
+	return nil
+}
+
+func (s FileStep) validate() error {
+	switch s.Op {
+	case FileOpCopy, FileOpMove:
+		if s.Dest == "" {
+			return fmt.Errorf("%s requires dest", s.Op)
+		}
+	case FileOpTar:
+		if s.Dest == "" {
+			return fmt.Errorf("tar requires dest")
+		}
+		switch s.Format {
+		case "", "none", CompressGzip, CompressZstd:
+		default:
+			return fmt.Errorf("invalid tar format: %s", s.Format)
+		}
+	case FileOpCompress:
+		switch s.Format {
+		case "", CompressGzip, CompressZstd:
+		default:
+			return fmt.Errorf("invalid compress format: %s", s.Format)
+		}
+	case FileOpChecksum:
+		switch s.Algorithm {
+		case "", ChecksumSHA256, ChecksumSHA512:
+		default:
+			return fmt.Errorf("invalid checksum algorithm: %s", s.Algorithm)
+		}
+	case FileOpDelete:
+	default:
+		return fmt.Errorf("invalid op: %s", s.Op)
+	}
+
+	if s.Dest != "" {
+		if err := ValidateTemplate(s.Dest); err != nil {
+			return fmt.Errorf("invalid dest: %v", err)
+		}
+	}
+	return nil
+}
+
+type fileOps struct {
+	fw    *FileWatcher
+	steps []FileStep
+	dests []*template.Template
+}
+
+func newFileOps(fw *FileWatcher, cfg FileOpsConfig) (*fileOps, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	ops := &fileOps{fw: fw, steps: cfg.Steps, dests: make([]*template.Template, len(cfg.Steps))}
+	for i, step := range cfg.Steps {
+		if step.Dest == "" {
+			continue
+		}
+		tmpl, err := parseTemplate(fmt.Sprintf("file_ops[%d].dest", i), step.Dest)
+		if err != nil {
+			return nil, err
+		}
+		ops.dests[i] = tmpl
+	}
+	return ops, nil
+}
+
+// Handle runs the pipeline on the file of event once it stopped changing.
+// Events of files that no longer exist are skipped, as are the events of
+// directories the pipeline cannot work on.
+func (o *fileOps) Handle(event *Event) error {
+	if event.File == nil {
+		return nil
+	}
+	if event.File.IsDir && !o.handlesDirs() {
+		return nil
+	}
+	if !o.settle(event.Path) {
+		return nil
+	}
+
+	data := event.templateData()
+	current := event.Path
+	for i, step := range o.steps {
+		var dest string
+		if o.dests[i] != nil {
+			var err error
+			if dest, err = execute(o.dests[i], data); err != nil {
+				o.report(event, step, current, "", err)
+				return err
+			}
+			name := filepath.Base(current)
+			if step.Op == FileOpTar {
+				name += tarExt(step.Format)
+			}
+			dest = destPath(dest, name)
+		}
+
+		// The outputs are written into the watched paths more often than
+		// not, their events must not run the pipeline again
+		output := stepOutput(step, current, dest)
+		if output != "" {
+			o.fw.written.begin(output)
+		}
+		next, err := o.apply(step, current, dest)
+		if output != "" {
+			o.fw.written.end(output)
+		}
+		o.report(event, step, current, next, err)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", step.Op, current, err)
+		}
+		current = next
+	}
+	return nil
+}
+
+// Close implements Action
+func (o *fileOps) Close() error {
+	return nil
+}
+
+// handlesDirs reports whether the pipeline works on directories. Copy,
+// compress and checksum only work on files, tar turns a directory into one.
+func (o *fileOps) handlesDirs() bool {
+	for _, step := range o.steps {
+		switch step.Op {
+		case FileOpTar:
+			return true
+		case FileOpCopy, FileOpCompress, FileOpChecksum:
+			return false
+		}
+	}
+	return true
+}
+
+// settle waits until the size and modification time of path stop changing,
+// so that a file still being written is not moved or compressed. It reports
+// false when the file is gone or the watcher is stopping.
+func (o *fileOps) settle(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+
+	for {
+		delay := time.After(fileSettleDelay)
+		select {
+		case <-delay:
+		case <-o.fw.stopCh:
+			if !o.fw.draining.Load() {
+				return false
+			}
+			<-delay
+		}
+
+		current, err := os.Lstat(path)
+		if err != nil {
+			return false
+		}
+		if current.Size() == info.Size() && current.ModTime().Equal(info.ModTime()) {
+			return true
+		}
+		info = current
+	}
+}
+
+// stepOutput returns the file a step writes, or "" when it writes none
+func stepOutput(step FileStep, path, dest string) string {
+	switch step.Op {
+	case FileOpCopy, FileOpMove, FileOpTar:
+		return dest
+	case FileOpCompress:
+		return path + compressExt(step.Format)
+	case FileOpChecksum:
+		algorithm := step.Algorithm
+		if algorithm == "" {
+			algorithm = ChecksumSHA256
+		}
+		return path + "." + algorithm
+	}
+	return ""
+}
+
+// apply runs a step on path and returns the path the next step works on
+func (o *fileOps) apply(step FileStep, path, dest string) (string, error) {
+	switch step.Op {
+	case FileOpCopy:
+		return dest, copyFile(path, dest)
+	case FileOpMove:
+		return dest, moveFile(path, dest)
+	case FileOpCompress:
+		return compressFile(path, step.Format, step.KeepSource)
+	case FileOpTar:
+		return dest, tarPath(path, dest, step.Format)
+	case FileOpChecksum:
+		return path, writeChecksum(path, step.Algorithm)
+	case FileOpDelete:
+		return "", os.RemoveAll(path)
+	}
+	return "", fmt.Errorf("invalid op: %s", step.Op)
+}
+
+// report writes the outcome of a step to the event log
+func (o *fileOps) report(event *Event, step FileStep, path, result string, err error) {
+	logger := o.fw.eventLog()
+	if err != nil {
+		logger.Error("file operation failed",
+			"sequence", event.Sequence,
+			"op", step.Op,
+			"path", path,
+			"error", err.Error(),
+		)
+		return
+	}
+	logger.Info("file operation",
+		"sequence", event.Sequence,
+		"op", step.Op,
+		"path", path,
+		"result", result,
+	)
+}
+
+// destPath resolves a rendered destination. A destination ending in a path
+// separator or naming an existing directory receives the output as name.
+func destPath(dest, name string) string {
+	if strings.HasSuffix(dest, string(filepath.Separator)) {
+		return filepath.Join(dest, name)
+	}
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		return filepath.Join(dest, name)
+	}
+	return dest
+}
+
+// writeTracker records the files the watcher writes itself so that their
+// events are ignored
+type writeTracker struct {
+	lock  sync.Mutex
+	paths map[string]time.Time // Until when events are ignored, zero while writing
+}
+
+func newWriteTracker() *writeTracker {
+	return &writeTracker{paths: make(map[string]time.Time)}
+}
+
+// begin marks path, and the temporary files writeAtomic creates for it, as
+// being written
+func (t *writeTracker) begin(path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.paths[path] = time.Time{}
+}
+
+// end ignores the events of path for ownWriteWindow more, covering the
+// events still queued for the write
+func (t *writeTracker) end(path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.paths[path] = time.Now().Add(ownWriteWindow)
+}
+
+// contains reports whether name is a file written by the watcher
+func (t *writeTracker) contains(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	found := false
+	for path, until := range t.paths {
+		if !until.IsZero() && now.After(until) {
+			delete(t.paths, path)
+			continue
+		}
+		if name == path || isAtomicTemp(name, path) {
+			found = true
+		}
+	}
+	return found
+}
+
+// atomicTempPattern returns the name pattern of the temporary files
+// writeAtomic creates for dest
+func atomicTempPattern(dest string) string {
+	return "." + filepath.Base(dest) + ".*.tmp"
+}
+
+func isAtomicTemp(name, dest string) bool {
+	if filepath.Dir(name) != filepath.Dir(dest) {
+		return false
+	}
+	matched, _ := filepath.Match(atomicTempPattern(dest), filepath.Base(name))
+	return matched
+}
+
+// writeAtomic writes dest through a temporary file in the same directory
+// which is renamed into place once complete
+func writeAtomic(dest string, mode os.FileMode, write func(w io.Writer) error) error {
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, atomicTempPattern(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// copyFile copies src to dest preserving its mode and modification time
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cannot copy a directory")
+	}
+
+	err = writeAtomic(dest, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// moveFile renames src to dest, copying across filesystems
+func moveFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	err := os.Rename(src, dest)
+	if err == nil {
+		return nil
+	}
+
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) || !errors.Is(linkErr.Err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dest); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// compressFile compresses path into path.gz or path.zst
+func compressFile(path, format string, keepSource bool) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	dest := path + compressExt(format)
+	err = writeAtomic(dest, info.Mode().Perm(), func(w io.Writer) error {
+		cw, err := newCompressWriter(w, format)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(cw, in); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Chtimes(dest, info.ModTime(), info.ModTime()); err != nil {
+		return "", err
+	}
+	if !keepSource {
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	}
+	return dest, nil
+}
+
+func compressExt(format string) string {
+	switch format {
+	case CompressZstd:
+		return ".zst"
+	case CompressGzip, "":
+		return ".gz"
+	}
+	return ""
+}
+
+func newCompressWriter(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	case CompressGzip, "":
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("invalid compress format: %s", format)
+}
+
+// tarExt returns the extension of archives written in format
+func tarExt(format string) string {
+	switch format {
+	case "", "none":
+		return ".tar"
+	}
+	return ".tar" + compressExt(format)
+}
+
+// nopWriteCloser leaves the underlying writer open
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// tarPath archives the file or directory at path into dest
+func tarPath(path, dest, format string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	return writeAtomic(dest, 0644, func(w io.Writer) error {
+		var cw io.WriteCloser = nopWriteCloser{w}
+		if format != "" && format != "none" {
+			compressed, err := newCompressWriter(w, format)
+			if err != nil {
+				return err
+			}
+			cw = compressed
+		}
+
+		// Entries are named relative to the parent so that the archive
+		// unpacks into the file or directory name
+		tw := tar.NewWriter(cw)
+		base := filepath.Dir(path)
+
+		err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return addTarEntry(tw, base, p, fi)
+		})
+		if err != nil {
+			tw.Close()
+			cw.Close()
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	})
+}
+
+func addTarEntry(tw *tar.Writer, base, path string, info os.FileInfo) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	name, err := filepath.Rel(base, path)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeChecksum writes a sha256sum compatible sidecar next to path
+func writeChecksum(path, algorithm string) error {
+	var h hash.Hash
+	switch algorithm {
+	case ChecksumSHA512:
+		h = sha512.New()
+	case ChecksumSHA256, "":
+		algorithm = ChecksumSHA256
+		h = sha256.New()
+	default:
+		return fmt.Errorf("invalid checksum algorithm: %s", algorithm)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), filepath.Base(path))
+	return writeAtomic(path+"."+algorithm, 0644, func(w io.Writer) error {
+		_, err := io.WriteString(w, line)
+		return err
+	})
+}
@@ -0,0 +1,237 @@
+package watcher
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func newTestFileOps(t *testing.T, fw *FileWatcher, steps ...FileStep) *fileOps {
+	t.Helper()
+
+	ops, err := newFileOps(fw, FileOpsConfig{Steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ops
+}
+
+func createEvent(fw *FileWatcher, path string) *Event {
+	return fw.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Create})
+}
+
+func TestFileOpsCopyAndChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.csv")
+	writeTestFile(t, path, "a,b\n")
+	fw := newTestWatcher(t)
+
+	ops := newTestFileOps(t, fw,
+		FileStep{Op: FileOpCopy, Dest: "{{ .Dir }}/archive/"},
+		FileStep{Op: FileOpChecksum},
+	)
+	if err := ops.Handle(createEvent(fw, path)); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := filepath.Join(dir, "archive", "report.csv")
+	if got := readTestFile(t, copied); got != "a,b\n" {
+		t.Fatalf("unexpected copy %q", got)
+	}
+	if got := readTestFile(t, path); got != "a,b\n" {
+		t.Fatalf("expected the source to be kept, got %q", got)
+	}
+
+	sum := sha256.Sum256([]byte("a,b\n"))
+	want := hex.EncodeToString(sum[:]) + "  report.csv\n"
+	if got := readTestFile(t, copied+".sha256"); got != want {
+		t.Fatalf("unexpected checksum sidecar %q, want %q", got, want)
+	}
+}
+
+func TestFileOpsCompressAndMove(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	writeTestFile(t, path, "line\n")
+	fw := newTestWatcher(t)
+
+	ops := newTestFileOps(t, fw,
+		FileStep{Op: FileOpCompress},
+		FileStep{Op: FileOpMove, Dest: "{{ .Dir }}/done/"},
+	)
+	if err := ops.Handle(createEvent(fw, path)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, gone := range []string{path, path + ".gz"} {
+		if _, err := os.Lstat(gone); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be gone, got %v", gone, err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "done", "app.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "line\n" {
+		t.Fatalf("unexpected content %q: %v", data, err)
+	}
+}
+
+func TestFileOpsTarIntoDirectory(t *testing.T) {
+	dir := t.TempDir()
+	logs := filepath.Join(dir, "logs")
+	writeTestFile(t, filepath.Join(logs, "a.log"), "a")
+	writeTestFile(t, filepath.Join(logs, "b.log"), "b")
+	archives := filepath.Join(dir, "archives")
+	if err := os.Mkdir(archives, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fw := newTestWatcher(t)
+
+	ops := newTestFileOps(t, fw, FileStep{Op: FileOpTar, Dest: archives, Format: CompressGzip})
+	if err := ops.Handle(createEvent(fw, logs)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(archives, "logs.tar.gz"))
+	if err != nil {
+		t.Fatalf("expected the archive to be named after the directory: %v", err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	if got := names; len(got) != 3 || got[0] != "logs/" || got[1] != "logs/a.log" || got[2] != "logs/b.log" {
+		t.Fatalf("unexpected entries %q", got)
+	}
+}
+
+func TestFileOpsTarExt(t *testing.T) {
+	for format, want := range map[string]string{
+		"":           ".tar",
+		"none":       ".tar",
+		CompressGzip: ".tar.gz",
+		CompressZstd: ".tar.zst",
+	} {
+		if got := tarExt(format); got != want {
+			t.Errorf("format %q: expected %s, got %s", format, want, got)
+		}
+	}
+}
+
+func TestFileOpsSkipsDirectoriesOfFileSteps(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fw := newTestWatcher(t)
+
+	for _, step := range []FileStep{
+		{Op: FileOpCopy, Dest: "{{ .Dir }}/copy/"},
+		{Op: FileOpCompress},
+		{Op: FileOpChecksum},
+	} {
+		ops := newTestFileOps(t, fw, step)
+		if err := ops.Handle(createEvent(fw, sub)); err != nil {
+			t.Fatalf("%s: expected the directory to be skipped, got %v", step.Op, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected nothing to be written, got %d entries", len(entries))
+	}
+}
+
+func TestFileOpsDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.tmp")
+	writeTestFile(t, path, "data")
+	fw := newTestWatcher(t)
+
+	ops := newTestFileOps(t, fw, FileStep{Op: FileOpDelete})
+	if err := ops.Handle(createEvent(fw, path)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be deleted, got %v", err)
+	}
+}
+
+func TestFileOpsIgnoresOwnWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.csv")
+	writeTestFile(t, path, "data")
+	fw := newTestWatcher(t)
+
+	ops := newTestFileOps(t, fw, FileStep{Op: FileOpChecksum})
+	if err := ops.Handle(createEvent(fw, path)); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := path + ".sha256"
+	if !fw.written.contains(sidecar) {
+		t.Fatal("expected the events of the sidecar to be ignored")
+	}
+	if !fw.written.contains(filepath.Join(dir, ".report.csv.sha256.123456.tmp")) {
+		t.Fatal("expected the events of the temporary file to be ignored")
+	}
+	if fw.written.contains(path) {
+		t.Fatal("expected the events of the source to be kept")
+	}
+}
+
+func TestWriteTrackerExpires(t *testing.T) {
+	written := newWriteTracker()
+
+	written.begin("/data/out")
+	if !written.contains("/data/out") {
+		t.Fatal("expected a file being written to be ignored")
+	}
+
+	written.end("/data/out")
+	if !written.contains("/data/out") {
+		t.Fatal("expected the events queued for the write to be ignored")
+	}
+
+	written.paths["/data/out"] = time.Now().Add(-time.Millisecond)
+	if written.contains("/data/out") {
+		t.Fatal("expected the file to be forgotten after the window")
+	}
+	if len(written.paths) != 0 {
+		t.Fatalf("expected the expired entry to be removed, got %v", written.paths)
+	}
+}
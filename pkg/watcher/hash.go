@@ -0,0 +1,193 @@
+package watcher
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	HashSHA256 = "sha256"
+	HashXXHash = "xxhash"
+
+	// Files are hashed on the watch loop, so the default stays small
+	defaultHashMaxFileSize = 1024 * 1024
+	defaultHashCacheSize   = 10000
+)
+
+// ContentHashConfig controls content based change suppression
+type ContentHashConfig struct {
+	Algorithm   string // Digest algorithm (sha256, xxhash)
+	MaxFileSize int64  // Files larger than this are never suppressed
+	CacheSize   int    // Maximum number of cached digests
+}
+
+type hashEntry struct {
+	path     string
+	previous string
+	current  string
+	mode     os.FileMode // Permissions, so that chmod events are not suppressed
+}
+
+// hashCache is a bounded LRU cache of file content digests
+type hashCache struct {
+	lock        sync.Mutex
+	algorithm   string
+	maxFileSize int64
+	maxEntries  int
+	entries     map[string]*list.Element
+	order       *list.List
+}
+
+func newHashCache(cfg ContentHashConfig) *hashCache {
+	c := &hashCache{
+		algorithm:   cfg.Algorithm,
+		maxFileSize: cfg.MaxFileSize,
+		maxEntries:  cfg.CacheSize,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+	}
+	if c.algorithm == "" {
+		c.algorithm = HashSHA256
+	}
+	if c.maxFileSize <= 0 {
+		c.maxFileSize = defaultHashMaxFileSize
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultHashCacheSize
+	}
+	return c
+}
+
+// IsValidHashAlgorithm reports whether the algorithm is supported
+func IsValidHashAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case HashSHA256, HashXXHash:
+		return true
+	default:
+		return false
+	}
+}
+
+// changed records the current digest and permissions of path and reports
+// whether either differs from the previously recorded ones. Files that
+// cannot be hashed are always reported as changed.
+func (c *hashCache) changed(path string) bool {
+	digest, mode, err := c.digest(path)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		c.removeLocked(path)
+		return true
+	}
+
+	if elem, ok := c.entries[path]; ok {
+		entry := elem.Value.(*hashEntry)
+		c.order.MoveToFront(elem)
+		if entry.current == digest && entry.mode == mode {
+			return false
+		}
+		if entry.current != digest {
+			entry.previous = entry.current
+			entry.current = digest
+		}
+		entry.mode = mode
+		return true
+	}
+
+	c.insertLocked(&hashEntry{path: path, current: digest, mode: mode})
+	return true
+}
+
+// prime records the digest of path without reporting a change
+func (c *hashCache) prime(path string) {
+	digest, mode, err := c.digest(path)
+	if err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[path]; ok {
+		return
+	}
+	c.insertLocked(&hashEntry{path: path, current: digest, mode: mode})
+}
+
+// digests returns the previous and current digest recorded for path
+func (c *hashCache) digests(path string) (string, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[path]; ok {
+		entry := elem.Value.(*hashEntry)
+		return entry.previous, entry.current
+	}
+	return "", ""
+}
+
+func (c *hashCache) remove(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.removeLocked(path)
+}
+
+func (c *hashCache) insertLocked(entry *hashEntry) {
+	c.entries[entry.path] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*hashEntry).path)
+	}
+}
+
+func (c *hashCache) removeLocked(path string) {
+	if elem, ok := c.entries[path]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, path)
+	}
+}
+
+// digest returns the content digest and the permissions of path
+func (c *hashCache) digest(path string) (string, os.FileMode, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", 0, fmt.Errorf("not a regular file: %s", path)
+	}
+	if info.Size() > c.maxFileSize {
+		return "", 0, fmt.Errorf("file too large to hash: %s", path)
+	}
+
+	var h hash.Hash
+	switch c.algorithm {
+	case HashXXHash:
+		h = xxhash.New()
+	default:
+		h = sha256.New()
+	}
+
+	if _, err := io.Copy(h, io.LimitReader(f, c.maxFileSize+1)); err != nil {
+		return "", 0, err
+	}
+	return c.algorithm + ":" + hex.EncodeToString(h.Sum(nil)), info.Mode().Perm(), nil
+}
@@ -0,0 +1,106 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestHashCacheChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeTestFile(t, path, "a: 1\n")
+	c := newHashCache(ContentHashConfig{})
+
+	if !c.changed(path) {
+		t.Fatal("expected an unknown file to be reported as changed")
+	}
+	if c.changed(path) {
+		t.Fatal("expected the unchanged file to be suppressed")
+	}
+
+	_, first := c.digests(path)
+	writeTestFile(t, path, "a: 2\n")
+	if !c.changed(path) {
+		t.Fatal("expected the new content to be reported")
+	}
+	if previous, current := c.digests(path); previous != first || current == first || !strings.HasPrefix(current, "sha256:") {
+		t.Fatalf("unexpected digests %s and %s", previous, current)
+	}
+}
+
+func TestHashCachePermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deploy.sh")
+	writeTestFile(t, path, "#!/bin/sh\n")
+	c := newHashCache(ContentHashConfig{Algorithm: HashXXHash})
+	c.prime(path)
+
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !c.changed(path) {
+		t.Fatal("expected the permission change to be reported")
+	}
+	if previous, _ := c.digests(path); previous != "" {
+		t.Fatalf("expected the content digest to be kept, got previous %s", previous)
+	}
+	if c.changed(path) {
+		t.Fatal("expected the unchanged file to be suppressed")
+	}
+}
+
+func TestHashCacheLimits(t *testing.T) {
+	dir := t.TempDir()
+	c := newHashCache(ContentHashConfig{MaxFileSize: 4, CacheSize: 2})
+
+	large := filepath.Join(dir, "large")
+	writeTestFile(t, large, "12345")
+	c.changed(large)
+	if !c.changed(large) {
+		t.Fatal("expected files above the size limit to always pass")
+	}
+
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file-%d", i))
+		writeTestFile(t, path, "x")
+		c.changed(path)
+	}
+	if n := len(c.entries); n != 2 {
+		t.Fatalf("expected the cache to hold 2 entries, got %d", n)
+	}
+	if _, ok := c.entries[filepath.Join(dir, "file-0")]; ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+}
+
+func TestAcceptsSuppressesUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	writeTestFile(t, path, "a: 1\n")
+
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), []string{dir}, []string{"modify", "chmod"}, "true", nil, nil, nil, false,
+		WithContentHash(ContentHashConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+	fw.hashes.prime(path)
+
+	if fw.accepts(fsnotify.Event{Name: path, Op: fsnotify.Write}, "modify") {
+		t.Fatal("expected a write of the same content to be suppressed")
+	}
+	if fw.accepts(fsnotify.Event{Name: path, Op: fsnotify.Chmod}, "chmod") {
+		t.Fatal("expected a chmod keeping the permissions to be suppressed")
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !fw.accepts(fsnotify.Event{Name: path, Op: fsnotify.Chmod}, "chmod") {
+		t.Fatal("expected the permission change to pass")
+	}
+}
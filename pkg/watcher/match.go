@@ -0,0 +1,221 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMultilineTimeout = time.Second
+
+// MatchConfig selects the tailed lines that trigger the command
+type MatchConfig struct {
+	Patterns          []string      // Regular expressions evaluated against each record
+	MultilineStart    string        // Regular expression marking the first line of a record
+	MultilineMaxLines int           // Maximum number of lines grouped into one record
+	MultilineTimeout  time.Duration // Time an unfinished record waits for more lines
+}
+
+// Match is a record of appended lines matched by one of the patterns
+type Match struct {
+	Pattern string            `json:"pattern"`
+	Lines   []string          `json:"lines"`
+	Groups  map[string]string `json:"groups,omitempty"`
+}
+
+type matcher struct {
+	patterns []*regexp.Regexp
+	start    *regexp.Regexp
+	maxLines int
+	timeout  time.Duration
+
+	// expired is called with the event that read the last lines of a record
+	// that saw no further lines within the timeout
+	expired func(event *Event)
+
+	lock    sync.Mutex
+	pending map[string]*pendingRecord
+}
+
+// pendingRecord is the last record of a file, which may continue with the
+// next append
+type pendingRecord struct {
+	lines []string
+	event *Event
+	timer *time.Timer
+}
+
+var envNameReplacer = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Validate compiles the configured expressions and reports the first error
+func (c MatchConfig) Validate() error {
+	_, err := newMatcher(c)
+	return err
+}
+
+func newMatcher(cfg MatchConfig) (*matcher, error) {
+	if len(cfg.Patterns) == 0 {
+		return nil, fmt.Errorf("at least one match pattern must be specified")
+	}
+
+	m := &matcher{
+		maxLines: cfg.MultilineMaxLines,
+		timeout:  cfg.MultilineTimeout,
+		pending:  make(map[string]*pendingRecord),
+	}
+	if m.timeout <= 0 {
+		m.timeout = defaultMultilineTimeout
+	}
+	for _, pattern := range cfg.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match pattern %q: %v", pattern, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+
+	if cfg.MultilineStart != "" {
+		re, err := regexp.Compile(cfg.MultilineStart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiline_start pattern %q: %v", cfg.MultilineStart, err)
+		}
+		m.start = re
+	}
+
+	return m, nil
+}
+
+// match groups the lines read from the file of event into records and
+// returns the records matched by one of the patterns. With multiline_start
+// the last record is held back, as the next append may continue it. It is
+// completed by the next read, by final for a removed or renamed file, or
+// handed to expired once the timeout elapsed.
+func (m *matcher) match(event *Event, lines []string, final bool) []Match {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.pending[event.Path]; ok {
+		p.timer.Stop()
+		delete(m.pending, event.Path)
+		lines = append(p.lines, lines...)
+	}
+
+	records := m.records(lines)
+	if m.start != nil && !final && len(records) > 0 {
+		last := records[len(records)-1]
+		if m.maxLines <= 0 || len(last) < m.maxLines {
+			records = records[:len(records)-1]
+			m.holdLocked(event, last)
+		}
+	}
+	return m.matches(records)
+}
+
+// flush returns the matches of the record held back after reading the lines
+// of event
+func (m *matcher) flush(event *Event) []Match {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.pending[event.Path]
+	if !ok || p.event != event {
+		// Completed by a read in the meantime
+		return nil
+	}
+	delete(m.pending, event.Path)
+	return m.matches([][]string{p.lines})
+}
+
+func (m *matcher) holdLocked(event *Event, lines []string) {
+	p := &pendingRecord{lines: lines, event: event}
+	p.timer = time.AfterFunc(m.timeout, func() {
+		if m.expired != nil {
+			m.expired(event)
+		}
+	})
+	m.pending[event.Path] = p
+}
+
+// close stops the timers of the held back records
+func (m *matcher) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for path, p := range m.pending {
+		p.timer.Stop()
+		delete(m.pending, path)
+	}
+}
+
+func (m *matcher) matches(records [][]string) []Match {
+	var matches []Match
+	for _, record := range records {
+		text := strings.Join(record, "\n")
+		for _, re := range m.patterns {
+			submatches := re.FindStringSubmatch(text)
+			if submatches == nil {
+				continue
+			}
+
+			match := Match{Pattern: re.String(), Lines: record}
+			for i, name := range re.SubexpNames() {
+				if i == 0 || name == "" {
+					continue
+				}
+				if match.Groups == nil {
+					match.Groups = make(map[string]string)
+				}
+				match.Groups[name] = submatches[i]
+			}
+			matches = append(matches, match)
+			break
+		}
+	}
+	return matches
+}
+
+func (m *matcher) records(lines []string) [][]string {
+	if m.start == nil {
+		records := make([][]string, len(lines))
+		for i, line := range lines {
+			records[i] = []string{line}
+		}
+		return records
+	}
+
+	var records [][]string
+	var current []string
+	for _, line := range lines {
+		full := m.maxLines > 0 && len(current) >= m.maxLines
+		if current != nil && (m.start.MatchString(line) || full) {
+			records = append(records, current)
+			current = nil
+		}
+		current = append(current, line)
+	}
+	if current != nil {
+		records = append(records, current)
+	}
+	return records
+}
+
+// env returns the environment variables describing the match
+func (m Match) env() []string {
+	env := []string{
+		fmt.Sprintf("WATCHER_MATCH_PATTERN=%s", m.Pattern),
+		fmt.Sprintf("WATCHER_MATCH_JSON=%s", m.String()),
+	}
+	for name, value := range m.Groups {
+		name = strings.ToUpper(envNameReplacer.ReplaceAllString(name, "_"))
+		env = append(env, fmt.Sprintf("WATCHER_MATCH_%s=%s", name, value))
+	}
+	return env
+}
+
+func (m Match) String() string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
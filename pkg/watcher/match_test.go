@@ -0,0 +1,93 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestMatcher(t *testing.T, timeout time.Duration) *matcher {
+	t.Helper()
+
+	m, err := newMatcher(MatchConfig{
+		Patterns:         []string{`ERROR (?P<msg>.*)`},
+		MultilineStart:   `^\d{4}-`,
+		MultilineTimeout: timeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.close)
+	return m
+}
+
+func TestMatchCarriesRecordAcrossReads(t *testing.T) {
+	m := newTestMatcher(t, time.Hour)
+	first := testEvent("/logs/app.log")
+
+	matches := m.match(first, []string{"2024-01-01 ERROR boom", "  at main.go:10"}, false)
+	if len(matches) != 0 {
+		t.Fatalf("expected the last record to be held back, got %+v", matches)
+	}
+
+	second := testEvent("/logs/app.log")
+	matches = m.match(second, []string{"  at main.go:20", "2024-01-01 INFO ok"}, false)
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %+v", matches)
+	}
+	if got := matches[0].Lines; len(got) != 3 || got[2] != "  at main.go:20" {
+		t.Fatalf("expected the record to continue across reads, got %q", got)
+	}
+	if got := matches[0].Groups["msg"]; got != "boom" {
+		t.Fatalf("unexpected group: %q", got)
+	}
+}
+
+func TestMatchFinalReleasesRecord(t *testing.T) {
+	m := newTestMatcher(t, time.Hour)
+
+	m.match(testEvent("/logs/app.log"), []string{"2024-01-01 ERROR boom"}, false)
+	matches := m.match(testEvent("/logs/app.log"), nil, true)
+	if len(matches) != 1 || len(matches[0].Lines) != 1 {
+		t.Fatalf("expected the held record on the final read, got %+v", matches)
+	}
+}
+
+func TestMatchFlushesRecordAfterTimeout(t *testing.T) {
+	m := newTestMatcher(t, 10*time.Millisecond)
+	expired := make(chan *Event, 1)
+	m.expired = func(event *Event) { expired <- event }
+
+	event := testEvent("/logs/app.log")
+	m.match(event, []string{"2024-01-01 ERROR boom"}, false)
+
+	select {
+	case got := <-expired:
+		if got != event {
+			t.Fatal("expected the event that read the record")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("record was not flushed")
+	}
+
+	matches := m.flush(event)
+	if len(matches) != 1 || matches[0].Groups["msg"] != "boom" {
+		t.Fatalf("expected the flushed record to match, got %+v", matches)
+	}
+	if matches := m.flush(event); len(matches) != 0 {
+		t.Fatalf("expected the record to be flushed once, got %+v", matches)
+	}
+}
+
+func TestMatchFlushIgnoresCompletedRecord(t *testing.T) {
+	m := newTestMatcher(t, time.Hour)
+
+	first := testEvent("/logs/app.log")
+	m.match(first, []string{"2024-01-01 ERROR one"}, false)
+	m.match(testEvent("/logs/app.log"), []string{"2024-01-01 ERROR two"}, false)
+
+	// The record of first was completed by the second read, which holds
+	// back its own record
+	if matches := m.flush(first); len(matches) != 0 {
+		t.Fatalf("expected no matches, got %+v", matches)
+	}
+}
@@ -0,0 +1,64 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Metrics receives the measurements of a watcher, e.g. to export them to
+// Prometheus. rule is the configured path covering the event and op its
+// event type. Methods are called from several goroutines.
+type Metrics interface {
+	// EventReceived is called for every event on a watched path
+	EventReceived(rule, op string)
+
+	// EventFiltered is called for events skipped by the event types, ignore
+	// patterns, content hashes or because dispatch is paused
+	EventFiltered(rule, op string)
+
+	// EventDispatched is called for events handed to the command, service,
+	// sink and actions
+	EventDispatched(rule, op string)
+
+	// EventDropped is called for events discarded by the concurrency policy,
+	// a full sink buffer or a full publisher spool
+	EventDropped(rule, op string)
+
+	// CommandFinished is called once a command exited. exitCode is -1 for
+	// commands killed by a signal.
+	CommandFinished(rule string, duration time.Duration, exitCode int)
+
+	// Retry is called when an action retries a delivery
+	Retry(action string)
+
+	// Timeout is called when a request of an action timed out, and with
+	// action "command" when a command was killed after the timeout
+	Timeout(action string)
+
+	// Overflow is called when the kernel event queue overflowed and events
+	// were lost
+	Overflow()
+}
+
+// nopMetrics discards the measurements when no Metrics are configured
+type nopMetrics struct{}
+
+func (nopMetrics) EventReceived(string, string)               {}
+func (nopMetrics) EventFiltered(string, string)               {}
+func (nopMetrics) EventDispatched(string, string)             {}
+func (nopMetrics) EventDropped(string, string)                {}
+func (nopMetrics) CommandFinished(string, time.Duration, int) {}
+func (nopMetrics) Retry(string)                               {}
+func (nopMetrics) Timeout(string)                             {}
+func (nopMetrics) Overflow()                                  {}
+
+// isTimeout reports whether err is a deadline or network timeout
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// recordingMetrics counts the measurements by kind, rule and op
+type recordingMetrics struct {
+	lock   sync.Mutex
+	counts map[string]int
+	exits  []int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{counts: make(map[string]int)}
+}
+
+func (m *recordingMetrics) add(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counts[key]++
+}
+
+func (m *recordingMetrics) count(key string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counts[key]
+}
+
+func (m *recordingMetrics) EventReceived(rule, op string)   { m.add("received " + op) }
+func (m *recordingMetrics) EventFiltered(rule, op string)   { m.add("filtered " + op) }
+func (m *recordingMetrics) EventDispatched(rule, op string) { m.add("dispatched " + op) }
+func (m *recordingMetrics) EventDropped(rule, op string)    { m.add("dropped " + op) }
+func (m *recordingMetrics) Retry(action string)             { m.add("retry " + action) }
+func (m *recordingMetrics) Timeout(action string)           { m.add("timeout " + action) }
+func (m *recordingMetrics) Overflow()                       { m.add("overflow") }
+
+func (m *recordingMetrics) CommandFinished(rule string, duration time.Duration, exitCode int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counts["command "+rule]++
+	m.exits = append(m.exits, exitCode)
+}
+
+func (m *recordingMetrics) exitCodes() []int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]int{}, m.exits...)
+}
+
+func TestMetricsEvents(t *testing.T) {
+	dir := t.TempDir()
+	metrics := newRecordingMetrics()
+
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), []string{dir}, []string{"create"}, "true", nil, nil, []string{"*.tmp"}, false,
+		WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+	if err := fw.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(dir, "upload.tmp"), "")
+	writeTestFile(t, filepath.Join(dir, "report.csv"), "")
+
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("command "+dir) == 1 })
+	for key, want := range map[string]int{
+		"received create":   2,
+		"filtered create":   1,
+		"dispatched create": 1,
+	} {
+		if got := metrics.count(key); got != want {
+			t.Errorf("%s: expected %d, got %d", key, want, got)
+		}
+	}
+	if got := metrics.exitCodes(); fmt.Sprint(got) != "[0]" {
+		t.Fatalf("expected a successful command, got exit codes %v", got)
+	}
+
+	// Filtered by the event types
+	if err := os.Remove(filepath.Join(dir, "report.csv")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("filtered remove") == 1 })
+}
@@ -0,0 +1,460 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorRenameGrace is how long the destination of a renamed path is kept
+// for the create event of the new name, which moves it instead of copying
+// it again
+const mirrorRenameGrace = 5 * time.Second
+
+// SyncConfig keeps a destination directory in sync with the watched paths
+type SyncConfig struct {
+	Dest           string        // Directory mirroring the watched paths
+	VerifyInterval time.Duration // Interval of full verification sweeps, 0 disables them
+	DryRun         bool          // Only log the changes that would be made
+}
+
+// mirror maintains the destination incrementally from the event stream.
+// A full reconciliation runs at start and on every verification sweep to
+// repair changes missed by the event stream.
+type mirror struct {
+	fw  *FileWatcher
+	cfg SyncConfig
+
+	// lock serializes sweeps and the handling of events, so that a sweep
+	// does not undo or repeat the changes of an event applied meanwhile
+	lock    sync.Mutex
+	started bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+
+	// Destinations of renamed paths waiting for the create of the new name.
+	// Events of different paths are dispatched independently, so the create
+	// may also be handled first and is then recorded in moved.
+	renameLock sync.Mutex
+	renamed    map[string]*time.Timer
+	moved      map[string]time.Time
+}
+
+func newMirror(fw *FileWatcher, cfg SyncConfig) (*mirror, error) {
+	if cfg.Dest == "" || !filepath.IsAbs(cfg.Dest) {
+		return nil, fmt.Errorf("sync dest must be an absolute path")
+	}
+	if cfg.VerifyInterval < 0 {
+		return nil, fmt.Errorf("sync verify interval must be non-negative")
+	}
+
+	dest := filepath.Clean(cfg.Dest)
+	for _, path := range fw.paths {
+		path = filepath.Clean(path)
+		if dest == path || isWithin(dest, path) || isWithin(path, dest) {
+			return nil, fmt.Errorf("sync dest %s overlaps the watched path %s", dest, path)
+		}
+	}
+	cfg.Dest = dest
+
+	// With several watched paths each is mirrored under its base name
+	if len(fw.paths) > 1 {
+		names := make(map[string]string)
+		for _, path := range fw.paths {
+			name := filepath.Base(filepath.Clean(path))
+			if other, ok := names[name]; ok {
+				return nil, fmt.Errorf("sync cannot mirror %s and %s, both would be mirrored to %s", other, path, filepath.Join(dest, name))
+			}
+			names[name] = path
+		}
+	}
+
+	return &mirror{
+		fw:      fw,
+		cfg:     cfg,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+		renamed: make(map[string]*time.Timer),
+		moved:   make(map[string]time.Time),
+	}, nil
+}
+
+// start runs the initial reconciliation and the verification sweeps in the
+// background
+func (m *mirror) start() error {
+	if m.cfg.DryRun {
+		if _, err := os.Stat(m.cfg.Dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.MkdirAll(m.cfg.Dest, 0755); err != nil {
+		return fmt.Errorf("failed to create sync dest: %v", err)
+	}
+
+	m.started = true
+	go m.run()
+	return nil
+}
+
+func (m *mirror) run() {
+	defer close(m.doneCh)
+
+	m.sweep("initial")
+	if m.cfg.VerifyInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(m.cfg.VerifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep("verify")
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// Handle applies an event to the destination
+func (m *mirror) Handle(event *Event) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	dest := m.destFor(event.Root, event.RelPath)
+
+	switch event.Type {
+	case EventRemove:
+		return m.remove(dest)
+	case EventRename:
+		m.renamedAway(dest)
+		return nil
+	}
+
+	info, err := os.Lstat(event.Path)
+	if os.IsNotExist(err) {
+		return m.remove(dest)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !m.fw.recursiveWatch && event.Path != event.Root {
+		return nil
+	}
+
+	// A moved destination is only copied again when it differs
+	force := true
+	if event.OldPath != "" {
+		old := m.destFor(event.Root, relTo(event.Root, m.fw.isFileRoot(event.Root), event.OldPath))
+		moved, err := m.move(old, dest)
+		if err != nil {
+			return err
+		}
+		force = !moved
+	}
+
+	// Directory events carry no events for their contents, e.g. when a
+	// directory is moved into the tree
+	if info.IsDir() {
+		_, err := m.reconcile(event.Path, dest)
+		return err
+	}
+	return m.syncEntry(event.Path, dest, info, force)
+}
+
+// renamedAway keeps the destination of a renamed path for the create of its
+// new name, removing it once mirrorRenameGrace passed without one
+func (m *mirror) renamedAway(dest string) {
+	m.renameLock.Lock()
+	defer m.renameLock.Unlock()
+
+	if _, ok := m.moved[dest]; ok {
+		delete(m.moved, dest)
+		return
+	}
+	if timer, ok := m.renamed[dest]; ok {
+		timer.Stop()
+	}
+	m.renamed[dest] = time.AfterFunc(mirrorRenameGrace, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.renameLock.Lock()
+		defer m.renameLock.Unlock()
+
+		if _, ok := m.renamed[dest]; !ok {
+			return
+		}
+		delete(m.renamed, dest)
+		if err := m.remove(dest); err != nil {
+			m.fw.logger.Error("failed to remove renamed sync destination", "dest", dest, "error", err)
+		}
+	})
+}
+
+// move moves the destination of the old name of a renamed path to dest and
+// reports whether there was one to move
+func (m *mirror) move(old, dest string) (bool, error) {
+	m.renameLock.Lock()
+	defer m.renameLock.Unlock()
+
+	if timer, ok := m.renamed[old]; ok {
+		timer.Stop()
+		delete(m.renamed, old)
+	} else {
+		// Forget moves whose rename event was filtered out
+		for path, at := range m.moved {
+			if time.Since(at) > mirrorRenameGrace {
+				delete(m.moved, path)
+			}
+		}
+		m.moved[old] = time.Now()
+	}
+
+	if _, err := os.Lstat(old); err != nil {
+		return false, nil
+	}
+	err := m.apply("move", old, dest, func() error { return moveFile(old, dest) })
+	return err == nil && !m.cfg.DryRun, err
+}
+
+// Close stops the verification sweeps and removes the destinations of
+// renamed paths still waiting for their new name
+func (m *mirror) Close() error {
+	m.lock.Lock()
+	m.renameLock.Lock()
+	for dest, timer := range m.renamed {
+		timer.Stop()
+		if err := m.remove(dest); err != nil {
+			m.fw.logger.Error("failed to remove renamed sync destination", "dest", dest, "error", err)
+		}
+	}
+	m.renamed = make(map[string]*time.Timer)
+	m.renameLock.Unlock()
+	m.lock.Unlock()
+
+	if !m.started {
+		return nil
+	}
+	close(m.stopCh)
+	<-m.doneCh
+	return nil
+}
+
+// sweep reconciles all watched paths with the destination
+func (m *mirror) sweep(kind string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	start := time.Now()
+	changes := 0
+	for _, root := range m.fw.paths {
+		n, err := m.reconcile(root, m.destFor(root, relTo(root, m.fw.isFileRoot(root), root)))
+		changes += n
+		if err != nil {
+			m.fw.logger.Error("sync failed", "sweep", kind, "path", root, "error", err)
+		}
+	}
+
+	m.fw.eventLog().Info("sync sweep",
+		"sweep", kind,
+		"changes", changes,
+		"dry_run", m.cfg.DryRun,
+		"duration", time.Since(start).String(),
+	)
+}
+
+// reconcile makes dest mirror src and returns the number of changes
+func (m *mirror) reconcile(src, dest string) (int, error) {
+	changes := 0
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path != src && m.fw.ignored(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Without recursive_watch only the files directly in a watched
+		// directory are mirrored
+		if path != src && info.IsDir() && !m.fw.recursiveWatch {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if m.inSync(info, target) {
+			return nil
+		}
+		changes++
+		return m.syncEntry(path, target, info, false)
+	})
+	if err != nil {
+		return changes, err
+	}
+
+	// Remove what no longer exists in the source. Excluded entries are left
+	// alone as they are not managed by the mirror.
+	err = filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == dest {
+			return nil
+		}
+		if m.fw.ignored(path) || (info.IsDir() && !m.fw.recursiveWatch) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(src, rel)); !os.IsNotExist(err) {
+			return nil
+		}
+		changes++
+		if err := m.remove(path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// inSync reports whether target matches the source entry described by info
+func (m *mirror) inSync(info os.FileInfo, target string) bool {
+	existing, err := os.Lstat(target)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case info.IsDir():
+		return existing.IsDir()
+	case info.Mode()&os.ModeSymlink != 0:
+		return existing.Mode()&os.ModeSymlink != 0
+	}
+	return existing.Mode().IsRegular() &&
+		existing.Size() == info.Size() &&
+		existing.ModTime().Equal(info.ModTime()) &&
+		existing.Mode().Perm() == info.Mode().Perm()
+}
+
+// syncEntry copies a single file, symlink or directory to target
+func (m *mirror) syncEntry(src, target string, info os.FileInfo, force bool) error {
+	if !force && m.inSync(info, target) {
+		return nil
+	}
+
+	switch {
+	case info.IsDir():
+		if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+			if err := m.remove(target); err != nil {
+				return err
+			}
+		}
+		return m.apply("mkdir", src, target, func() error { return os.MkdirAll(target, info.Mode().Perm()) })
+
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return m.apply("symlink", src, target, func() error {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		})
+
+	case info.Mode().IsRegular():
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+			if err := m.remove(target); err != nil {
+				return err
+			}
+		}
+		return m.apply("copy", src, target, func() error { return copyFile(src, target) })
+	}
+
+	// Devices, sockets and pipes are not mirrored
+	return nil
+}
+
+func (m *mirror) remove(target string) error {
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return nil
+	}
+	return m.apply("delete", "", target, func() error { return os.RemoveAll(target) })
+}
+
+// apply runs a change unless in dry-run mode and records it in the event log
+func (m *mirror) apply(op, src, dest string, fn func() error) error {
+	logger := m.fw.eventLog()
+	if m.cfg.DryRun {
+		logger.Info("sync dry run", "op", op, "path", src, "dest", dest)
+		return nil
+	}
+
+	if err := fn(); err != nil {
+		logger.Error("sync failed", "op", op, "path", src, "dest", dest, "error", err.Error())
+		return err
+	}
+	m.fw.logger.Debug("synced", "op", op, "path", src, "dest", dest)
+	return nil
+}
+
+// destFor returns the destination of a path relative to a watched root.
+// With several watched paths each is mirrored under its base name, which
+// newMirror checks to be unique.
+func (m *mirror) destFor(root, rel string) string {
+	if len(m.fw.paths) == 1 {
+		return filepath.Join(m.cfg.Dest, rel)
+	}
+	return filepath.Join(m.cfg.Dest, filepath.Base(root), rel)
+}
+
+// isFileRoot reports whether a watched root is a single file
+func (fw *FileWatcher) isFileRoot(root string) bool {
+	info, err := os.Stat(root)
+	return err == nil && !info.IsDir()
+}
+
+// relTo returns path relative to a watched root. Single file roots are
+// relative to their directory so that the file keeps its name.
+func relTo(root string, fileRoot bool, path string) string {
+	base := root
+	if fileRoot {
+		base = filepath.Dir(root)
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return rel
+}
+
+// isWithin reports whether path is inside dir
+func isWithin(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
@@ -0,0 +1,152 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-hclog"
+)
+
+func newTestMirror(t *testing.T, paths []string, cfg SyncConfig) (*FileWatcher, *mirror) {
+	t.Helper()
+
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), paths, nil, "", nil, nil, nil, true, WithSync(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+	return fw, fw.actions[len(fw.actions)-1].(*mirror)
+}
+
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMirrorHandle(t *testing.T) {
+	src, dest := t.TempDir(), filepath.Join(t.TempDir(), "mirror")
+	fw, m := newTestMirror(t, []string{src}, SyncConfig{Dest: dest})
+
+	path := filepath.Join(src, "sub", "report.csv")
+	writeTestFile(t, path, "a,b\n")
+	if err := m.Handle(fw.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Create})); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(dest, "sub", "report.csv")); got != "a,b\n" {
+		t.Fatalf("unexpected mirrored content %q", got)
+	}
+
+	os.Remove(path)
+	if err := m.Handle(fw.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Remove})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "sub", "report.csv")); !os.IsNotExist(err) {
+		t.Fatalf("expected the mirrored file to be removed, got %v", err)
+	}
+}
+
+func TestMirrorSeveralPaths(t *testing.T) {
+	base, dest := t.TempDir(), filepath.Join(t.TempDir(), "mirror")
+	logs, data := filepath.Join(base, "logs"), filepath.Join(base, "data")
+	writeTestFile(t, filepath.Join(logs, "app.log"), "log")
+	writeTestFile(t, filepath.Join(data, "app.log"), "data")
+
+	_, m := newTestMirror(t, []string{logs, data}, SyncConfig{Dest: dest})
+	m.sweep("initial")
+
+	if got := readTestFile(t, filepath.Join(dest, "logs", "app.log")); got != "log" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if got := readTestFile(t, filepath.Join(dest, "data", "app.log")); got != "data" {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestMirrorRejectsDuplicateNames(t *testing.T) {
+	base := t.TempDir()
+	paths := []string{filepath.Join(base, "a", "logs"), filepath.Join(base, "b", "logs")}
+
+	_, err := NewFileWatcher(hclog.NewNullLogger(), paths, nil, "", nil, nil, nil, true,
+		WithSync(SyncConfig{Dest: filepath.Join(base, "mirror")}))
+	if err == nil || !strings.Contains(err.Error(), "both would be mirrored to") {
+		t.Fatalf("expected the paths to be rejected, got %v", err)
+	}
+}
+
+func TestMirrorSweepRepairsDest(t *testing.T) {
+	src, dest := t.TempDir(), filepath.Join(t.TempDir(), "mirror")
+	writeTestFile(t, filepath.Join(src, "keep"), "keep")
+	writeTestFile(t, filepath.Join(dest, "stale"), "stale")
+
+	_, m := newTestMirror(t, []string{src}, SyncConfig{Dest: dest})
+	m.sweep("verify")
+
+	if got := readTestFile(t, filepath.Join(dest, "keep")); got != "keep" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "stale")); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale file to be removed, got %v", err)
+	}
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	src, dest := t.TempDir(), filepath.Join(t.TempDir(), "mirror")
+	writeTestFile(t, filepath.Join(src, "file"), "data")
+
+	_, m := newTestMirror(t, []string{src}, SyncConfig{Dest: dest, DryRun: true})
+	m.sweep("initial")
+
+	if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+		t.Fatalf("expected a dry run not to create the destination, got %v", err)
+	}
+}
+
+func TestMirrorEventsAndSweepsDoNotRace(t *testing.T) {
+	src, dest := t.TempDir(), filepath.Join(t.TempDir(), "mirror")
+	fw, m := newTestMirror(t, []string{src}, SyncConfig{Dest: dest})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			m.sweep("verify")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		path := filepath.Join(src, "file")
+		for i := 0; i < 20; i++ {
+			os.WriteFile(path, []byte("data"), 0644)
+			m.Handle(fw.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Create}))
+			os.Remove(path)
+			m.Handle(fw.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Remove}))
+		}
+	}()
+	wg.Wait()
+
+	// The last event removed the file, no sweep may have brought it back
+	if _, err := os.Lstat(filepath.Join(dest, "file")); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be removed, got %v", err)
+	}
+}
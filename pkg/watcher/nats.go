@@ -0,0 +1,123 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSConfig describes the NATS server events are published to
+type NATSConfig struct {
+	URL        string // Server URLs, comma separated
+	JetStream  bool   // Publish to a JetStream stream and wait for its acknowledgement
+	Stream     string // Stream expected to store the messages, optional
+	CredsFile  string // Credentials file of the user
+	Token      string // Authentication token
+	CACert     string // PEM file of the CA verifying the server
+	ClientCert string // PEM file of the client certificate
+	ClientKey  string // PEM file of the client key
+	Name       string // Connection name shown by the server
+}
+
+// Validate reports whether the NATS configuration is usable
+func (c NATSConfig) Validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("nats url must be specified")
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return fmt.Errorf("invalid nats url: %v", err)
+	}
+	if c.Stream != "" && !c.JetStream {
+		return fmt.Errorf("nats stream requires jetstream")
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return fmt.Errorf("nats client cert and client key must be set together")
+	}
+	return nil
+}
+
+type natsPublisher struct {
+	cfg NATSConfig
+	nc  *nats.Conn
+	js  jetstream.JetStream
+}
+
+// NewNATSPublisher connects to NATS. The connection is established in the
+// background when the server is unavailable.
+func NewNATSPublisher(cfg NATSConfig) (Publisher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	opts := []nats.Option{
+		nats.Name(cfg.Name),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		// Publishing fails while disconnected instead of buffering the
+		// messages in memory, so that they are spooled
+		nats.ReconnectBufSize(-1),
+	}
+	if cfg.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.CredsFile))
+	}
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+	if cfg.CACert != "" {
+		opts = append(opts, nats.RootCAs(cfg.CACert))
+	}
+	if cfg.ClientCert != "" {
+		opts = append(opts, nats.ClientCert(cfg.ClientCert, cfg.ClientKey))
+	}
+
+	nc, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+
+	p := &natsPublisher{cfg: cfg, nc: nc}
+	if cfg.JetStream {
+		if p.js, err = jetstream.New(nc); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("failed to create jetstream context: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// Publish publishes data. Core NATS messages are flushed to the server,
+// JetStream messages are acknowledged by the stream and deduplicated by
+// msgID.
+func (p *natsPublisher) Publish(ctx context.Context, subject, msgID string, data []byte) error {
+	if !p.nc.IsConnected() {
+		return fmt.Errorf("not connected to nats: %s", p.nc.Status())
+	}
+
+	if p.js == nil {
+		msg := &nats.Msg{Subject: subject, Data: data, Header: nats.Header{}}
+		msg.Header.Set(nats.MsgIdHdr, msgID)
+		if err := p.nc.PublishMsg(msg); err != nil {
+			return err
+		}
+		return p.nc.FlushWithContext(ctx)
+	}
+
+	opts := []jetstream.PublishOpt{jetstream.WithMsgID(msgID)}
+	if p.cfg.Stream != "" {
+		opts = append(opts, jetstream.WithExpectStream(p.cfg.Stream))
+	}
+	_, err := p.js.Publish(ctx, subject, data, opts...)
+	return err
+}
+
+// Close drains the connection, or closes it when it is down
+func (p *natsPublisher) Close() error {
+	if !p.nc.IsConnected() {
+		p.nc.Close()
+		return nil
+	}
+	return p.nc.Drain()
+}
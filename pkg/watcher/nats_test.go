@@ -0,0 +1,196 @@
+package watcher
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// runNATSServer starts a JetStream enabled server, on port when it is not 0
+func runNATSServer(t *testing.T, port int, storeDir string) *server.Server {
+	t.Helper()
+
+	opts := natstest.DefaultTestOptions
+	opts.Port = -1
+	if port != 0 {
+		opts.Port = port
+	}
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+
+	s := natstest.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newTestNATS(t *testing.T, cfg NATSConfig) *natsPublisher {
+	t.Helper()
+
+	publisher, err := NewNATSPublisher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+	return publisher.(*natsPublisher)
+}
+
+// newTestStream creates the FILES stream storing files.> on the server
+func newTestStream(t *testing.T, s *server.Server) jetstream.Stream {
+	t.Helper()
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := js.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:     "FILES",
+		Subjects: []string{"files.>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func streamMessages(t *testing.T, stream jetstream.Stream) uint64 {
+	t.Helper()
+
+	info, err := stream.Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.State.Msgs
+}
+
+func TestNATSCorePublish(t *testing.T) {
+	s := runNATSServer(t, 0, t.TempDir())
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("files.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.Flush()
+
+	// Flushes require a deadline, which publishAction always sets
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	publisher := newTestNATS(t, NATSConfig{URL: s.ClientURL()})
+	if err := publisher.Publish(ctx, "files.create", "msg-1", []byte(`{"path":"/data/1"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != `{"path":"/data/1"}` || msg.Header.Get(nats.MsgIdHdr) != "msg-1" {
+		t.Fatalf("unexpected message %q with headers %v", msg.Data, msg.Header)
+	}
+}
+
+func TestNATSJetStreamDeduplicates(t *testing.T) {
+	s := runNATSServer(t, 0, t.TempDir())
+	stream := newTestStream(t, s)
+
+	publisher := newTestNATS(t, NATSConfig{URL: s.ClientURL(), JetStream: true, Stream: "FILES"})
+	for i := 0; i < 2; i++ {
+		if err := publisher.Publish(context.Background(), "files.create", "msg-1", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publisher.Publish(context.Background(), "files.create", "msg-2", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := streamMessages(t, stream); n != 2 {
+		t.Fatalf("expected the repeated message to be stored once, got %d messages", n)
+	}
+}
+
+func TestNATSJetStreamExpectStream(t *testing.T) {
+	s := runNATSServer(t, 0, t.TempDir())
+	stream := newTestStream(t, s)
+
+	publisher := newTestNATS(t, NATSConfig{URL: s.ClientURL(), JetStream: true, Stream: "OTHER"})
+	if err := publisher.Publish(context.Background(), "files.create", "msg-1", []byte("{}")); err == nil {
+		t.Fatal("expected the publish to be rejected by another stream")
+	}
+	if n := streamMessages(t, stream); n != 0 {
+		t.Fatalf("expected no stored messages, got %d", n)
+	}
+}
+
+func TestNATSSpoolReplay(t *testing.T) {
+	storeDir := t.TempDir()
+	s := runNATSServer(t, 0, storeDir)
+	port := s.Addr().(*net.TCPAddr).Port
+	newTestStream(t, s)
+
+	publisher := newTestNATS(t, NATSConfig{URL: s.ClientURL(), JetStream: true, Stream: "FILES"})
+	fw := newTestWatcher(t)
+	p, err := newPublishAction(fw, "nats", publisher, PublishConfig{
+		Subject:   "files.{{ .Op }}",
+		SpoolFile: filepath.Join(t.TempDir(), "spool.jsonl"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Without a reconnect buffer publishing fails while disconnected
+	s.Shutdown()
+	waitFor(t, 5*time.Second, func() bool { return !publisher.nc.IsConnected() })
+	for i := 1; i <= 3; i++ {
+		if err := p.Handle(publishEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := spooledCount(p); n != 3 {
+		t.Fatalf("expected 3 spooled events, got %d", n)
+	}
+
+	s = runNATSServer(t, port, storeDir)
+	waitFor(t, 10*time.Second, publisher.nc.IsConnected)
+
+	p.retry()
+	waitFor(t, 10*time.Second, func() bool { return spooledCount(p) == 0 })
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := js.Stream(context.Background(), "FILES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := streamMessages(t, stream); n != 3 {
+		t.Fatalf("expected the 3 spooled events to be stored, got %d", n)
+	}
+}
@@ -0,0 +1,302 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	NomadDispatch = "dispatch" // Dispatch a parameterized job
+	NomadRestart  = "restart"  // Restart a task of the allocation
+	NomadSignal   = "signal"   // Signal a task of the allocation
+
+	defaultNomadAddress = "http://127.0.0.1:4646"
+	nomadRequestTimeout = 10 * time.Second
+
+	// maxDispatchPayload is the payload size limit enforced by Nomad
+	maxDispatchPayload = 16 * 1024
+)
+
+// NomadActionConfig describes a call to the Nomad HTTP API made for every
+// event. The address, token, namespace, region and TLS settings are read
+// from the usual NOMAD_* variables of the task, falling back to the
+// environment of the Nomad client.
+type NomadActionConfig struct {
+	Action  string            // dispatch, restart or signal
+	Job     string            // Parameterized job to dispatch
+	Meta    map[string]string // Dispatch meta, values are templates
+	Payload bool              // Send the event JSON as the dispatch payload
+	Task    string            // Task of the allocation to restart or signal
+	Signal  string            // Signal to send, e.g. SIGHUP
+}
+
+// Validate reports whether the Nomad action is usable
+func (c NomadActionConfig) Validate() error {
+	switch c.Action {
+	case NomadDispatch:
+		if c.Job == "" {
+			return fmt.Errorf("nomad_dispatch job must be specified")
+		}
+		for key, value := range c.Meta {
+			if err := ValidateTemplate(value); err != nil {
+				return fmt.Errorf("invalid nomad_dispatch meta %s: %v", key, err)
+			}
+		}
+	case NomadRestart:
+		if c.Task == "" {
+			return fmt.Errorf("nomad_restart task must be specified")
+		}
+	case NomadSignal:
+		if c.Task == "" {
+			return fmt.Errorf("nomad_signal task must be specified")
+		}
+		if c.Signal == "" {
+			return fmt.Errorf("nomad_signal signal must be specified")
+		}
+	default:
+		return fmt.Errorf("invalid nomad action: %s", c.Action)
+	}
+	return nil
+}
+
+type nomadAction struct {
+	fw   *FileWatcher
+	cfg  NomadActionConfig
+	meta map[string]*template.Template
+
+	// The client is built on first use as the task environment is not
+	// known while options are applied
+	once    sync.Once
+	client  *http.Client
+	address string
+	err     error
+}
+
+func newNomadAction(fw *FileWatcher, cfg NomadActionConfig) (*nomadAction, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	a := &nomadAction{
+		fw:   fw,
+		cfg:  cfg,
+		meta: make(map[string]*template.Template, len(cfg.Meta)),
+	}
+	for key, value := range cfg.Meta {
+		tmpl, err := parseTemplate("nomad_dispatch.meta."+key, value)
+		if err != nil {
+			return nil, err
+		}
+		a.meta[key] = tmpl
+	}
+	return a, nil
+}
+
+// Handle calls the Nomad API for event
+func (a *nomadAction) Handle(event *Event) error {
+	var err error
+	switch a.cfg.Action {
+	case NomadDispatch:
+		err = a.dispatch(event)
+	case NomadRestart:
+		err = a.allocRequest(event, http.MethodPut, "restart", map[string]interface{}{
+			"TaskName": a.cfg.Task,
+		})
+	case NomadSignal:
+		err = a.allocRequest(event, http.MethodPost, "signal", map[string]interface{}{
+			"Task":   a.cfg.Task,
+			"Signal": a.cfg.Signal,
+		})
+	}
+	if err != nil {
+		a.fw.emitTaskEvent(fmt.Sprintf("Nomad %s failed", a.cfg.Action), map[string]string{
+			"path":  event.Path,
+			"error": err.Error(),
+		})
+	}
+	return err
+}
+
+// Close implements Action
+func (a *nomadAction) Close() error {
+	return nil
+}
+
+func (a *nomadAction) dispatch(event *Event) error {
+	data := event.templateData()
+	meta := make(map[string]string, len(a.meta))
+	for key, tmpl := range a.meta {
+		value, err := execute(tmpl, data)
+		if err != nil {
+			return err
+		}
+		meta[key] = value
+	}
+
+	req := map[string]interface{}{"Meta": meta}
+	if a.cfg.Payload {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if len(payload) > maxDispatchPayload {
+			return fmt.Errorf("event payload of %d bytes exceeds the dispatch limit of %d bytes", len(payload), maxDispatchPayload)
+		}
+		req["Payload"] = payload
+	}
+
+	var resp struct {
+		DispatchedJobID string
+		EvalID          string
+	}
+	path := "/v1/job/" + url.PathEscape(a.cfg.Job) + "/dispatch"
+	if err := a.do(http.MethodPost, path, req, &resp); err != nil {
+		return fmt.Errorf("failed to dispatch job %s: %v", a.cfg.Job, err)
+	}
+
+	a.fw.eventLog().Info("nomad job dispatched",
+		"path", event.Path,
+		"job", a.cfg.Job,
+		"dispatched_job_id", resp.DispatchedJobID,
+		"eval_id", resp.EvalID,
+	)
+	return nil
+}
+
+// allocRequest calls an endpoint of the allocation running the watcher
+func (a *nomadAction) allocRequest(event *Event, method, endpoint string, body interface{}) error {
+	if a.fw.allocID == "" {
+		return fmt.Errorf("nomad_%s requires the allocation ID", a.cfg.Action)
+	}
+
+	path := "/v1/client/allocation/" + url.PathEscape(a.fw.allocID) + "/" + endpoint
+	if err := a.do(method, path, body, nil); err != nil {
+		return fmt.Errorf("failed to %s task %s: %v", a.cfg.Action, a.cfg.Task, err)
+	}
+
+	args := []interface{}{"path", event.Path, "task", a.cfg.Task}
+	if a.cfg.Signal != "" {
+		args = append(args, "signal", a.cfg.Signal)
+	}
+	a.fw.eventLog().Info("nomad task "+endpoint+" requested", args...)
+	return nil
+}
+
+// do sends a request to the Nomad API and decodes the response into out
+func (a *nomadAction) do(method, path string, body, out interface{}) error {
+	a.once.Do(a.setup)
+	if a.err != nil {
+		return a.err
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(a.address + path)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	if ns := a.env("NOMAD_NAMESPACE"); ns != "" {
+		query.Set("namespace", ns)
+	}
+	if region := a.env("NOMAD_REGION"); region != "" {
+		query.Set("region", region)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := a.env("NOMAD_TOKEN"); token != "" {
+		req.Header.Set("X-Nomad-Token", token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		if isTimeout(err) {
+			a.fw.metrics.Timeout("nomad_" + a.cfg.Action)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("invalid response: %v", err)
+		}
+	}
+	return nil
+}
+
+// setup builds the HTTP client from the NOMAD_* variables
+func (a *nomadAction) setup() {
+	address := a.env("NOMAD_ADDR")
+	if address == "" {
+		address = defaultNomadAddress
+	}
+
+	tlsConfig, err := WebhookTLSConfig{
+		CACert:     a.env("NOMAD_CACERT"),
+		ClientCert: a.env("NOMAD_CLIENT_CERT"),
+		ClientKey:  a.env("NOMAD_CLIENT_KEY"),
+		ServerName: a.env("NOMAD_TLS_SERVER_NAME"),
+	}.config()
+	if err != nil {
+		a.err = err
+		return
+	}
+	if skip, _ := strconv.ParseBool(a.env("NOMAD_SKIP_VERIFY")); skip {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	// unix:// addresses reach the agent over a socket, such as the task API
+	if socket, ok := strings.CutPrefix(address, "unix://"); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		address = "http://localhost"
+	}
+
+	a.address = strings.TrimSuffix(address, "/")
+	a.client = &http.Client{
+		Transport: transport,
+		Timeout:   nomadRequestTimeout,
+	}
+}
+
+// env looks a variable up in the task environment, then in the environment
+// of the Nomad client
+func (a *nomadAction) env(name string) string {
+	if value, ok := a.fw.lookupEnv(name); ok {
+		return value
+	}
+	return os.Getenv(name)
+}
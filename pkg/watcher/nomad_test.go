@@ -0,0 +1,300 @@
+package watcher
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// nomadRequest is a request received by the fake Nomad API
+type nomadRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Token  string
+	Body   map[string]interface{}
+}
+
+// fakeNomad records the API requests and answers them with status and body
+type fakeNomad struct {
+	lock     sync.Mutex
+	requests []nomadRequest
+	status   int
+	body     string
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	var body map[string]interface{}
+	json.Unmarshal(data, &body)
+
+	f.lock.Lock()
+	f.requests = append(f.requests, nomadRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Token:  r.Header.Get("X-Nomad-Token"),
+		Body:   body,
+	})
+	status, resp := f.status, f.body
+	f.lock.Unlock()
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if resp == "" {
+		resp = "{}"
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, resp)
+}
+
+func (f *fakeNomad) received() []nomadRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]nomadRequest{}, f.requests...)
+}
+
+// newFakeNomad serves a fake Nomad API and points NOMAD_ADDR at it
+func newFakeNomad(t *testing.T) *fakeNomad {
+	f := &fakeNomad{}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	t.Setenv("NOMAD_ADDR", server.URL)
+	t.Setenv("NOMAD_TOKEN", "")
+	t.Setenv("NOMAD_NAMESPACE", "")
+	t.Setenv("NOMAD_REGION", "")
+	return f
+}
+
+func TestNomadDispatch(t *testing.T) {
+	nomad := newFakeNomad(t)
+	nomad.body = `{"DispatchedJobID": "ingest/dispatch-1", "EvalID": "eval-1"}`
+	t.Setenv("NOMAD_TOKEN", "secret")
+	t.Setenv("NOMAD_NAMESPACE", "batch")
+	fw := newTestWatcher(t)
+
+	a, err := newNomadAction(fw, NomadActionConfig{
+		Action:  NomadDispatch,
+		Job:     "ingest",
+		Meta:    map[string]string{"file": "{{ .Base }}", "op": "{{ .Op }}"},
+		Payload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := testEvent("/data/in/report.csv")
+	if err := a.Handle(event); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := nomad.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	req := requests[0]
+	if req.Method != http.MethodPost || req.Path != "/v1/job/ingest/dispatch" {
+		t.Fatalf("unexpected request %s %s", req.Method, req.Path)
+	}
+	if req.Token != "secret" || req.Query != "namespace=batch" {
+		t.Fatalf("expected the token and namespace of the environment, got %q and %q", req.Token, req.Query)
+	}
+
+	meta, _ := req.Body["Meta"].(map[string]interface{})
+	if meta["file"] != "report.csv" || meta["op"] != "create" {
+		t.Fatalf("unexpected meta: %v", req.Body["Meta"])
+	}
+
+	// Payloads are base64 encoded byte slices
+	payload, _ := req.Body["Payload"].(string)
+	if payload == "" {
+		t.Fatal("expected a payload")
+	}
+	var data []byte
+	json.Unmarshal([]byte(`"`+payload+`"`), &data)
+	var sent Event
+	if err := json.Unmarshal(data, &sent); err != nil || sent.Path != event.Path {
+		t.Fatalf("expected the event as payload, got %q: %v", data, err)
+	}
+}
+
+func TestNomadDispatchPayloadLimit(t *testing.T) {
+	nomad := newFakeNomad(t)
+	events := &taskEvents{}
+	fw := newTestWatcher(t, WithTaskEvents(events.emit))
+
+	a, err := newNomadAction(fw, NomadActionConfig{
+		Action:  NomadDispatch,
+		Job:     "ingest",
+		Payload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Just below the limit
+	event := testEvent("/")
+	size := len(event.String())
+	event.Path = "/" + strings.Repeat("a", maxDispatchPayload-size)
+	if err := a.Handle(event); err != nil {
+		t.Fatalf("expected a payload of %d bytes to be accepted: %v", len(event.String()), err)
+	}
+
+	event.Path += "a"
+	err = a.Handle(event)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the dispatch limit") {
+		t.Fatalf("expected the payload limit error, got %v", err)
+	}
+	if n := len(nomad.received()); n != 1 {
+		t.Fatalf("expected the oversized payload not to be sent, got %d requests", n)
+	}
+	if got := events.list(); len(got) != 1 || got[0] != "Nomad dispatch failed" {
+		t.Fatalf("expected a dispatch failed task event, got %q", got)
+	}
+}
+
+func TestNomadRestart(t *testing.T) {
+	nomad := newFakeNomad(t)
+	fw := newTestWatcher(t, WithTaskInfo("web", "alloc-1"))
+
+	a, err := newNomadAction(fw, NomadActionConfig{
+		Action: NomadRestart,
+		Task:   "web",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Handle(testEvent("/local/config.yml")); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := nomad.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	req := requests[0]
+	if req.Method != http.MethodPut || req.Path != "/v1/client/allocation/alloc-1/restart" {
+		t.Fatalf("unexpected request %s %s", req.Method, req.Path)
+	}
+	if req.Body["TaskName"] != "web" {
+		t.Fatalf("unexpected body: %v", req.Body)
+	}
+}
+
+func TestNomadSignal(t *testing.T) {
+	nomad := newFakeNomad(t)
+	fw := newTestWatcher(t, WithTaskInfo("web", "alloc-1"))
+
+	a, err := newNomadAction(fw, NomadActionConfig{
+		Action: NomadSignal,
+		Task:   "proxy",
+		Signal: "SIGHUP",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Handle(testEvent("/local/config.yml")); err != nil {
+		t.Fatal(err)
+	}
+
+	req := nomad.received()[0]
+	if req.Method != http.MethodPost || req.Path != "/v1/client/allocation/alloc-1/signal" {
+		t.Fatalf("unexpected request %s %s", req.Method, req.Path)
+	}
+	if req.Body["Task"] != "proxy" || req.Body["Signal"] != "SIGHUP" {
+		t.Fatalf("unexpected body: %v", req.Body)
+	}
+}
+
+func TestNomadErrorStatus(t *testing.T) {
+	nomad := newFakeNomad(t)
+	nomad.status = http.StatusForbidden
+	nomad.body = "Permission denied\n"
+	events := &taskEvents{}
+	fw := newTestWatcher(t, WithTaskInfo("web", "alloc-1"), WithTaskEvents(events.emit))
+
+	a, err := newNomadAction(fw, NomadActionConfig{
+		Action: NomadSignal,
+		Task:   "proxy",
+		Signal: "SIGHUP",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.Handle(testEvent("/local/config.yml"))
+	if err == nil || !strings.Contains(err.Error(), "unexpected status 403: Permission denied") {
+		t.Fatalf("expected the status and response in the error, got %v", err)
+	}
+	if got := events.list(); len(got) != 1 || got[0] != "Nomad signal failed" {
+		t.Fatalf("expected a signal failed task event, got %q", got)
+	}
+}
+
+func TestNomadAllocRequestRequiresAllocID(t *testing.T) {
+	nomad := newFakeNomad(t)
+	fw := newTestWatcher(t)
+
+	a, err := newNomadAction(fw, NomadActionConfig{
+		Action: NomadRestart,
+		Task:   "web",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Handle(testEvent("/local/config.yml")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := len(nomad.received()); n != 0 {
+		t.Fatalf("expected no requests, got %d", n)
+	}
+}
+
+func TestNomadUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "nomad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+
+	nomad := &fakeNomad{}
+	server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: nomad}}
+	server.Start()
+	defer server.Close()
+
+	t.Setenv("NOMAD_ADDR", "unix://"+socket)
+	fw := newTestWatcher(t, WithTaskInfo("web", "alloc-1"))
+
+	a, err := newNomadAction(fw, NomadActionConfig{
+		Action: NomadRestart,
+		Task:   "web",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Handle(testEvent("/local/config.yml")); err != nil {
+		t.Fatal(err)
+	}
+	if requests := nomad.received(); len(requests) != 1 || requests[0].Path != "/v1/client/allocation/alloc-1/restart" {
+		t.Fatalf("unexpected requests: %+v", requests)
+	}
+}
@@ -0,0 +1,259 @@
+package watcher
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option configures optional FileWatcher behaviour
+type Option func(*FileWatcher) error
+
+// WithContentHash enables suppression of modify and chmod events that
+// changed neither the content nor the permissions of a file
+func WithContentHash(cfg ContentHashConfig) Option {
+	return func(fw *FileWatcher) error {
+		fw.hashes = newHashCache(cfg)
+		return nil
+	}
+}
+
+// WithTail enables log-tail mode, passing only newly appended lines to the
+// command on stdin
+func WithTail(cfg TailConfig) Option {
+	return func(fw *FileWatcher) error {
+		fw.tail = newTailer(cfg)
+		return nil
+	}
+}
+
+// WithMatch restricts tail mode to records matching one of the configured
+// patterns
+func WithMatch(cfg MatchConfig) Option {
+	return func(fw *FileWatcher) error {
+		m, err := newMatcher(cfg)
+		if err != nil {
+			return err
+		}
+		m.expired = fw.flushRecord
+		fw.match = m
+		return nil
+	}
+}
+
+// WithFollowSymlinks watches symlinked paths together with their targets and
+// descends into symlinked directories of recursive watches
+func WithFollowSymlinks() Option {
+	return func(fw *FileWatcher) error {
+		fw.followSymlinks = true
+		return nil
+	}
+}
+
+// WithWorkingDir sets the working directory template of the command
+func WithWorkingDir(dir string) Option {
+	return func(fw *FileWatcher) error {
+		fw.workingDir = dir
+		return nil
+	}
+}
+
+// WithStdin selects what is written to the command's stdin
+func WithStdin(mode string) Option {
+	return func(fw *FileWatcher) error {
+		if !IsValidStdin(mode) {
+			return fmt.Errorf("invalid stdin mode: %s", mode)
+		}
+		fw.stdin = mode
+		return nil
+	}
+}
+
+// WithTaskInfo sets the task and allocation IDs reported in events
+func WithTaskInfo(taskID, allocID string) Option {
+	return func(fw *FileWatcher) error {
+		fw.taskID = taskID
+		fw.allocID = allocID
+		return nil
+	}
+}
+
+// WithOutput streams command output to the given writers, typically the
+// task's stdout and stderr log FIFOs
+func WithOutput(cfg OutputConfig) Option {
+	return func(fw *FileWatcher) error {
+		if cfg.Stdout == nil {
+			return fmt.Errorf("stdout writer must be specified")
+		}
+		fw.output = newTaskOutput(cfg)
+		return nil
+	}
+}
+
+// WithExec runs commands with the given user, environment and working
+// directory instead of inheriting those of the plugin
+func WithExec(cfg ExecConfig) Option {
+	return func(fw *FileWatcher) error {
+		ec, err := newExecContext(cfg)
+		if err != nil {
+			return err
+		}
+		fw.exec = ec
+		return nil
+	}
+}
+
+// WithService supervises a long-running process that is restarted or
+// reloaded on events instead of running the command per event
+func WithService(cfg ServiceConfig) Option {
+	return func(fw *FileWatcher) error {
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+		fw.service = newService(fw, cfg)
+		return nil
+	}
+}
+
+// WithConcurrency sets the policy for events of a path arriving while its
+// previous command is still running
+func WithConcurrency(policy string) Option {
+	return func(fw *FileWatcher) error {
+		if !IsValidConcurrency(policy) {
+			return fmt.Errorf("invalid concurrency policy: %s", policy)
+		}
+		if policy == "" {
+			policy = ConcurrencyQueue
+		}
+		fw.concurrency = policy
+		return nil
+	}
+}
+
+// WithTimeout kills the process group of commands running longer than d.
+// The default of 0 lets them run until they exit.
+func WithTimeout(d time.Duration) Option {
+	return func(fw *FileWatcher) error {
+		if d < 0 {
+			return fmt.Errorf("timeout must be non-negative")
+		}
+		fw.timeout = d
+		return nil
+	}
+}
+
+// WithMaxConcurrent limits the commands running at once across all paths.
+// The default of 0 does not limit them, 1 runs them one after another.
+func WithMaxConcurrent(n int) Option {
+	return func(fw *FileWatcher) error {
+		if n < 0 {
+			return fmt.Errorf("max concurrent must be non-negative")
+		}
+		fw.maxConcurrent = n
+		return nil
+	}
+}
+
+// WithWebhook sends the event documents to an HTTP endpoint
+func WithWebhook(cfg WebhookConfig) Option {
+	return func(fw *FileWatcher) error {
+		w, err := newWebhook(fw, cfg)
+		if err != nil {
+			return err
+		}
+		fw.actions = append(fw.actions, w)
+		return nil
+	}
+}
+
+// WithTaskEvents records action results as task events through fn
+func WithTaskEvents(fn TaskEventFunc) Option {
+	return func(fw *FileWatcher) error {
+		fw.taskEvents = fn
+		return nil
+	}
+}
+
+// WithFileOps runs a pipeline of built-in file operations per event
+func WithFileOps(cfg FileOpsConfig) Option {
+	return func(fw *FileWatcher) error {
+		ops, err := newFileOps(fw, cfg)
+		if err != nil {
+			return err
+		}
+		fw.actions = append(fw.actions, ops)
+		return nil
+	}
+}
+
+// WithSync mirrors the watched paths into a destination directory
+func WithSync(cfg SyncConfig) Option {
+	return func(fw *FileWatcher) error {
+		m, err := newMirror(fw, cfg)
+		if err != nil {
+			return err
+		}
+		fw.actions = append(fw.actions, m)
+		return nil
+	}
+}
+
+// WithSink streams the event documents as JSON lines to a file, socket or
+// named pipe
+func WithSink(cfg SinkConfig) Option {
+	return func(fw *FileWatcher) error {
+		s, err := newSink(fw, cfg)
+		if err != nil {
+			return err
+		}
+		fw.sink = s
+		return nil
+	}
+}
+
+// WithSyslog writes the events to syslog or journald
+func WithSyslog(cfg SyslogConfig) Option {
+	return func(fw *FileWatcher) error {
+		s, err := newSyslogWriter(fw, cfg)
+		if err != nil {
+			return err
+		}
+		fw.actions = append(fw.actions, s)
+		return nil
+	}
+}
+
+// WithNomadAction calls the Nomad API for every event
+func WithNomadAction(cfg NomadActionConfig) Option {
+	return func(fw *FileWatcher) error {
+		a, err := newNomadAction(fw, cfg)
+		if err != nil {
+			return err
+		}
+		fw.actions = append(fw.actions, a)
+		return nil
+	}
+}
+
+// WithPublisher publishes the events to a message bus. name identifies the
+// publisher in logs and task events.
+func WithPublisher(name string, publisher Publisher, cfg PublishConfig) Option {
+	return func(fw *FileWatcher) error {
+		p, err := newPublishAction(fw, name, publisher, cfg)
+		if err != nil {
+			return err
+		}
+		fw.actions = append(fw.actions, p)
+		return nil
+	}
+}
+
+// WithMetrics reports the event, command and delivery measurements to m
+func WithMetrics(m Metrics) Option {
+	return func(fw *FileWatcher) error {
+		if m == nil {
+			return fmt.Errorf("metrics must not be nil")
+		}
+		fw.metrics = m
+		return nil
+	}
+}
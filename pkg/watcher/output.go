@@ -0,0 +1,119 @@
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// OutputConfig routes command output to the task's log streams instead of
+// the plugin log
+type OutputConfig struct {
+	Stdout        io.Writer // Receives command stdout and structured event lines
+	Stderr        io.Writer // Receives command stderr
+	PrefixEventID bool      // Prefix every output line with the event sequence number
+}
+
+type taskOutput struct {
+	stdout *syncWriter
+	stderr *syncWriter
+	prefix bool
+	events hclog.Logger
+}
+
+func newTaskOutput(cfg OutputConfig) *taskOutput {
+	stdout := &syncWriter{w: cfg.Stdout}
+	stderr := stdout
+	if cfg.Stderr != nil {
+		stderr = &syncWriter{w: cfg.Stderr}
+	}
+
+	return &taskOutput{
+		stdout: stdout,
+		stderr: stderr,
+		prefix: cfg.PrefixEventID,
+		events: hclog.New(&hclog.LoggerOptions{
+			Name:       "filewatcher",
+			Output:     stdout,
+			JSONFormat: true,
+			Level:      hclog.Info,
+		}),
+	}
+}
+
+// writers returns the stdout and stderr writers of a command run for event
+func (o *taskOutput) writers(event *Event) (*lineWriter, *lineWriter) {
+	var prefix []byte
+	if o.prefix {
+		prefix = []byte(fmt.Sprintf("[event %d] ", event.Sequence))
+	}
+	return &lineWriter{w: o.stdout, prefix: prefix}, &lineWriter{w: o.stderr, prefix: prefix}
+}
+
+// syncWriter serializes writes of concurrent commands
+type syncWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.w.Write(p)
+}
+
+// maxOutputLine bounds the buffered partial line of a command. Longer lines
+// are written in pieces.
+const maxOutputLine = 64 * 1024
+
+// lineWriter writes complete lines so that output of concurrent commands is
+// interleaved line by line rather than mid-line
+type lineWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := l.writeLine(l.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		l.buf = l.buf[i+1:]
+	}
+	for len(l.buf) >= maxOutputLine {
+		if err := l.writeLine(append(l.buf[:maxOutputLine:maxOutputLine], '\n')); err != nil {
+			return 0, err
+		}
+		l.buf = l.buf[maxOutputLine:]
+	}
+	return len(p), nil
+}
+
+// Flush writes a trailing partial line
+func (l *lineWriter) Flush() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	line := append(l.buf, '\n')
+	l.buf = nil
+	return l.writeLine(line)
+}
+
+func (l *lineWriter) writeLine(line []byte) error {
+	if len(l.prefix) == 0 {
+		_, err := l.w.Write(line)
+		return err
+	}
+	_, err := l.w.Write(append(append([]byte{}, l.prefix...), line...))
+	return err
+}
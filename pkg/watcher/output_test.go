@@ -0,0 +1,41 @@
+package watcher
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLineWriterWritesCompleteLines(t *testing.T) {
+	var out bytes.Buffer
+	w := &lineWriter{w: &out, prefix: []byte("[event 1] ")}
+
+	w.Write([]byte("one\ntw"))
+	if got := out.String(); got != "[event 1] one\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+
+	w.Write([]byte("o\nthree"))
+	w.Flush()
+	if got := out.String(); got != "[event 1] one\n[event 1] two\n[event 1] three\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
+
+func TestLineWriterBoundsPartialLine(t *testing.T) {
+	var out bytes.Buffer
+	w := &lineWriter{w: &out}
+
+	chunk := []byte(strings.Repeat("x", 1024))
+	for i := 0; i < 3*maxOutputLine/len(chunk); i++ {
+		w.Write(chunk)
+		if len(w.buf) >= maxOutputLine {
+			t.Fatalf("buffered %d bytes", len(w.buf))
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3 || len(lines[0]) != maxOutputLine {
+		t.Fatalf("expected 3 lines of %d bytes, got %d", maxOutputLine, len(lines))
+	}
+}
@@ -0,0 +1,489 @@
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// Interval at which spooled events are retried
+	spoolRetryInterval = 5 * time.Second
+
+	// Timeout of a single publish, including the broker acknowledgement
+	publishTimeout = 10 * time.Second
+
+	defaultSpoolLimit = 100 * 1024 * 1024
+
+	// Spooled events sent per round trip by a BatchPublisher
+	publishBatchSize = 100
+)
+
+// Publisher delivers event documents to a message bus
+type Publisher interface {
+	// Publish sends data to subject and returns once the broker accepted
+	// it. msgID identifies the event so that brokers supporting it drop
+	// the duplicates of redelivered events.
+	Publish(ctx context.Context, subject, msgID string, data []byte) error
+	// Close releases the connection to the broker
+	Close() error
+}
+
+// Message is an event document addressed to a subject
+type Message struct {
+	Subject string
+	MsgID   string
+	Data    []byte
+}
+
+// BatchPublisher is implemented by publishers able to send several messages
+// in one round trip. It is used to replay the spool.
+type BatchPublisher interface {
+	// PublishBatch sends messages in order and returns how many of them,
+	// from the first, the broker accepted
+	PublishBatch(ctx context.Context, messages []Message) (int, error)
+}
+
+// PublishConfig describes how events are routed to a Publisher
+type PublishConfig struct {
+	Subject    string        // Subject or key template, e.g. files.{{ .Op }}
+	Rules      []PublishRule // Subject overrides, the first matching rule applies
+	SpoolFile  string        // File holding the events not yet accepted by the broker
+	SpoolLimit int64         // Maximum size of the spool in bytes
+}
+
+// PublishRule publishes matching events to another subject
+type PublishRule struct {
+	Pattern string   // Glob matched against the file name, all files when empty
+	Events  []string // Event types, all types when empty
+	Subject string   // Subject or key template
+}
+
+// Validate reports whether the publish configuration is usable
+func (c PublishConfig) Validate() error {
+	if c.Subject == "" {
+		return fmt.Errorf("publish subject must be specified")
+	}
+	if err := ValidateTemplate(c.Subject); err != nil {
+		return fmt.Errorf("invalid publish subject: %v", err)
+	}
+	for _, rule := range c.Rules {
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid publish rule pattern %q: %v", rule.Pattern, err)
+		}
+		for _, event := range rule.Events {
+			if !IsValidEventType(event) {
+				return fmt.Errorf("invalid publish rule event: %s", event)
+			}
+		}
+		if rule.Subject == "" {
+			return fmt.Errorf("publish rule subject must be specified")
+		}
+		if err := ValidateTemplate(rule.Subject); err != nil {
+			return fmt.Errorf("invalid publish rule subject: %v", err)
+		}
+	}
+	if c.SpoolFile == "" {
+		return fmt.Errorf("publish spool file must be specified")
+	}
+	if c.SpoolLimit < 0 {
+		return fmt.Errorf("publish spool limit must be non-negative")
+	}
+	return nil
+}
+
+func (r PublishRule) matches(event *Event) bool {
+	if len(r.Events) > 0 && !containsString(r.Events, string(event.Type)) {
+		return false
+	}
+	if r.Pattern != "" {
+		matched, _ := filepath.Match(r.Pattern, filepath.Base(event.Path))
+		return matched
+	}
+	return true
+}
+
+// spooledMessage is a line of the spool file
+type spooledMessage struct {
+	Subject string          `json:"subject"`
+	MsgID   string          `json:"msg_id"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// publishAction publishes events at least once. Events the broker does not
+// accept are appended to the spool and retried in order; while the spool
+// holds events new events are queued behind them.
+type publishAction struct {
+	fw        *FileWatcher
+	name      string
+	publisher Publisher
+	cfg       PublishConfig
+	subject   *template.Template
+	rules     []*template.Template
+
+	lock    sync.Mutex
+	spooled int
+	size    int64
+	failing bool
+
+	started bool
+	kick    chan struct{}
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func newPublishAction(fw *FileWatcher, name string, publisher Publisher, cfg PublishConfig) (*publishAction, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.SpoolLimit == 0 {
+		cfg.SpoolLimit = defaultSpoolLimit
+	}
+
+	p := &publishAction{
+		fw:        fw,
+		name:      name,
+		publisher: publisher,
+		cfg:       cfg,
+		kick:      make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+
+	var err error
+	if p.subject, err = parseTemplate(name+".subject", cfg.Subject); err != nil {
+		return nil, err
+	}
+	for _, rule := range cfg.Rules {
+		tmpl, err := parseTemplate(name+".rule.subject", rule.Subject)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, tmpl)
+	}
+	return p, nil
+}
+
+// start loads the events spooled by a previous run and retries them in the
+// background
+func (p *publishAction) start() error {
+	if err := os.MkdirAll(filepath.Dir(p.cfg.SpoolFile), 0755); err != nil {
+		return fmt.Errorf("failed to create %s spool dir: %v", p.name, err)
+	}
+
+	messages, err := p.readSpool()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(p.cfg.SpoolFile); err == nil {
+		p.size = info.Size()
+	}
+	p.spooled = len(messages)
+	if p.spooled > 0 {
+		p.fw.logger.Info("replaying spooled events", "publisher", p.name, "events", p.spooled)
+		p.retry()
+	}
+
+	p.started = true
+	go p.run()
+	return nil
+}
+
+// Handle publishes event, spooling it when the broker is unavailable
+func (p *publishAction) Handle(event *Event) error {
+	msg, err := p.message(event)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	if p.spooled > 0 {
+		err := p.spoolLocked(event, msg)
+		p.lock.Unlock()
+		return err
+	}
+	p.lock.Unlock()
+
+	if err := p.publish(msg); err != nil {
+		p.lock.Lock()
+		p.failedLocked(err)
+		err = p.spoolLocked(event, msg)
+		p.lock.Unlock()
+		p.retry()
+		return err
+	}
+	return nil
+}
+
+// Close stops the retries and the publisher. Spooled events are kept for
+// the next run.
+func (p *publishAction) Close() error {
+	if p.started {
+		close(p.stopCh)
+		<-p.doneCh
+	}
+
+	p.lock.Lock()
+	if p.spooled > 0 {
+		p.fw.logger.Warn("events left in spool", "publisher", p.name, "events", p.spooled, "spool", p.cfg.SpoolFile)
+	}
+	p.lock.Unlock()
+
+	return p.publisher.Close()
+}
+
+// message builds the message of event
+func (p *publishAction) message(event *Event) (spooledMessage, error) {
+	tmpl := p.subject
+	for i, rule := range p.cfg.Rules {
+		if rule.matches(event) {
+			tmpl = p.rules[i]
+			break
+		}
+	}
+
+	subject, err := execute(tmpl, event.templateData())
+	if err != nil {
+		return spooledMessage{}, err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return spooledMessage{}, err
+	}
+
+	return spooledMessage{
+		Subject: subject,
+		MsgID:   fmt.Sprintf("%s-%d-%d", p.fw.allocID, event.Sequence, event.Timestamp.UnixNano()),
+		Data:    data,
+	}, nil
+}
+
+// replay publishes messages in order and returns how many were delivered
+// before the first failure
+func (p *publishAction) replay(messages []spooledMessage) (int, error) {
+	batcher, ok := p.publisher.(BatchPublisher)
+	if !ok {
+		for i, msg := range messages {
+			if err := p.publish(msg); err != nil {
+				return i, err
+			}
+		}
+		return len(messages), nil
+	}
+
+	delivered := 0
+	for len(messages) > 0 {
+		n := min(len(messages), publishBatchSize)
+		batch := make([]Message, n)
+		for i, msg := range messages[:n] {
+			batch[i] = Message{Subject: msg.Subject, MsgID: msg.MsgID, Data: msg.Data}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		sent, err := batcher.PublishBatch(ctx, batch)
+		cancel()
+
+		delivered += sent
+		if err != nil {
+			return delivered, err
+		}
+		messages = messages[n:]
+	}
+	return delivered, nil
+}
+
+func (p *publishAction) publish(msg spooledMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	return p.publisher.Publish(ctx, msg.Subject, msg.MsgID, msg.Data)
+}
+
+// retry wakes up the retry loop
+func (p *publishAction) retry() {
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (p *publishAction) run() {
+	defer close(p.doneCh)
+
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.kick:
+		case <-ticker.C:
+		case <-p.stopCh:
+			return
+		}
+
+		p.lock.Lock()
+		pending := p.spooled > 0
+		p.lock.Unlock()
+
+		if pending {
+			p.fw.metrics.Retry(p.name)
+			p.replaySpool()
+		}
+	}
+}
+
+// replaySpool publishes the spooled events in order, stopping at the first
+// failure. The lock is only held while the spool is read and rewritten, so
+// that Handle can keep appending to it while the events are sent.
+func (p *publishAction) replaySpool() {
+	p.lock.Lock()
+	messages, err := p.readSpool()
+	p.lock.Unlock()
+	if err != nil {
+		p.fw.logger.Error("failed to read spool", "publisher", p.name, "error", err)
+		return
+	}
+
+	delivered, replayErr := p.replay(messages)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if replayErr != nil {
+		p.failedLocked(replayErr)
+	}
+	if delivered == 0 {
+		return
+	}
+
+	// Events spooled while sending were appended behind the sent ones
+	current, err := p.readSpool()
+	if err != nil {
+		p.fw.logger.Error("failed to read spool", "publisher", p.name, "error", err)
+		return
+	}
+	delivered = min(delivered, len(current))
+	if err := p.rewriteSpool(current[delivered:]); err != nil {
+		p.fw.logger.Error("failed to rewrite spool", "publisher", p.name, "error", err)
+		return
+	}
+	p.spooled = len(current) - delivered
+	if p.spooled == 0 && p.failing {
+		p.failing = false
+		p.fw.logger.Info("publisher recovered", "publisher", p.name, "replayed", delivered)
+	}
+	if p.spooled > 0 && replayErr == nil {
+		// Events spooled while sending are sent without waiting for the
+		// next retry interval
+		p.retry()
+	}
+}
+
+// spoolLocked appends msg, the message of event, to the spool file
+func (p *publishAction) spoolLocked(event *Event, msg spooledMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if p.size+int64(len(line)) > p.cfg.SpoolLimit {
+		p.fw.metrics.EventDropped(event.Root, string(event.Type))
+		return fmt.Errorf("%s spool is full, event dropped", p.name)
+	}
+
+	f, err := os.OpenFile(p.cfg.SpoolFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s spool: %v", p.name, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to spool event: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to spool event: %v", err)
+	}
+
+	p.spooled++
+	p.size += int64(len(line))
+	return nil
+}
+
+func (p *publishAction) readSpool() ([]spooledMessage, error) {
+	data, err := os.ReadFile(p.cfg.SpoolFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s spool: %v", p.name, err)
+	}
+
+	var messages []spooledMessage
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		var msg spooledMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			// A line cut short by a crash while spooling
+			p.fw.logger.Warn("skipping corrupt spool entry", "publisher", p.name, "error", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, scanner.Err()
+}
+
+// rewriteSpool atomically replaces the spool with the remaining messages
+func (p *publishAction) rewriteSpool(messages []spooledMessage) error {
+	if len(messages) == 0 {
+		p.size = 0
+		if err := os.Remove(p.cfg.SpoolFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp := p.cfg.SpoolFile + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.cfg.SpoolFile); err != nil {
+		return err
+	}
+	p.size = int64(buf.Len())
+	return nil
+}
+
+// failedLocked records the first failure of an outage in the task events
+func (p *publishAction) failedLocked(err error) {
+	if isTimeout(err) {
+		p.fw.metrics.Timeout(p.name)
+	}
+	if p.failing {
+		return
+	}
+	p.failing = true
+	p.fw.logger.Warn("publisher unavailable, spooling events", "publisher", p.name, "error", err)
+	p.fw.emitTaskEvent("Publisher unavailable, spooling events", map[string]string{
+		"publisher": p.name,
+		"error":     err.Error(),
+	})
+}
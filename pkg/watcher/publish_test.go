@@ -0,0 +1,295 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errBrokerDown = errors.New("broker unavailable")
+
+// fakePublisher records the published messages. Publishing fails while err
+// is set and waits for block while it is set.
+type fakePublisher struct {
+	lock      sync.Mutex
+	err       error
+	block     chan struct{}
+	blocked   int
+	published []Message
+	closed    bool
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, subject, msgID string, data []byte) error {
+	f.lock.Lock()
+	err, block := f.err, f.block
+	if block != nil {
+		f.blocked++
+	}
+	f.lock.Unlock()
+
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.published = append(f.published, Message{Subject: subject, MsgID: msgID, Data: data})
+	return nil
+}
+
+func (f *fakePublisher) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakePublisher) set(err error, block chan struct{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.err, f.block = err, block
+}
+
+// paths returns the event paths of the published messages in order
+func (f *fakePublisher) paths(t *testing.T) []string {
+	t.Helper()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var paths []string
+	for _, msg := range f.published {
+		var event Event
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, event.Path)
+	}
+	return paths
+}
+
+// fakeBatchPublisher accepts accept messages of the next batch and fails
+// the rest
+type fakeBatchPublisher struct {
+	fakePublisher
+	batches int
+	accept  int
+}
+
+func (f *fakeBatchPublisher) PublishBatch(ctx context.Context, messages []Message) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.batches++
+	n := len(messages)
+	if f.accept >= 0 && f.accept < n {
+		n = f.accept
+	}
+	f.published = append(f.published, messages[:n]...)
+	if n < len(messages) {
+		return n, errBrokerDown
+	}
+	return n, nil
+}
+
+func newTestPublish(t *testing.T, fw *FileWatcher, publisher Publisher, spool string) *publishAction {
+	t.Helper()
+
+	p, err := newPublishAction(fw, "test", publisher, PublishConfig{
+		Subject:   "files.{{ .Op }}",
+		SpoolFile: spool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func publishEvent(i int) *Event {
+	event := testEvent(fmt.Sprintf("/data/%d", i))
+	event.Sequence = uint64(i)
+	return event
+}
+
+func spooledCount(p *publishAction) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.spooled
+}
+
+func TestPublishSpoolsAndReplaysInOrder(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	publisher := &fakePublisher{err: errBrokerDown}
+	events := &taskEvents{}
+	fw := newTestWatcher(t, WithTaskEvents(events.emit))
+	p := newTestPublish(t, fw, publisher, spool)
+	defer p.Close()
+
+	for i := 1; i <= 3; i++ {
+		if err := p.Handle(publishEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := spooledCount(p); n != 3 {
+		t.Fatalf("expected 3 spooled events, got %d", n)
+	}
+	if got := events.list(); len(got) != 1 {
+		t.Fatalf("expected one task event for the outage, got %q", got)
+	}
+
+	publisher.set(nil, nil)
+	p.retry()
+	waitFor(t, 5*time.Second, func() bool { return spooledCount(p) == 0 })
+
+	if got := publisher.paths(t); fmt.Sprint(got) != "[/data/1 /data/2 /data/3]" {
+		t.Fatalf("expected the events in order, got %v", got)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Fatalf("expected the spool to be removed, got %v", err)
+	}
+
+	// Once the spool is empty events are published directly
+	if err := p.Handle(publishEvent(4)); err != nil {
+		t.Fatal(err)
+	}
+	if got := publisher.paths(t); len(got) != 4 || got[3] != "/data/4" {
+		t.Fatalf("expected the event to be published, got %v", got)
+	}
+}
+
+func TestPublishReplaysSpoolOfPreviousRun(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	fw := newTestWatcher(t)
+
+	down := &fakePublisher{err: errBrokerDown}
+	p := newTestPublish(t, fw, down, spool)
+	for i := 1; i <= 2; i++ {
+		p.Handle(publishEvent(i))
+	}
+	p.Close()
+	if !down.closed {
+		t.Fatal("expected the publisher to be closed")
+	}
+
+	publisher := &fakePublisher{}
+	p = newTestPublish(t, fw, publisher, spool)
+	defer p.Close()
+
+	waitFor(t, 5*time.Second, func() bool { return spooledCount(p) == 0 })
+	if got := publisher.paths(t); fmt.Sprint(got) != "[/data/1 /data/2]" {
+		t.Fatalf("expected the spooled events, got %v", got)
+	}
+}
+
+func TestPublishBatchReplayKeepsUnacceptedEvents(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	publisher := &fakeBatchPublisher{accept: 0}
+	publisher.err = errBrokerDown
+	fw := newTestWatcher(t)
+	p := newTestPublish(t, fw, publisher, spool)
+	defer p.Close()
+
+	for i := 1; i <= 5; i++ {
+		p.Handle(publishEvent(i))
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		publisher.lock.Lock()
+		defer publisher.lock.Unlock()
+		return publisher.batches > 0
+	})
+
+	// The broker accepts the first two events of the next batch
+	publisher.lock.Lock()
+	publisher.accept = 2
+	publisher.lock.Unlock()
+	p.retry()
+	waitFor(t, 5*time.Second, func() bool { return spooledCount(p) == 3 })
+
+	publisher.lock.Lock()
+	publisher.accept = -1
+	publisher.lock.Unlock()
+	p.retry()
+	waitFor(t, 5*time.Second, func() bool { return spooledCount(p) == 0 })
+
+	if got := publisher.paths(t); fmt.Sprint(got) != "[/data/1 /data/2 /data/3 /data/4 /data/5]" {
+		t.Fatalf("expected every event once and in order, got %v", got)
+	}
+}
+
+func TestPublishSpoolsWhileReplaying(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	publisher := &fakePublisher{err: errBrokerDown}
+	fw := newTestWatcher(t)
+	p := newTestPublish(t, fw, publisher, spool)
+	defer p.Close()
+
+	p.Handle(publishEvent(1))
+
+	// Hold the replay inside the broker call
+	block := make(chan struct{})
+	publisher.set(nil, block)
+	p.retry()
+	waitFor(t, 5*time.Second, func() bool {
+		publisher.lock.Lock()
+		defer publisher.lock.Unlock()
+		return publisher.blocked == 1
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- p.Handle(publishEvent(2)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle blocked while the spool was replayed")
+	}
+
+	publisher.set(nil, nil)
+	close(block)
+	waitFor(t, 5*time.Second, func() bool { return spooledCount(p) == 0 })
+
+	if got := publisher.paths(t); fmt.Sprint(got) != "[/data/1 /data/2]" {
+		t.Fatalf("expected the event spooled during the replay behind the others, got %v", got)
+	}
+}
+
+func TestPublishSpoolLimit(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	publisher := &fakePublisher{err: errBrokerDown}
+	fw := newTestWatcher(t)
+
+	p := newTestPublish(t, fw, publisher, spool)
+	defer p.Close()
+
+	// Room for a single event
+	msg, err := p.message(publishEvent(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := json.Marshal(msg)
+	p.cfg.SpoolLimit = int64(len(line)) + 10
+
+	if err := p.Handle(publishEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Handle(publishEvent(2)); err == nil {
+		t.Fatal("expected the event to be dropped once the spool is full")
+	}
+	if n := spooledCount(p); n != 1 {
+		t.Fatalf("expected 1 spooled event, got %d", n)
+	}
+}
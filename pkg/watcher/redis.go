@@ -0,0 +1,143 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RedisStream = "stream" // XADD the events to a stream
+	RedisList   = "list"   // LPUSH the events to a list
+)
+
+// RedisConfig describes the Redis server events are written to. The key of
+// every event is the rendered subject of the PublishConfig.
+type RedisConfig struct {
+	Address  string // host:port, or a redis:// or rediss:// URL
+	Username string
+	Password string
+	DB       int
+	Mode     string // stream or list
+	MaxLen   int64  // Entries kept per key, 0 keeps all of them
+}
+
+// Validate reports whether the Redis configuration is usable
+func (c RedisConfig) Validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("redis address must be specified")
+	}
+	if _, err := c.options(); err != nil {
+		return err
+	}
+	switch c.Mode {
+	case "", RedisStream, RedisList:
+	default:
+		return fmt.Errorf("invalid redis mode: %s", c.Mode)
+	}
+	if c.MaxLen < 0 {
+		return fmt.Errorf("redis maxlen must be non-negative")
+	}
+	return nil
+}
+
+func (c RedisConfig) options() (*redis.Options, error) {
+	opts := &redis.Options{Addr: c.Address}
+	if strings.HasPrefix(c.Address, "redis://") || strings.HasPrefix(c.Address, "rediss://") {
+		var err error
+		if opts, err = redis.ParseURL(c.Address); err != nil {
+			return nil, fmt.Errorf("invalid redis address: %v", err)
+		}
+	}
+	if c.Username != "" {
+		opts.Username = c.Username
+	}
+	if c.Password != "" {
+		opts.Password = c.Password
+	}
+	if c.DB != 0 {
+		opts.DB = c.DB
+	}
+	return opts, nil
+}
+
+type redisPublisher struct {
+	cfg    RedisConfig
+	client *redis.Client
+}
+
+// NewRedisPublisher creates a Redis client. Connections are established on
+// first use and reestablished after failures.
+func NewRedisPublisher(cfg RedisConfig) (Publisher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = RedisStream
+	}
+
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+	// Failed writes are spooled and retried in order by the caller
+	opts.MaxRetries = -1
+
+	return &redisPublisher{cfg: cfg, client: redis.NewClient(opts)}, nil
+}
+
+// Publish writes data to the stream or list key
+func (p *redisPublisher) Publish(ctx context.Context, key, msgID string, data []byte) error {
+	_, err := p.PublishBatch(ctx, []Message{{Subject: key, MsgID: msgID, Data: data}})
+	return err
+}
+
+// PublishBatch pipelines the writes of messages
+func (p *redisPublisher) PublishBatch(ctx context.Context, messages []Message) (int, error) {
+	cmds, err := p.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range messages {
+			p.write(ctx, pipe, msg)
+		}
+		return nil
+	})
+
+	// A list message is written by two commands, it is delivered once its
+	// LPUSH succeeded
+	perMessage := 1
+	if p.cfg.Mode == RedisList && p.cfg.MaxLen > 0 {
+		perMessage = 2
+	}
+	for i := 0; i < len(cmds); i += perMessage {
+		if cmdErr := cmds[i].Err(); cmdErr != nil {
+			return i / perMessage, cmdErr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(messages), nil
+}
+
+func (p *redisPublisher) write(ctx context.Context, pipe redis.Pipeliner, msg Message) {
+	if p.cfg.Mode == RedisList {
+		pipe.LPush(ctx, msg.Subject, msg.Data)
+		if p.cfg.MaxLen > 0 {
+			pipe.LTrim(ctx, msg.Subject, 0, p.cfg.MaxLen-1)
+		}
+		return
+	}
+
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: msg.Subject,
+		MaxLen: p.cfg.MaxLen,
+		Approx: p.cfg.MaxLen > 0,
+		Values: []interface{}{"event", msg.Data, "msg_id", msg.MsgID},
+	})
+}
+
+// Close closes the connections
+func (p *redisPublisher) Close() error {
+	return p.client.Close()
+}
@@ -0,0 +1,187 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T, cfg RedisConfig) (*miniredis.Miniredis, *redisPublisher) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	cfg.Address = server.Addr()
+
+	publisher, err := NewRedisPublisher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+	return server, publisher.(*redisPublisher)
+}
+
+func redisMessages(key string, n int) []Message {
+	messages := make([]Message, n)
+	for i := range messages {
+		messages[i] = Message{
+			Subject: key,
+			MsgID:   fmt.Sprintf("msg-%d", i+1),
+			Data:    []byte(fmt.Sprintf(`{"path":"/data/%d"}`, i+1)),
+		}
+	}
+	return messages
+}
+
+func TestRedisStream(t *testing.T) {
+	server, publisher := newTestRedis(t, RedisConfig{})
+
+	if err := publisher.Publish(context.Background(), "files", "msg-1", []byte(`{"path":"/data/1"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := server.Stream("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	want := []string{"event", `{"path":"/data/1"}`, "msg_id", "msg-1"}
+	if fmt.Sprint(entries[0].Values) != fmt.Sprint(want) {
+		t.Fatalf("expected values %q, got %q", want, entries[0].Values)
+	}
+}
+
+func TestRedisStreamBatchAndMaxLen(t *testing.T) {
+	server, publisher := newTestRedis(t, RedisConfig{MaxLen: 100})
+
+	// One pipeline writing more entries than MAXLEN keeps
+	messages := redisMessages("files", 150)
+	n, err := publisher.PublishBatch(context.Background(), messages)
+	if err != nil || n != len(messages) {
+		t.Fatalf("expected all %d messages to be delivered, got %d: %v", len(messages), n, err)
+	}
+
+	entries, err := server.Stream("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MAXLEN is approximate in Redis, miniredis trims exactly
+	if len(entries) != 100 {
+		t.Fatalf("expected the stream to be trimmed to 100 entries, got %d", len(entries))
+	}
+	if last := entries[len(entries)-1].Values[3]; last != "msg-150" {
+		t.Fatalf("expected the newest entry to be kept, got %s", last)
+	}
+}
+
+func TestRedisList(t *testing.T) {
+	server, publisher := newTestRedis(t, RedisConfig{Mode: RedisList, MaxLen: 2})
+
+	n, err := publisher.PublishBatch(context.Background(), redisMessages("files", 3))
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 messages to be delivered, got %d: %v", n, err)
+	}
+
+	list, err := server.List("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`{"path":"/data/3"}`, `{"path":"/data/2"}`}
+	if fmt.Sprint(list) != fmt.Sprint(want) {
+		t.Fatalf("expected the newest events first, got %q", list)
+	}
+}
+
+func TestRedisBatchReportsDeliveredPrefix(t *testing.T) {
+	for _, cfg := range []RedisConfig{
+		{Mode: RedisStream},
+		{Mode: RedisList},
+		{Mode: RedisList, MaxLen: 10},
+	} {
+		t.Run(fmt.Sprintf("%s-%d", cfg.Mode, cfg.MaxLen), func(t *testing.T) {
+			server, publisher := newTestRedis(t, cfg)
+			server.Set("busy", "not a stream or list")
+
+			messages := redisMessages("files", 3)
+			messages[1].Subject = "busy"
+
+			n, err := publisher.PublishBatch(context.Background(), messages)
+			if err == nil || n != 1 {
+				t.Fatalf("expected the first message to be delivered before the error, got %d: %v", n, err)
+			}
+		})
+	}
+}
+
+func TestRedisReconnects(t *testing.T) {
+	server, publisher := newTestRedis(t, RedisConfig{})
+	ctx := context.Background()
+
+	if err := publisher.Publish(ctx, "files", "msg-1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	if err := publisher.Publish(ctx, "files", "msg-2", []byte("{}")); err == nil {
+		t.Fatal("expected an error while the server is down")
+	}
+
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, "files", "msg-3", []byte("{}")); err != nil {
+		t.Fatalf("expected the publisher to reconnect: %v", err)
+	}
+}
+
+func TestRedisSpoolReplay(t *testing.T) {
+	server, publisher := newTestRedis(t, RedisConfig{})
+	fw := newTestWatcher(t)
+
+	p, err := newPublishAction(fw, "redis", publisher, PublishConfig{
+		Subject:   "files.{{ .Op }}",
+		SpoolFile: filepath.Join(t.TempDir(), "spool.jsonl"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	server.Close()
+	for i := 1; i <= 3; i++ {
+		if err := p.Handle(publishEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := spooledCount(p); n != 3 {
+		t.Fatalf("expected 3 spooled events, got %d", n)
+	}
+
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	p.retry()
+	waitFor(t, 5*time.Second, func() bool { return spooledCount(p) == 0 })
+
+	entries, err := server.Stream("files.create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if want := fmt.Sprintf("-%d-", i+1); !strings.Contains(entry.Values[3], want) {
+			t.Fatalf("expected entry %d to carry msg id %s, got %s", i, want, entry.Values[3])
+		}
+	}
+}
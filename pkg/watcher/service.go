@@ -0,0 +1,382 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	ServiceRestart = "restart" // Stop the service and start it again on changes
+	ServiceReload  = "reload"  // Send the reload signal to the service on changes
+
+	ServiceStateStarting   = "starting"
+	ServiceStateRunning    = "running"
+	ServiceStateRestarting = "restarting"
+	ServiceStateBackoff    = "backoff"
+	ServiceStateStopped    = "stopped"
+
+	// Delay before restarting a crashed service, doubled up to the maximum
+	// while it keeps crashing
+	serviceRestartDelay    = time.Second
+	serviceMaxRestartDelay = 30 * time.Second
+
+	// A service running this long is considered healthy again
+	serviceStableAfter = 10 * time.Second
+)
+
+// ServiceConfig describes a long-running process supervised by the watcher
+// and restarted or reloaded when the watched files change
+type ServiceConfig struct {
+	Command      string
+	Args         []string
+	OnChange     string        // restart or reload
+	StopSignal   os.Signal     // Signal stopping the service on restart
+	ReloadSignal os.Signal     // Signal sent to the service on reload
+	GracePeriod  time.Duration // Time to wait for the service to stop before killing it
+	Debounce     time.Duration // Quiet period required after an event before acting
+}
+
+// Validate reports whether the service configuration is usable
+func (c ServiceConfig) Validate() error {
+	if c.Command == "" {
+		return fmt.Errorf("service command must be specified")
+	}
+	if !IsValidServiceAction(c.OnChange) {
+		return fmt.Errorf("invalid service action: %s", c.OnChange)
+	}
+	if c.GracePeriod < 0 {
+		return fmt.Errorf("service grace period must be non-negative")
+	}
+	if c.Debounce < 0 {
+		return fmt.Errorf("service debounce must be non-negative")
+	}
+	return nil
+}
+
+// IsValidServiceAction checks if the service action is valid
+func IsValidServiceAction(action string) bool {
+	switch action {
+	case "", ServiceRestart, ServiceReload:
+		return true
+	}
+	return false
+}
+
+// ServiceStatus is the health of the supervised service
+type ServiceStatus struct {
+	State     string
+	Pid       int
+	Restarts  int
+	StartedAt time.Time
+	ExitCode  int // Exit code of the previous run, -1 when killed by a signal
+}
+
+type service struct {
+	fw     *FileWatcher
+	cfg    ServiceConfig
+	logger hclog.Logger
+
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	status  ServiceStatus
+	trigger chan *Event
+
+	started     bool
+	stopCh      chan struct{}
+	doneCh      chan struct{}
+	stopSignal  os.Signal
+	stopTimeout time.Duration
+}
+
+func newService(fw *FileWatcher, cfg ServiceConfig) *service {
+	if cfg.OnChange == "" {
+		cfg.OnChange = ServiceRestart
+	}
+	if cfg.StopSignal == nil {
+		cfg.StopSignal = os.Interrupt
+	}
+
+	return &service{
+		fw:      fw,
+		cfg:     cfg,
+		logger:  fw.logger.Named("service"),
+		status:  ServiceStatus{State: ServiceStateStarting},
+		trigger: make(chan *Event, 1),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+// start starts the service process and its supervisor
+func (s *service) start() error {
+	if err := s.spawn(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.started = true
+	s.lock.Unlock()
+
+	go s.run()
+	return nil
+}
+
+// notify schedules a restart or reload for event
+func (s *service) notify(event *Event) {
+	select {
+	case s.trigger <- event:
+	default:
+		// A change is already pending
+	}
+}
+
+// run supervises the service until it is stopped
+func (s *service) run() {
+	defer close(s.doneCh)
+
+	var debounce, backoff <-chan time.Time
+	var pending *Event
+	delay := serviceRestartDelay
+
+	for {
+		s.lock.Lock()
+		exited := s.exited
+		s.lock.Unlock()
+
+		select {
+		case event := <-s.trigger:
+			pending = event
+			debounce = time.After(s.cfg.Debounce)
+
+		case <-debounce:
+			debounce = nil
+			backoff = nil
+			delay = serviceRestartDelay
+			if err := s.change(pending); err != nil {
+				s.logger.Error("failed to restart service", "error", err, "delay", delay)
+				backoff, delay = s.backoff(delay)
+			}
+			pending = nil
+
+		case <-exited:
+			uptime := s.collect()
+			if uptime >= serviceStableAfter {
+				delay = serviceRestartDelay
+			}
+			s.logger.Warn("service exited, restarting", "exit_code", s.health().ExitCode, "delay", delay)
+			backoff, delay = s.backoff(delay)
+
+		case <-backoff:
+			backoff = nil
+			s.lock.Lock()
+			s.status.Restarts++
+			s.lock.Unlock()
+			if err := s.spawn(); err != nil {
+				s.logger.Error("failed to restart service", "error", err, "delay", delay)
+				backoff, delay = s.backoff(delay)
+			}
+
+		case <-s.stopCh:
+			s.lock.Lock()
+			signal, timeout := s.stopSignal, s.stopTimeout
+			s.lock.Unlock()
+
+			s.terminate(signal, timeout)
+			s.setState(ServiceStateStopped)
+			return
+		}
+	}
+}
+
+// backoff puts the service in backoff and returns the timer of the next
+// restart attempt after delay along with the delay of the attempt after it
+func (s *service) backoff(delay time.Duration) (<-chan time.Time, time.Duration) {
+	s.setState(ServiceStateBackoff)
+	next := delay * 2
+	if next > serviceMaxRestartDelay {
+		next = serviceMaxRestartDelay
+	}
+	return time.After(delay), next
+}
+
+// change restarts or reloads the service after a debounced event. A failure
+// to start it again is returned so that the supervisor retries with backoff.
+func (s *service) change(event *Event) error {
+	path := ""
+	if event != nil {
+		path = event.Path
+	}
+
+	s.lock.Lock()
+	running := s.cmd != nil
+	s.lock.Unlock()
+
+	if s.cfg.OnChange == ServiceReload && running && s.cfg.ReloadSignal != nil {
+		s.logger.Info("reloading service", "path", path, "signal", s.cfg.ReloadSignal)
+		s.signal(s.cfg.ReloadSignal)
+		return nil
+	}
+
+	s.logger.Info("restarting service", "path", path)
+	s.setState(ServiceStateRestarting)
+	s.terminate(s.cfg.StopSignal, s.cfg.GracePeriod)
+
+	s.lock.Lock()
+	s.status.Restarts++
+	s.lock.Unlock()
+
+	return s.spawn()
+}
+
+// spawn starts the service process
+func (s *service) spawn() error {
+	cmd, err := s.fw.Command(context.Background(), s.cfg.Command, s.cfg.Args...)
+	if err != nil {
+		return fmt.Errorf("failed to prepare service: %v", err)
+	}
+
+	stdout, stderr := s.writers()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	if err := s.fw.StartCommand(cmd); err != nil {
+		return fmt.Errorf("failed to start service: %v", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		if s.fw.exec != nil && s.fw.exec.hook != nil {
+			s.fw.exec.hook.PostExit(nil, cmd.ProcessState)
+		}
+		close(exited)
+	}()
+
+	s.lock.Lock()
+	s.cmd = cmd
+	s.exited = exited
+	s.status.State = ServiceStateRunning
+	s.status.Pid = cmd.Process.Pid
+	s.status.StartedAt = time.Now()
+	s.lock.Unlock()
+
+	s.logger.Info("service started", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// collect records the exit of the service process and returns how long it
+// was running
+func (s *service) collect() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cmd == nil {
+		return 0
+	}
+	s.status.ExitCode = s.cmd.ProcessState.ExitCode()
+	s.status.Pid = 0
+	s.cmd = nil
+	s.exited = nil
+	return time.Since(s.status.StartedAt)
+}
+
+// terminate sends signal to the service and kills it once timeout elapsed
+func (s *service) terminate(signal os.Signal, timeout time.Duration) {
+	s.lock.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.lock.Unlock()
+
+	if cmd == nil {
+		return
+	}
+
+	if err := signalGroup(cmd.Process, signal); err != nil {
+		s.logger.Debug("failed to signal service", "error", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+	case <-timer.C:
+		s.logger.Warn("service did not stop in time, killing it", "timeout", timeout)
+		signalGroup(cmd.Process, os.Kill)
+		<-exited
+	}
+	s.collect()
+}
+
+// signal forwards signal to the service process group
+func (s *service) signal(signal os.Signal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cmd == nil {
+		return
+	}
+	if err := signalGroup(s.cmd.Process, signal); err != nil {
+		s.logger.Debug("failed to signal service", "error", err)
+	}
+}
+
+// stop stops the supervisor and the service, waiting up to timeout after
+// sending signal before killing it
+func (s *service) stop(signal os.Signal, timeout time.Duration) {
+	s.lock.Lock()
+	if !s.started {
+		s.lock.Unlock()
+		return
+	}
+	select {
+	case <-s.stopCh:
+	default:
+		s.stopSignal = signal
+		s.stopTimeout = timeout
+		close(s.stopCh)
+	}
+	s.lock.Unlock()
+
+	<-s.doneCh
+}
+
+func (s *service) setState(state string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status.State = state
+}
+
+// health returns the status of the service
+func (s *service) health() ServiceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.status
+}
+
+// writers returns the writers receiving the service output
+func (s *service) writers() (io.Writer, io.Writer) {
+	if s.fw.output != nil {
+		return s.fw.output.stdout, s.fw.output.stderr
+	}
+	w := s.logger.StandardWriter(&hclog.StandardLoggerOptions{})
+	return w, w
+}
+
+// ServiceStatus returns the health of the supervised service, if any
+func (fw *FileWatcher) ServiceStatus() (ServiceStatus, bool) {
+	if fw.service == nil {
+		return ServiceStatus{}, false
+	}
+	return fw.service.health(), true
+}
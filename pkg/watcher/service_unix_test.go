@@ -0,0 +1,75 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeServiceScript writes a long-running service script to path
+func writeServiceScript(t *testing.T, path string) {
+	t.Helper()
+
+	writeTestFile(t, path, "#!/bin/sh\nexec sleep 30\n")
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestService starts a service running the script at path
+func newTestService(t *testing.T, path string) *service {
+	t.Helper()
+
+	writeServiceScript(t, path)
+
+	s := newService(newTestWatcher(t), ServiceConfig{
+		Command:     path,
+		Debounce:    10 * time.Millisecond,
+		GracePeriod: time.Second,
+	})
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.stop(os.Kill, time.Second) })
+	return s
+}
+
+func TestServiceRestartsOnChange(t *testing.T) {
+	s := newTestService(t, filepath.Join(t.TempDir(), "service.sh"))
+	pid := s.health().Pid
+
+	s.notify(testEvent("/data/a"))
+	waitFor(t, 5*time.Second, func() bool {
+		status := s.health()
+		return status.State == ServiceStateRunning && status.Pid != pid
+	})
+	if got := s.health().Restarts; got != 1 {
+		t.Fatalf("expected 1 restart, got %d", got)
+	}
+}
+
+func TestServiceBacksOffWhenRestartFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.sh")
+	s := newTestService(t, path)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	s.notify(testEvent(path))
+	waitFor(t, 5*time.Second, func() bool { return s.health().State == ServiceStateBackoff })
+
+	// The next attempt waits for the restart delay rather than the debounce
+	time.Sleep(serviceRestartDelay / 2)
+	if got := s.health().Restarts; got != 1 {
+		t.Fatalf("expected a single restart attempt within the restart delay, got %d", got)
+	}
+
+	writeServiceScript(t, path)
+	waitFor(t, 5*time.Second, func() bool { return s.health().State == ServiceStateRunning })
+	if got := s.health().Restarts; got != 2 {
+		t.Fatalf("expected the backoff to restart the service, got %d restarts", got)
+	}
+}
@@ -0,0 +1,410 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SinkFile   = "file"   // Append to a file, rotated by size
+	SinkSocket = "socket" // Write to a Unix domain stream socket
+	SinkPipe   = "pipe"   // Write to a named pipe
+
+	defaultSinkBufferSize = 4096
+
+	// Delay before reopening a sink target that failed
+	sinkRetryDelay = time.Second
+
+	// Time a single write may block on a slow socket or pipe reader
+	sinkWriteTimeout = 10 * time.Second
+
+	// Time Close waits for the buffered events to be written
+	sinkCloseTimeout = 5 * time.Second
+)
+
+// sinkFields are the fields of the event document that can be selected
+var sinkFields = []string{
+	"schema_version", "sequence", "type", "op", "path", "rel_path", "root",
+	"old_path", "file", "task_id", "alloc_id", "timestamp",
+}
+
+// SinkConfig describes where the event documents are streamed as JSON lines
+type SinkConfig struct {
+	Type       string   // file, socket or pipe
+	Path       string   // Path of the file, socket or pipe
+	Fields     []string // Fields of the event document to write, all when empty
+	MaxSize    int64    // Size in bytes at which the file is rotated, 0 disables rotation
+	MaxFiles   int      // Rotated files kept
+	BufferSize int      // Events buffered while the target is slow or unavailable
+}
+
+// Validate reports whether the sink configuration is usable
+func (c SinkConfig) Validate() error {
+	switch c.Type {
+	case SinkFile, SinkSocket, SinkPipe:
+	default:
+		return fmt.Errorf("invalid sink type: %s", c.Type)
+	}
+	if c.Path == "" {
+		return fmt.Errorf("sink path must be specified")
+	}
+	for _, field := range c.Fields {
+		if !containsString(sinkFields, field) {
+			return fmt.Errorf("invalid sink field: %s", field)
+		}
+	}
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("sink rotation limits must be non-negative")
+	}
+	if c.Type != SinkFile && (c.MaxSize > 0 || c.MaxFiles > 0) {
+		return fmt.Errorf("sink rotation is only supported for files")
+	}
+	if c.BufferSize < 0 {
+		return fmt.Errorf("sink buffer size must be non-negative")
+	}
+	return nil
+}
+
+// sink writes the event documents in the order the events were received. A
+// single writer drains the buffer so that the order holds for every path.
+type sink struct {
+	fw  *FileWatcher
+	cfg SinkConfig
+
+	lock    sync.Mutex
+	started bool
+	closed  bool
+	queue   chan []byte
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+
+	target  io.WriteCloser
+	failing bool
+	dropped atomic.Uint64
+}
+
+func newSink(fw *FileWatcher, cfg SinkConfig) (*sink, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = defaultSinkBufferSize
+	}
+	if err := checkSinkPath(fw, cfg); err != nil {
+		return nil, err
+	}
+
+	return &sink{
+		fw:     fw,
+		cfg:    cfg,
+		queue:  make(chan []byte, cfg.BufferSize),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}, nil
+}
+
+// checkSinkPath rejects a file or pipe sink whose writes would be reported
+// as events of a watched path, feeding every event back into the sink
+func checkSinkPath(fw *FileWatcher, cfg SinkConfig) error {
+	if cfg.Type == SinkSocket {
+		return nil
+	}
+
+	// Rotated files are written next to the file
+	path := filepath.Clean(cfg.Path)
+	dir := filepath.Dir(path)
+	for _, watched := range fw.paths {
+		watched = filepath.Clean(watched)
+		if path == watched || dir == watched || (fw.recursiveWatch && isWithin(dir, watched)) {
+			return fmt.Errorf("sink path %s is inside the watched path %s", cfg.Path, watched)
+		}
+	}
+	return nil
+}
+
+func (s *sink) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.started = true
+	go s.run()
+}
+
+// publish buffers the document of event. Events are dropped when the buffer
+// is full rather than blocking the watch loop.
+func (s *sink) publish(event *Event) {
+	line, err := s.encode(event)
+	if err != nil {
+		s.fw.logger.Error("failed to encode event for sink", "path", event.Path, "error", err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- line:
+	default:
+		s.fw.metrics.EventDropped(event.Root, string(event.Type))
+		if s.dropped.Add(1) == 1 {
+			s.fw.logger.Warn("sink buffer full, dropping events", "path", s.cfg.Path)
+		}
+	}
+}
+
+// encode returns the JSON line of event restricted to the configured fields
+func (s *sink) encode(event *Event) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.cfg.Fields) == 0 {
+		return append(data, '\n'), nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	// Fields are written in the configured order
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	n := 0
+	for _, field := range s.cfg.Fields {
+		value, ok := doc[field]
+		if !ok {
+			continue
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", field)
+		buf.Write(value)
+		n++
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+func (s *sink) run() {
+	defer close(s.doneCh)
+
+	for line := range s.queue {
+		s.write(line)
+	}
+	s.closeTarget()
+}
+
+// write writes a line, reopening the target until it succeeds or the sink
+// is closed
+func (s *sink) write(line []byte) {
+	select {
+	case <-s.stopCh:
+		if s.failing {
+			s.dropped.Add(1)
+			return
+		}
+	default:
+	}
+
+	for {
+		err := s.open()
+		if err == nil {
+			if err = s.writeLine(line); err == nil {
+				s.recovered()
+				return
+			}
+			s.closeTarget()
+		}
+		s.failed(err)
+		if isTimeout(err) {
+			s.fw.metrics.Timeout("sink")
+		}
+
+		select {
+		case <-time.After(sinkRetryDelay):
+			s.fw.metrics.Retry("sink")
+		case <-s.stopCh:
+			// The buffered events get a single attempt once closing
+			s.dropped.Add(1)
+			return
+		}
+	}
+}
+
+func (s *sink) writeLine(line []byte) error {
+	if d, ok := s.target.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		// Regular files do not support deadlines
+		d.SetWriteDeadline(time.Now().Add(sinkWriteTimeout))
+	}
+	_, err := s.target.Write(line)
+	return err
+}
+
+func (s *sink) open() error {
+	if s.target != nil {
+		return nil
+	}
+
+	var err error
+	switch s.cfg.Type {
+	case SinkFile:
+		s.target, err = openRotatingFile(s.cfg.Path, s.cfg.MaxSize, s.cfg.MaxFiles)
+	case SinkSocket:
+		s.target, err = net.DialTimeout("unix", s.cfg.Path, sinkWriteTimeout)
+	case SinkPipe:
+		s.target, err = openPipe(s.cfg.Path)
+	}
+	if err != nil {
+		s.target = nil
+	}
+	return err
+}
+
+func (s *sink) closeTarget() {
+	if s.target == nil {
+		return
+	}
+	if err := s.target.Close(); err != nil {
+		s.fw.logger.Debug("failed to close sink", "path", s.cfg.Path, "error", err)
+	}
+	s.target = nil
+}
+
+// failed records the first failure of an outage in the task events
+func (s *sink) failed(err error) {
+	if s.failing {
+		return
+	}
+	s.failing = true
+	s.fw.logger.Warn("sink unavailable, retrying", "type", s.cfg.Type, "path", s.cfg.Path, "error", err)
+	s.fw.emitTaskEvent("Event sink unavailable", map[string]string{
+		"type":  s.cfg.Type,
+		"path":  s.cfg.Path,
+		"error": err.Error(),
+	})
+}
+
+func (s *sink) recovered() {
+	dropped := s.dropped.Swap(0)
+	if !s.failing && dropped == 0 {
+		return
+	}
+	s.failing = false
+	s.fw.logger.Info("sink recovered", "type", s.cfg.Type, "path", s.cfg.Path, "dropped", dropped)
+}
+
+// close writes the buffered events, giving up after sinkCloseTimeout
+func (s *sink) close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.queue)
+	started := s.started
+	s.lock.Unlock()
+
+	if !started {
+		return
+	}
+
+	select {
+	case <-s.doneCh:
+	case <-time.After(sinkCloseTimeout):
+		s.fw.logger.Warn("sink did not flush in time", "path", s.cfg.Path, "timeout", sinkCloseTimeout)
+	}
+	close(s.stopCh)
+	<-s.doneCh
+
+	if dropped := s.dropped.Load(); dropped > 0 {
+		s.fw.logger.Warn("sink closed with undelivered events", "path", s.cfg.Path, "dropped", dropped)
+	}
+}
+
+// rotatingFile appends to a file and rotates it once it reaches maxSize,
+// keeping maxFiles rotated files named path.1 (newest) to path.N
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %v", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.maxFiles == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+
+	// Shifting onto path.N drops the oldest file
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		old := fmt.Sprintf("%s.%d", r.path, i)
+		if err := os.Rename(old, fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
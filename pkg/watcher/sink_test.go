@@ -0,0 +1,179 @@
+package watcher
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func newTestSink(t *testing.T, fw *FileWatcher, cfg SinkConfig) *sink {
+	t.Helper()
+
+	s, err := newSink(fw, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+// readSinkLines returns the JSON documents of a sink file
+func readSinkLines(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var docs []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestSinkFileKeepsOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	fw := newTestWatcher(t)
+	s := newTestSink(t, fw, SinkConfig{Type: SinkFile, Path: path, Fields: []string{"sequence", "path"}})
+	s.start()
+
+	for i := 1; i <= 50; i++ {
+		s.publish(publishEvent(i))
+	}
+	s.close()
+
+	docs := readSinkLines(t, path)
+	if len(docs) != 50 {
+		t.Fatalf("expected 50 lines, got %d", len(docs))
+	}
+	for i, doc := range docs {
+		if len(doc) != 2 || doc["path"] != fmt.Sprintf("/data/%d", i+1) {
+			t.Fatalf("unexpected line %d: %v", i, doc)
+		}
+	}
+}
+
+func TestSinkFieldsOrder(t *testing.T) {
+	fw := newTestWatcher(t)
+	s := newTestSink(t, fw, SinkConfig{Type: SinkFile, Path: filepath.Join(t.TempDir(), "events.jsonl"), Fields: []string{"path", "op"}})
+
+	line, err := s.encode(testEvent("/data/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != `{"path":"/data/a","op":"create"}`+"\n" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestSinkDropsWhenBufferFull(t *testing.T) {
+	metrics := newRecordingMetrics()
+	fw := newTestWatcher(t, WithMetrics(metrics))
+	s := newTestSink(t, fw, SinkConfig{Type: SinkFile, Path: filepath.Join(t.TempDir(), "events.jsonl"), BufferSize: 2})
+
+	// Not started, nothing drains the buffer
+	for i := 1; i <= 5; i++ {
+		s.publish(publishEvent(i))
+	}
+	if n := s.dropped.Load(); n != 3 {
+		t.Fatalf("expected 3 dropped events, got %d", n)
+	}
+	if n := metrics.count("dropped create"); n != 3 {
+		t.Fatalf("expected 3 dropped events in the metrics, got %d", n)
+	}
+}
+
+func TestSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	fw := newTestWatcher(t)
+	s := newTestSink(t, fw, SinkConfig{Type: SinkFile, Path: path, MaxSize: 1024, MaxFiles: 2})
+	s.start()
+
+	for i := 1; i <= 100; i++ {
+		s.publish(publishEvent(i))
+	}
+	s.close()
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 rotated files to be kept, got %v", err)
+	}
+
+	// The newest events are kept in order across the files
+	var sequences []float64
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Fatalf("expected %s to stay below the rotation size, got %d bytes", name, info.Size())
+		}
+		for _, doc := range readSinkLines(t, name) {
+			sequences = append(sequences, doc["sequence"].(float64))
+		}
+	}
+	for i := 1; i < len(sequences); i++ {
+		if sequences[i] != sequences[i-1]+1 {
+			t.Fatalf("expected consecutive sequences, got %v", sequences)
+		}
+	}
+	if last := sequences[len(sequences)-1]; last != 100 {
+		t.Fatalf("expected the newest event to be kept, got %v", last)
+	}
+}
+
+func TestSinkRejectsWatchedPath(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		path      string
+		recursive bool
+		rejected  bool
+	}{
+		{path: filepath.Join(dir, "events.jsonl"), rejected: true},
+		{path: filepath.Join(dir, "sub", "events.jsonl")},
+		{path: filepath.Join(dir, "sub", "events.jsonl"), recursive: true, rejected: true},
+		{path: filepath.Join(t.TempDir(), "events.jsonl"), recursive: true},
+	} {
+		_, err := NewFileWatcher(hclog.NewNullLogger(), []string{dir}, nil, "true", nil, nil, nil, tc.recursive,
+			WithSink(SinkConfig{Type: SinkFile, Path: tc.path}))
+		if rejected := err != nil && strings.Contains(err.Error(), "inside the watched path"); rejected != tc.rejected {
+			t.Errorf("%s (recursive %v): expected rejected %v, got %v", tc.path, tc.recursive, tc.rejected, err)
+		}
+	}
+}
+
+func TestStartFailureClosesSink(t *testing.T) {
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), []string{"/does/not/exist"}, nil, "true", nil, nil, nil, false,
+		WithSink(SinkConfig{Type: SinkFile, Path: filepath.Join(t.TempDir(), "events.jsonl")}),
+		WithTail(TailConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+
+	if err := fw.Start(); err == nil {
+		t.Fatal("expected Start to fail")
+	}
+
+	fw.sink.lock.Lock()
+	closed := fw.sink.closed
+	fw.sink.lock.Unlock()
+	if !closed {
+		t.Fatal("expected the sink to be closed")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+)
+
+// openPipe opens a named pipe for writing, creating it when missing. The
+// open fails instead of blocking while no reader has the pipe open.
+func openPipe(path string) (*os.File, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := syscall.Mkfifo(path, 0644); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenPipeWithoutReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.pipe")
+
+	// The open must fail rather than block the sink writer
+	_, err := openPipe(path)
+	if !errors.Is(err, syscall.ENXIO) {
+		t.Fatalf("expected ENXIO without a reader, got %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("expected the pipe to be created: %v", err)
+	}
+}
+
+func TestSinkPipe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.pipe")
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	fw := newTestWatcher(t)
+	s := newTestSink(t, fw, SinkConfig{Type: SinkPipe, Path: path, Fields: []string{"path"}})
+	s.start()
+	s.publish(testEvent("/data/a"))
+
+	// Reads return EOF until the sink opened the pipe for writing
+	var data []byte
+	buf := make([]byte, 1024)
+	waitFor(t, 5*time.Second, func() bool {
+		n, _ := reader.Read(buf)
+		data = append(data, buf[:n]...)
+		return strings.HasSuffix(string(data), "\n")
+	})
+	if string(data) != `{"path":"/data/a"}`+"\n" {
+		t.Fatalf("unexpected line %q", data)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package watcher
+
+import "os"
+
+// openPipe opens a named pipe, e.g. \\.\pipe\events, for writing
+func openPipe(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY, 0)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package watcher
+
+import "os"
+
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
+
+func fileOwner(info os.FileInfo) (int, int) {
+	return -1, -1
+}
@@ -0,0 +1,99 @@
+package watcher
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// killWait bounds the wait for commands to exit after SIGKILL
+const killWait = 5 * time.Second
+
+// Shutdown stops watching and terminates the in-flight commands. With drain
+// set the events already received are handled first. Remaining commands are
+// sent signal and killed once timeout has elapsed.
+func (fw *FileWatcher) Shutdown(signal os.Signal, timeout time.Duration, drain bool) {
+	deadline := time.Now().Add(timeout)
+
+	fw.draining.Store(drain)
+	fw.stopOnce.Do(func() { close(fw.stopCh) })
+
+	if drain {
+		select {
+		case <-fw.doneCh:
+			if !waitGroup(&fw.pending, time.Until(deadline)) {
+				fw.logger.Warn("timed out draining queued events")
+			}
+		case <-time.After(time.Until(deadline)):
+			fw.logger.Warn("timed out draining events")
+		}
+		fw.draining.Store(false)
+	}
+
+	if fw.service != nil {
+		fw.service.stop(signal, time.Until(deadline))
+	}
+
+	fw.signalAll(signal)
+	if !fw.waitIdle(time.Until(deadline)) {
+		fw.logger.Warn("commands did not exit in time, killing them", "timeout", timeout)
+		fw.signalAll(os.Kill)
+		fw.waitIdle(killWait)
+	}
+
+	fw.Stop()
+}
+
+// Kill immediately kills the in-flight commands and stops watching
+func (fw *FileWatcher) Kill() {
+	fw.draining.Store(false)
+	fw.stopOnce.Do(func() { close(fw.stopCh) })
+	if fw.service != nil {
+		fw.service.stop(os.Kill, killWait)
+	}
+	fw.signalAll(os.Kill)
+	fw.waitIdle(killWait)
+	fw.Stop()
+}
+
+// signalAll sends signal to the process groups of all in-flight commands and
+// prevents new commands from being started
+func (fw *FileWatcher) signalAll(signal os.Signal) {
+	fw.runningLock.Lock()
+	defer fw.runningLock.Unlock()
+
+	fw.terminating = true
+	fw.signalRunningLocked(signal)
+}
+
+func (fw *FileWatcher) signalRunningLocked(signal os.Signal) {
+	for cmd := range fw.running {
+		if err := signalGroup(cmd.Process, signal); err != nil {
+			fw.logger.Debug("failed to signal command", "pid", cmd.Process.Pid, "error", err)
+		}
+	}
+}
+
+// waitIdle waits up to timeout for all in-flight commands to exit
+func (fw *FileWatcher) waitIdle(timeout time.Duration) bool {
+	return waitGroup(&fw.inflight, timeout)
+}
+
+// waitGroup waits up to timeout for wg
+func waitGroup(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,113 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startGroupCommand runs a command in the background that starts a child
+// writing its pid to a file, and returns the pid of the child along with a
+// channel closed once the command finished. With ignoreTerm the command
+// and its child ignore SIGTERM.
+func startGroupCommand(t *testing.T, ignoreTerm bool) (*FileWatcher, int, <-chan struct{}) {
+	t.Helper()
+
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	script := "sleep 30 & echo $! > " + pidFile + "; wait"
+	if ignoreTerm {
+		script = "trap '' TERM; " + script
+	}
+	fw := newCommandWatcher(t, "sh", []string{"-c", script})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fw.run(testEvent("/data/a"))
+	}()
+
+	var pid int
+	waitFor(t, 5*time.Second, func() bool {
+		data, err := os.ReadFile(pidFile)
+		if err != nil {
+			return false
+		}
+		pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		return err == nil
+	})
+	return fw, pid, done
+}
+
+// waitExited waits for the process with pid and the command to be gone
+func waitExited(t *testing.T, pid int, done <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not finish")
+	}
+	waitFor(t, 5*time.Second, func() bool { return processExited(pid) })
+}
+
+// processExited reports whether the process with pid is gone or a zombie
+// waiting to be reaped by init
+func processExited(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the command name in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestShutdownSignalsProcessGroup(t *testing.T) {
+	fw, pid, done := startGroupCommand(t, false)
+
+	start := time.Now()
+	fw.Shutdown(syscall.SIGTERM, 10*time.Second, false)
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("expected the signal to stop the command, took %s", took)
+	}
+	waitExited(t, pid, done)
+}
+
+func TestShutdownKillsAfterTimeout(t *testing.T) {
+	fw, pid, done := startGroupCommand(t, true)
+
+	start := time.Now()
+	fw.Shutdown(syscall.SIGTERM, 200*time.Millisecond, false)
+	if took := time.Since(start); took < 200*time.Millisecond || took > 5*time.Second {
+		t.Fatalf("expected the command to be killed after the timeout, took %s", took)
+	}
+	waitExited(t, pid, done)
+}
+
+func TestKillKillsProcessGroup(t *testing.T) {
+	fw, pid, done := startGroupCommand(t, true)
+
+	fw.Kill()
+	waitExited(t, pid, done)
+}
+
+func TestShutdownRejectsNewCommands(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "ran")
+	fw := newCommandWatcher(t, "touch", []string{out})
+
+	fw.Shutdown(syscall.SIGTERM, time.Second, false)
+	fw.run(testEvent("/data/a"))
+
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected no command to run after shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// maxSymlinkHops bounds the resolution of symlink chains
+const maxSymlinkHops = 40
+
+// addSymlinkWatches watches every directory holding a link on the way from
+// path to its target, as well as the directory of the target itself, so that
+// atomic swaps of any link in the chain (e.g. Kubernetes style "..data"
+// mounts) and writes to the target are seen
+func (fw *FileWatcher) addSymlinkWatches(path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", path, err)
+	}
+	if resolved == path {
+		return nil
+	}
+
+	dirs, err := symlinkDirs(path)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := fw.watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %v", dir, err)
+		}
+		if !containsString(fw.linkDirs[dir], path) {
+			fw.linkDirs[dir] = append(fw.linkDirs[dir], path)
+		}
+	}
+
+	if old, ok := fw.links[path]; ok {
+		delete(fw.targets, old)
+	}
+	fw.links[path] = resolved
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		fw.targets[resolved] = path
+		return fw.watcher.Add(filepath.Dir(resolved))
+	}
+	return nil
+}
+
+// checkLinks re-resolves the symlinked paths affected by an event and emits a
+// modify event for every path whose target was swapped
+func (fw *FileWatcher) checkLinks(event fsnotify.Event) {
+	for _, path := range fw.linkDirs[filepath.Dir(event.Name)] {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil || resolved == fw.links[path] {
+			continue
+		}
+
+		fw.logger.Info("symlink target changed",
+			"path", path,
+			"old_target", fw.links[path],
+			"new_target", resolved,
+		)
+
+		if err := fw.addSymlinkWatches(path); err != nil {
+			fw.logger.Error("failed to watch new symlink target", "path", path, "error", err)
+			continue
+		}
+
+		if info, err := os.Stat(resolved); err == nil && info.IsDir() {
+			if err := fw.rewatchDir(path); err != nil {
+				fw.logger.Error("failed to watch new symlink target", "path", path, "error", err)
+			}
+		}
+
+		fw.deliver(fsnotify.Event{Name: path, Op: fsnotify.Write})
+	}
+}
+
+// rewatchDir moves the watch of a symlinked directory to its new target.
+// inotify watches the inode the link resolved to when it was added, so the
+// path is removed and added again.
+func (fw *FileWatcher) rewatchDir(path string) error {
+	fw.watcher.Remove(path)
+	if fw.recursiveWatch {
+		return walkDirs(path, fw.watcher.Add)
+	}
+	return fw.watcher.Add(path)
+}
+
+// linkName maps an event on a symlink target back to the watched link
+func (fw *FileWatcher) linkName(name string) string {
+	if path, ok := fw.targets[name]; ok {
+		return path
+	}
+	return name
+}
+
+// symlinkDirs returns the directories containing the links traversed when
+// resolving path, including links in its parent directories
+func symlinkDirs(path string) ([]string, error) {
+	var dirs []string
+	hops := 0
+
+	var walk func(p string) error
+	walk = func(p string) error {
+		if hops++; hops > maxSymlinkHops {
+			return fmt.Errorf("too many levels of symbolic links: %s", path)
+		}
+
+		dir := filepath.Dir(p)
+		if dir != p {
+			if resolved, err := filepath.EvalSymlinks(dir); err == nil && resolved != dir {
+				if err := walk(dir); err != nil {
+					return err
+				}
+			}
+		}
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		if !containsString(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		return walk(target)
+	}
+
+	if err := walk(path); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// walkDirs calls fn for root and every directory below it, descending into
+// symlinked directories. Directories are tracked by their resolved path so
+// that symlink loops are only visited once.
+func walkDirs(root string, fn func(string) error) error {
+	visited := make(map[string]bool)
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		if visited[resolved] {
+			return nil
+		}
+		visited[resolved] = true
+
+		if err := fn(dir); err != nil {
+			return err
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			p := filepath.Join(dir, entry.Name())
+			if entry.Type()&os.ModeSymlink != 0 {
+				info, err := os.Stat(p)
+				if err != nil || !info.IsDir() {
+					continue
+				}
+			} else if !entry.IsDir() {
+				continue
+			}
+
+			if err := walk(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk(root)
+}
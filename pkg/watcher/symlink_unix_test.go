@@ -0,0 +1,109 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// symlink creates link pointing to target
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSymlinkDirsFollowsChain(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "target", "file"), "data")
+	for _, dir := range []string{"first", "second"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink(t, filepath.Join(root, "target", "file"), filepath.Join(root, "second", "link"))
+	symlink(t, "../second/link", filepath.Join(root, "first", "link"))
+
+	dirs, err := symlinkDirs(filepath.Join(root, "first", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "first"), filepath.Join(root, "second")}
+	if fmt.Sprint(dirs) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, dirs)
+	}
+}
+
+func TestSymlinkDirsDetectsLoop(t *testing.T) {
+	dir := t.TempDir()
+	symlink(t, "b", filepath.Join(dir, "a"))
+	symlink(t, "a", filepath.Join(dir, "b"))
+
+	_, err := symlinkDirs(filepath.Join(dir, "a"))
+	if err == nil || !strings.Contains(err.Error(), "too many levels of symbolic links") {
+		t.Fatalf("expected the loop to be detected, got %v", err)
+	}
+}
+
+func TestWalkDirsVisitsLoopOnce(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sub", "deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, root, filepath.Join(root, "sub", "deep", "back"))
+
+	var visited []string
+	err := walkDirs(root, func(dir string) error {
+		visited = append(visited, dir)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 3 {
+		t.Fatalf("expected root, sub and deep to be visited once, got %v", visited)
+	}
+}
+
+func TestFollowSymlinksDetectsLinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "v1", "config"), "one")
+	writeTestFile(t, filepath.Join(dir, "v2", "config"), "two")
+
+	// Kubernetes style mount: the file links through a data link that is
+	// atomically swapped to the next version
+	symlink(t, "v1", filepath.Join(dir, "..data"))
+	symlink(t, "..data/config", filepath.Join(dir, "config"))
+	path := filepath.Join(dir, "config")
+
+	metrics := newRecordingMetrics()
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), []string{path}, []string{"modify"}, "true", nil, nil, nil, false,
+		WithFollowSymlinks(), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.Stop)
+	if err := fw.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	symlink(t, "v2", filepath.Join(dir, "..data_tmp"))
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("dispatched modify") > 0 })
+
+	// Writes to the new target are reported for the link
+	swapped := metrics.count("dispatched modify")
+	writeTestFile(t, filepath.Join(dir, "v2", "config"), "three")
+	waitFor(t, 5*time.Second, func() bool { return metrics.count("dispatched modify") > swapped })
+}
@@ -0,0 +1,348 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SyslogUnix     = "unix"     // RFC 5424 to the local syslog socket
+	SyslogUDP      = "udp"      // RFC 5424 over UDP
+	SyslogJournald = "journald" // Native journald protocol with structured fields
+
+	defaultSyslogSocket   = "/dev/log"
+	defaultJournaldSocket = "/run/systemd/journal/socket"
+	defaultSyslogTag      = "nomad-filewatcher"
+	defaultSyslogFacility = "user"
+	defaultSyslogSeverity = "notice"
+
+	// syslogSDID identifies the structured data element of the events. 32473
+	// is the enterprise number reserved for documentation (RFC 5612).
+	syslogSDID = "watcher@32473"
+
+	syslogDialTimeout = 5 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3,
+	"warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// SyslogConfig describes the syslog or journald destination of the events
+type SyslogConfig struct {
+	Transport string // unix, udp or journald
+	Address   string // Socket path or host:port, defaults to the local socket
+	Tag       string // Application name of the messages
+	Facility  string // Default facility, e.g. user or local0
+	Severity  string // Default severity, e.g. notice
+	Rules     []SyslogRule
+}
+
+// SyslogRule overrides the facility and severity of matching events. The
+// first matching rule applies.
+type SyslogRule struct {
+	Pattern  string   // Glob matched against the file name, all files when empty
+	Events   []string // Event types, all types when empty
+	Facility string
+	Severity string
+}
+
+// Validate reports whether the syslog configuration is usable
+func (c SyslogConfig) Validate() error {
+	switch c.Transport {
+	case "", SyslogUnix, SyslogJournald:
+	case SyslogUDP:
+		if c.Address == "" {
+			return fmt.Errorf("syslog address must be specified for udp")
+		}
+	default:
+		return fmt.Errorf("invalid syslog transport: %s", c.Transport)
+	}
+	if err := validatePriority(c.Facility, c.Severity); err != nil {
+		return err
+	}
+	for _, rule := range c.Rules {
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid syslog rule pattern %q: %v", rule.Pattern, err)
+		}
+		for _, event := range rule.Events {
+			if !IsValidEventType(event) {
+				return fmt.Errorf("invalid syslog rule event: %s", event)
+			}
+		}
+		if err := validatePriority(rule.Facility, rule.Severity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePriority(facility, severity string) error {
+	if _, ok := syslogFacilities[facility]; facility != "" && !ok {
+		return fmt.Errorf("invalid syslog facility: %s", facility)
+	}
+	if _, ok := syslogSeverities[severity]; severity != "" && !ok {
+		return fmt.Errorf("invalid syslog severity: %s", severity)
+	}
+	return nil
+}
+
+type syslogWriter struct {
+	fw       *FileWatcher
+	cfg      SyslogConfig
+	hostname string
+
+	lock    sync.Mutex
+	conn    net.Conn
+	network string
+}
+
+func newSyslogWriter(fw *FileWatcher, cfg SyslogConfig) (*syslogWriter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Transport == "" {
+		cfg.Transport = SyslogUnix
+	}
+	if cfg.Address == "" {
+		cfg.Address = defaultSyslogSocket
+		if cfg.Transport == SyslogJournald {
+			cfg.Address = defaultJournaldSocket
+		}
+	}
+	if cfg.Tag == "" {
+		cfg.Tag = defaultSyslogTag
+	}
+	if cfg.Facility == "" {
+		cfg.Facility = defaultSyslogFacility
+	}
+	if cfg.Severity == "" {
+		cfg.Severity = defaultSyslogSeverity
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &syslogWriter{fw: fw, cfg: cfg, hostname: hostname}, nil
+}
+
+// Handle writes event to syslog or journald
+func (s *syslogWriter) Handle(event *Event) error {
+	facility, severity := s.priority(event)
+
+	var msg []byte
+	if s.cfg.Transport == SyslogJournald {
+		msg = s.journalEntry(event, facility, severity)
+	} else {
+		msg = s.rfc5424(event, facility, severity)
+	}
+
+	if err := s.write(msg); err != nil {
+		return fmt.Errorf("failed to write to %s %s: %v", s.cfg.Transport, s.cfg.Address, err)
+	}
+	return nil
+}
+
+// Close closes the connection
+func (s *syslogWriter) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// priority returns the facility and severity codes of event
+func (s *syslogWriter) priority(event *Event) (int, int) {
+	facility, severity := s.cfg.Facility, s.cfg.Severity
+	for _, rule := range s.cfg.Rules {
+		if !rule.matches(event) {
+			continue
+		}
+		if rule.Facility != "" {
+			facility = rule.Facility
+		}
+		if rule.Severity != "" {
+			severity = rule.Severity
+		}
+		break
+	}
+	return syslogFacilities[facility], syslogSeverities[severity]
+}
+
+func (r SyslogRule) matches(event *Event) bool {
+	if len(r.Events) > 0 && !containsString(r.Events, string(event.Type)) {
+		return false
+	}
+	if r.Pattern != "" {
+		matched, _ := filepath.Match(r.Pattern, filepath.Base(event.Path))
+		return matched
+	}
+	return true
+}
+
+// message returns the human readable text of event
+func (s *syslogWriter) message(event *Event) string {
+	if event.OldPath != "" {
+		return fmt.Sprintf("file %s: %s (from %s)", event.Type, event.Path, event.OldPath)
+	}
+	return fmt.Sprintf("file %s: %s", event.Type, event.Path)
+}
+
+// rfc5424 formats event as an RFC 5424 message with the event fields as
+// structured data
+func (s *syslogWriter) rfc5424(event *Event, facility, severity int) []byte {
+	params := [][2]string{
+		{"path", event.Path},
+		{"op", string(event.Type)},
+		{"root", event.Root},
+		{"rel_path", event.RelPath},
+		{"sequence", fmt.Sprintf("%d", event.Sequence)},
+	}
+	if event.OldPath != "" {
+		params = append(params, [2]string{"old_path", event.OldPath})
+	}
+	if event.AllocID != "" {
+		params = append(params, [2]string{"alloc_id", event.AllocID})
+	}
+	if event.TaskID != "" {
+		params = append(params, [2]string{"task_id", event.TaskID})
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s [%s",
+		facility*8+severity,
+		event.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.cfg.Tag,
+		os.Getpid(),
+		event.Type,
+		syslogSDID,
+	)
+	for _, param := range params {
+		fmt.Fprintf(&buf, ` %s="%s"`, param[0], escapeSDParam(param[1]))
+	}
+	buf.WriteString("] ")
+	buf.WriteString(s.message(event))
+	return buf.Bytes()
+}
+
+// escapeSDParam escapes the characters RFC 5424 reserves in parameter values
+func escapeSDParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// journalEntry formats event in the journald native protocol
+func (s *syslogWriter) journalEntry(event *Event, facility, severity int) []byte {
+	fields := [][2]string{
+		{"MESSAGE", s.message(event)},
+		{"PRIORITY", fmt.Sprintf("%d", severity)},
+		{"SYSLOG_FACILITY", fmt.Sprintf("%d", facility)},
+		{"SYSLOG_IDENTIFIER", s.cfg.Tag},
+		{"WATCHER_PATH", event.Path},
+		{"WATCHER_OP", string(event.Type)},
+		{"WATCHER_ROOT", event.Root},
+		{"WATCHER_REL_PATH", event.RelPath},
+		{"WATCHER_SEQUENCE", fmt.Sprintf("%d", event.Sequence)},
+	}
+	if event.OldPath != "" {
+		fields = append(fields, [2]string{"WATCHER_OLD_PATH", event.OldPath})
+	}
+	if event.AllocID != "" {
+		fields = append(fields, [2]string{"NOMAD_ALLOC_ID", event.AllocID})
+	}
+	if event.TaskID != "" {
+		fields = append(fields, [2]string{"NOMAD_TASK_ID", event.TaskID})
+	}
+
+	var buf bytes.Buffer
+	for _, field := range fields {
+		if !strings.Contains(field[1], "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", field[0], field[1])
+			continue
+		}
+		// Values with newlines are length prefixed
+		buf.WriteString(field[0])
+		buf.WriteByte('\n')
+		binary.Write(&buf, binary.LittleEndian, uint64(len(field[1])))
+		buf.WriteString(field[1])
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// write sends msg, reconnecting once when the connection is broken
+func (s *syslogWriter) write(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.dial(); err != nil {
+				continue
+			}
+		}
+
+		frame := msg
+		if s.network == "unix" {
+			// Stream sockets need framing between messages
+			frame = append(append([]byte{}, msg...), '\n')
+		}
+		if _, err = s.conn.Write(frame); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *syslogWriter) dial() error {
+	if s.cfg.Transport == SyslogUDP {
+		conn, err := net.DialTimeout("udp", s.cfg.Address, syslogDialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn, s.network = conn, "udp"
+		return nil
+	}
+
+	// The local syslog socket is usually a datagram socket, journald always
+	// is one
+	conn, err := net.DialTimeout("unixgram", s.cfg.Address, syslogDialTimeout)
+	if err == nil {
+		s.conn, s.network = conn, "unixgram"
+		return nil
+	}
+	if s.cfg.Transport == SyslogJournald {
+		return err
+	}
+	conn, err = net.DialTimeout("unix", s.cfg.Address, syslogDialTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.network = conn, "unix"
+	return nil
+}
@@ -0,0 +1,256 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenUnixgram returns a datagram socket in a short temporary directory,
+// as socket paths are limited to about 100 bytes
+func listenUnixgram(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, path
+}
+
+func readDatagram(t *testing.T, conn net.PacketConn) []byte {
+	t.Helper()
+
+	buf := make([]byte, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func syslogEvent() *Event {
+	return &Event{
+		Sequence:  7,
+		Type:      EventRename,
+		Path:      "/data/in/report.csv",
+		OldPath:   `/data/tmp/re"port].csv`,
+		Root:      "/data/in",
+		RelPath:   "report.csv",
+		AllocID:   "alloc-1",
+		Timestamp: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+	}
+}
+
+func TestSyslogRFC5424(t *testing.T) {
+	conn, path := listenUnixgram(t)
+	fw := newTestWatcher(t)
+
+	s, err := newSyslogWriter(fw, SyslogConfig{
+		Address:  path,
+		Tag:      "uploads",
+		Facility: "local3",
+		Rules: []SyslogRule{
+			{Pattern: "*.tmp", Severity: "debug"},
+			{Pattern: "*.csv", Events: []string{"rename"}, Severity: "warning"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Handle(syslogEvent()); err != nil {
+		t.Fatal(err)
+	}
+
+	// local3 (19) * 8 + warning (4)
+	want := fmt.Sprintf(`<156>1 2024-05-01T12:30:00.000000Z %s uploads %d rename `+
+		`[watcher@32473 path="/data/in/report.csv" op="rename" root="/data/in" rel_path="report.csv" sequence="7" `+
+		`old_path="/data/tmp/re\"port\].csv" alloc_id="alloc-1"] `+
+		`file rename: /data/in/report.csv (from /data/tmp/re"port].csv)`, s.hostname, os.Getpid())
+	if got := string(readDatagram(t, conn)); got != want {
+		t.Fatalf("unexpected message\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestSyslogDefaultPriority(t *testing.T) {
+	conn, path := listenUnixgram(t)
+	fw := newTestWatcher(t)
+
+	s, err := newSyslogWriter(fw, SyslogConfig{Address: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Handle(testEvent("/data/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// user (1) * 8 + notice (5)
+	if got := string(readDatagram(t, conn)); !strings.HasPrefix(got, "<13>1 ") || !strings.Contains(got, " nomad-filewatcher ") {
+		t.Fatalf("unexpected message: %s", got)
+	}
+}
+
+func TestSyslogJournaldFraming(t *testing.T) {
+	conn, path := listenUnixgram(t)
+	fw := newTestWatcher(t)
+
+	s, err := newSyslogWriter(fw, SyslogConfig{
+		Transport: SyslogJournald,
+		Address:   path,
+		Severity:  "info",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	event := syslogEvent()
+	event.Path = "/data/in/multi\nline.csv"
+	if err := s.Handle(event); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := parseJournalEntry(t, readDatagram(t, conn))
+	want := map[string]string{
+		"MESSAGE":           `file rename: /data/in/multi` + "\n" + `line.csv (from /data/tmp/re"port].csv)`,
+		"PRIORITY":          "6",
+		"SYSLOG_FACILITY":   "1",
+		"SYSLOG_IDENTIFIER": "nomad-filewatcher",
+		"WATCHER_PATH":      "/data/in/multi\nline.csv",
+		"WATCHER_OP":        "rename",
+		"WATCHER_OLD_PATH":  `/data/tmp/re"port].csv`,
+		"WATCHER_SEQUENCE":  "7",
+		"NOMAD_ALLOC_ID":    "alloc-1",
+	}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("field %s: expected %q, got %q", key, value, fields[key])
+		}
+	}
+}
+
+// parseJournalEntry decodes the journald native protocol, including the
+// length prefixed binary fields
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			t.Fatalf("unterminated field: %q", data)
+		}
+		line := data[:i]
+		data = data[i+1:]
+
+		if key, value, ok := bytes.Cut(line, []byte{'='}); ok {
+			fields[string(key)] = string(value)
+			continue
+		}
+
+		if len(data) < 8 {
+			t.Fatalf("missing length of field %s", line)
+		}
+		size := binary.LittleEndian.Uint64(data[:8])
+		data = data[8:]
+		if uint64(len(data)) < size+1 || data[size] != '\n' {
+			t.Fatalf("invalid binary field %s", line)
+		}
+		fields[string(line)] = string(data[:size])
+		data = data[size+1:]
+	}
+	return fields
+}
+
+func TestSyslogStreamSocketFraming(t *testing.T) {
+	dir, err := os.MkdirTemp("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fw := newTestWatcher(t)
+	s, err := newSyslogWriter(fw, SyslogConfig{Address: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, p := range []string{"/data/a", "/data/b"} {
+		if err := s.Handle(testEvent(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for _, p := range []string{"/data/a", "/data/b"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(line, "file create: "+p+"\n") {
+			t.Fatalf("expected a newline framed message for %s, got %q", p, line)
+		}
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fw := newTestWatcher(t)
+	s, err := newSyslogWriter(fw, SyslogConfig{
+		Transport: SyslogUDP,
+		Address:   conn.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Handle(testEvent("/data/a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readDatagram(t, conn)); !strings.HasSuffix(got, "] file create: /data/a") {
+		t.Fatalf("expected an unframed datagram, got %q", got)
+	}
+}
@@ -0,0 +1,281 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxTailRead bounds the bytes read from a tailed file at once. Lines longer
+// than this are split.
+const maxTailRead = 1024 * 1024
+
+// TailConfig controls log-tail mode
+type TailConfig struct {
+	StateFile    string // File where read offsets are persisted
+	BatchSize    int    // Maximum number of lines per command invocation, 0 for unlimited
+	DrainRotated bool   // Finish reading a rotated file before following its replacement
+}
+
+type tailOffset struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// tailer tracks per-file read offsets so that only newly appended lines are
+// passed to the command
+type tailer struct {
+	lock         sync.Mutex
+	stateFile    string
+	batchSize    int
+	drainRotated bool
+	offsets      map[string]*tailOffset
+	files        map[string]*os.File
+}
+
+func newTailer(cfg TailConfig) *tailer {
+	return &tailer{
+		stateFile:    cfg.StateFile,
+		batchSize:    cfg.BatchSize,
+		drainRotated: cfg.DrainRotated,
+		offsets:      make(map[string]*tailOffset),
+		files:        make(map[string]*os.File),
+	}
+}
+
+// restore loads previously persisted offsets
+func (t *tailer) restore() error {
+	if t.stateFile == "" {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	data, err := os.ReadFile(t.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tail state: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &t.offsets); err != nil {
+		return fmt.Errorf("failed to unmarshal tail state: %v", err)
+	}
+	return nil
+}
+
+// seek positions path at its current end unless an offset for the same inode
+// was restored, so existing content is not replayed on start
+func (t *tailer) seek(path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	inode := fileInode(info)
+	if off, ok := t.offsets[path]; ok && off.Inode == inode && off.Offset <= info.Size() {
+		return
+	}
+	t.offsets[path] = &tailOffset{Inode: inode, Offset: info.Size()}
+}
+
+// read returns the complete lines appended to path since the last read, up
+// to maxTailRead bytes. more reports that further lines are pending.
+// Truncation (copytruncate rotation) and replacement of the file with a new
+// inode (create rotation) restart reading at the beginning of the file. With
+// draining enabled the remaining lines of a replaced file are returned first.
+func (t *tailer) read(path string) (lines []string, more bool, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, false, nil
+	}
+
+	inode := fileInode(info)
+	off, ok := t.offsets[path]
+	if ok && off.Inode != inode {
+		lines = t.drainLocked(path)
+	}
+	if !ok || off.Inode != inode || info.Size() < off.Offset {
+		off = &tailOffset{Inode: inode}
+		t.offsets[path] = off
+	}
+
+	f, err := t.fileLocked(path, inode)
+	if err != nil {
+		return lines, false, err
+	}
+
+	appended, n, err := readLines(f, off.Offset)
+	if err != nil {
+		return lines, false, err
+	}
+	lines = append(lines, appended...)
+	if n == 0 {
+		return lines, false, nil
+	}
+
+	off.Offset += n
+	return lines, off.Offset < info.Size(), t.persistLocked()
+}
+
+// release drops the offset of a removed or renamed file and returns the
+// lines drained from it
+func (t *tailer) release(path string) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	lines := t.drainLocked(path)
+	if _, ok := t.offsets[path]; ok {
+		delete(t.offsets, path)
+		t.persistLocked()
+	}
+	return lines
+}
+
+// close releases all open file handles
+func (t *tailer) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for path, f := range t.files {
+		f.Close()
+		delete(t.files, path)
+	}
+}
+
+// fileLocked returns an open handle of path for inode, reopening the file
+// when it was replaced
+func (t *tailer) fileLocked(path string, inode uint64) (*os.File, error) {
+	if f, ok := t.files[path]; ok {
+		if info, err := f.Stat(); err == nil && fileInode(info) == inode {
+			return f, nil
+		}
+		f.Close()
+		delete(t.files, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t.files[path] = f
+	return f, nil
+}
+
+// drainLocked closes the handle previously opened for path. With draining
+// enabled the lines appended to it since the last read are returned, up to
+// maxTailRead bytes, which still works after the file was renamed away.
+func (t *tailer) drainLocked(path string) []string {
+	f, ok := t.files[path]
+	if !ok {
+		return nil
+	}
+	delete(t.files, path)
+	defer f.Close()
+
+	off, ok := t.offsets[path]
+	if !t.drainRotated || !ok {
+		return nil
+	}
+
+	info, err := f.Stat()
+	if err != nil || fileInode(info) != off.Inode {
+		return nil
+	}
+
+	lines, _, err := readLines(f, off.Offset)
+	if err != nil {
+		return nil
+	}
+	return lines
+}
+
+// batches splits lines into chunks of at most batchSize lines
+func (t *tailer) batches(lines []string) [][]string {
+	if t.batchSize <= 0 || len(lines) <= t.batchSize {
+		return [][]string{lines}
+	}
+
+	var result [][]string
+	for len(lines) > t.batchSize {
+		result = append(result, lines[:t.batchSize])
+		lines = lines[t.batchSize:]
+	}
+	return append(result, lines)
+}
+
+func (t *tailer) persistLocked() error {
+	if t.stateFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(t.offsets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tail state: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.stateFile), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	tmp := t.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write tail state: %v", err)
+	}
+	return os.Rename(tmp, t.stateFile)
+}
+
+// readLines reads the complete lines of f starting at offset, up to
+// maxTailRead bytes. A trailing partial line is left for the next read unless
+// it fills the whole chunk. It returns the lines and the number of bytes
+// consumed.
+func readLines(f *os.File, offset int64) ([]string, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if info.Size() <= offset {
+		return nil, 0, nil
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	data := make([]byte, min(info.Size()-offset, maxTailRead))
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, 0, err
+	}
+	data = data[:n]
+
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		if n < maxTailRead {
+			return nil, 0, nil
+		}
+		// Split a line that does not fit into one read
+		return []string{string(data)}, int64(n), nil
+	}
+
+	var lines []string
+	for _, line := range bytes.Split(data[:end], []byte{'\n'}) {
+		lines = append(lines, string(bytes.TrimSuffix(line, []byte{'\r'})))
+	}
+	return lines, int64(end + 1), nil
+}
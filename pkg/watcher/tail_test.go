@@ -0,0 +1,108 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTailReadIsBounded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	line := strings.Repeat("x", 1023)
+	count := 3 * maxTailRead / 1024
+	if err := os.WriteFile(path, []byte(strings.Repeat(line+"\n", count)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tail := newTailer(TailConfig{})
+	tail.offsets[path] = &tailOffset{Inode: fileInode(mustStat(t, path))}
+	defer tail.close()
+
+	total := 0
+	for reads := 1; ; reads++ {
+		lines, more, err := tail.read(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines)*1024 > maxTailRead {
+			t.Fatalf("read %d lines at once", len(lines))
+		}
+		total += len(lines)
+		if !more {
+			break
+		}
+		if reads > count {
+			t.Fatal("read does not make progress")
+		}
+	}
+	if total != count {
+		t.Fatalf("expected %d lines, got %d", count, total)
+	}
+}
+
+func TestTailReadSplitsOversizedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	data := strings.Repeat("x", maxTailRead+10) + "\nnext\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tail := newTailer(TailConfig{})
+	tail.offsets[path] = &tailOffset{Inode: fileInode(mustStat(t, path))}
+	defer tail.close()
+
+	lines, more, err := tail.read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || len(lines[0]) != maxTailRead || !more {
+		t.Fatalf("expected the first chunk of the line, got %d lines", len(lines))
+	}
+
+	lines, _, err = tail.read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0] != strings.Repeat("x", 10) || lines[1] != "next" {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+}
+
+func TestTailReadKeepsPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("one\ntw"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tail := newTailer(TailConfig{})
+	tail.offsets[path] = &tailOffset{Inode: fileInode(mustStat(t, path))}
+	defer tail.close()
+
+	lines, _, err := tail.read(path)
+	if err != nil || len(lines) != 1 || lines[0] != "one" {
+		t.Fatalf("unexpected lines %q: %v", lines, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("o\n")
+	f.Close()
+
+	lines, _, err = tail.read(path)
+	if err != nil || len(lines) != 1 || lines[0] != "two" {
+		t.Fatalf("unexpected lines %q: %v", lines, err)
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
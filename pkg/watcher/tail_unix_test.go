@@ -0,0 +1,114 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendTestFile appends data to the file at path
+func appendTestFile(t *testing.T, path, data string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rotateTestFile reads path once, appends a line to it, renames it away and
+// creates a new file in its place, returning the lines read afterwards
+func rotateTestFile(t *testing.T, drain bool) []string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeTestFile(t, path, "one\n")
+
+	tail := newTailer(TailConfig{DrainRotated: drain})
+	tail.offsets[path] = &tailOffset{Inode: fileInode(mustStat(t, path))}
+	defer tail.close()
+
+	lines, _, err := tail.read(path)
+	if err != nil || fmt.Sprint(lines) != "[one]" {
+		t.Fatalf("unexpected lines %q: %v", lines, err)
+	}
+
+	appendTestFile(t, path, "two\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, "three\n")
+
+	lines, _, err = tail.read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestTailDrainsRotatedFile(t *testing.T) {
+	if lines := rotateTestFile(t, true); fmt.Sprint(lines) != "[two three]" {
+		t.Fatalf("expected the rest of the rotated file before the new one, got %q", lines)
+	}
+}
+
+func TestTailSkipsRotatedFileWithoutDrain(t *testing.T) {
+	if lines := rotateTestFile(t, false); fmt.Sprint(lines) != "[three]" {
+		t.Fatalf("expected only the new file, got %q", lines)
+	}
+}
+
+func TestTailRestartsAfterTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeTestFile(t, path, "one\ntwo\n")
+
+	tail := newTailer(TailConfig{DrainRotated: true})
+	tail.offsets[path] = &tailOffset{Inode: fileInode(mustStat(t, path))}
+	defer tail.close()
+
+	if _, _, err := tail.read(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// copytruncate keeps the inode and starts over with a shorter file
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendTestFile(t, path, "new\n")
+
+	lines, _, err := tail.read(path)
+	if err != nil || fmt.Sprint(lines) != "[new]" {
+		t.Fatalf("expected reading to restart at the beginning, got %q: %v", lines, err)
+	}
+}
+
+func TestTailReleaseDrainsRenamedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeTestFile(t, path, "one\n")
+
+	tail := newTailer(TailConfig{DrainRotated: true})
+	tail.offsets[path] = &tailOffset{Inode: fileInode(mustStat(t, path))}
+	defer tail.close()
+
+	if _, _, err := tail.read(path); err != nil {
+		t.Fatal(err)
+	}
+	appendTestFile(t, path, "two\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := tail.release(path); fmt.Sprint(lines) != "[two]" {
+		t.Fatalf("expected the lines appended before the rename, got %q", lines)
+	}
+	if _, ok := tail.offsets[path]; ok {
+		t.Fatal("expected the offset to be dropped")
+	}
+}
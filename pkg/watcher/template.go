@@ -0,0 +1,171 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateData is the event data available to exec_args, environment and
+// working_dir templates
+type TemplateData struct {
+	Path    string    // Absolute path of the file
+	Dir     string    // Directory containing the file
+	Base    string    // File name
+	Ext     string    // File extension including the dot
+	RelPath string    // Path relative to the watched root
+	Root    string    // Watched root covering the file
+	Op      string    // Event type (create, modify, remove, rename, chmod)
+	Time    time.Time // Time the event was received
+}
+
+// templateFuncs are the helpers available in templates. Arguments are passed
+// to the command directly and never through a shell; shellquote is provided
+// for commands that hand their arguments to one.
+var templateFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trimSuffix": func(suffix, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	},
+}
+
+// sampleEvent is rendered by the validation of templates so that unknown
+// fields are reported up front instead of on every event
+var sampleEvent = &Event{
+	SchemaVersion: EventSchemaVersion,
+	Sequence:      1,
+	Type:          EventModify,
+	Op:            "WRITE",
+	Path:          "/data/dir/file.txt",
+	RelPath:       "dir/file.txt",
+	Root:          "/data",
+	OldPath:       "/data/dir/old.txt",
+	File:          &FileInfo{Mode: "0644"},
+	Timestamp:     time.Unix(0, 0),
+}
+
+// ValidateTemplate reports whether text is a valid command template, by
+// rendering it for a sample event
+func ValidateTemplate(text string) error {
+	return validateTemplate(text, sampleEvent.templateData())
+}
+
+// validateTemplate parses text and renders it with data
+func validateTemplate(text string, data interface{}) error {
+	tmpl, err := parseTemplate("template", text)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, data); err != nil {
+		return fmt.Errorf("invalid template %q: %v", text, err)
+	}
+	return nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(templateFuncs).
+		Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %q: %v", text, err)
+	}
+	return tmpl, nil
+}
+
+// commandTemplate renders the per event arguments, environment and working
+// directory of the command
+type commandTemplate struct {
+	args       []*template.Template
+	envKeys    []string
+	env        map[string]*template.Template
+	workingDir *template.Template
+}
+
+func newCommandTemplate(args []string, env map[string]string, workingDir string) (*commandTemplate, error) {
+	ct := &commandTemplate{env: make(map[string]*template.Template)}
+
+	for i, arg := range args {
+		tmpl, err := parseTemplate(fmt.Sprintf("exec_args[%d]", i), arg)
+		if err != nil {
+			return nil, err
+		}
+		ct.args = append(ct.args, tmpl)
+	}
+
+	for k, v := range env {
+		tmpl, err := parseTemplate("environment."+k, v)
+		if err != nil {
+			return nil, err
+		}
+		ct.env[k] = tmpl
+		ct.envKeys = append(ct.envKeys, k)
+	}
+	sort.Strings(ct.envKeys)
+
+	if workingDir != "" {
+		tmpl, err := parseTemplate("working_dir", workingDir)
+		if err != nil {
+			return nil, err
+		}
+		ct.workingDir = tmpl
+	}
+
+	return ct, nil
+}
+
+// render executes the templates for an event
+func (ct *commandTemplate) render(data TemplateData) ([]string, []string, string, error) {
+	args := make([]string, 0, len(ct.args))
+	for _, tmpl := range ct.args {
+		arg, err := execute(tmpl, data)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		args = append(args, arg)
+	}
+
+	env := make([]string, 0, len(ct.envKeys))
+	for _, k := range ct.envKeys {
+		v, err := execute(ct.env[k], data)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	var dir string
+	if ct.workingDir != nil {
+		var err error
+		if dir, err = execute(ct.workingDir, data); err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	return args, env, dir, nil
+}
+
+func execute(tmpl *template.Template, data TemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %v", tmpl.Name(), err)
+	}
+	if strings.IndexByte(buf.String(), 0) >= 0 {
+		return "", fmt.Errorf("failed to render %s: result contains a NUL byte", tmpl.Name())
+	}
+	return buf.String(), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -1,10 +1,17 @@
 package watcher
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/hashicorp/go-hclog"
@@ -18,9 +25,53 @@ type FileWatcher struct {
 	execCommand    string
 	execArgs       []string
 	environment    map[string]string
+	workingDir     string
+	stdin          string
+	output         *taskOutput
+	exec           *execContext
+	taskID         string
+	allocID        string
+	sequence       uint64
+	lastRename     string
+	lastRenameAt   time.Time
+	renamedFrom    string
+	command        *commandTemplate
 	ignorePatterns []string
 	recursiveWatch bool
+	files          map[string]bool
+	dirs           []string
+	followSymlinks bool
+	links          map[string]string
+	targets        map[string]string
+	linkDirs       map[string][]string
+	hashes         *hashCache
+	tail           *tailer
+	match          *matcher
+	service        *service
+	sink           *sink
+	concurrency    string
+	maxConcurrent  int
+	slots          chan struct{}
+	timeout        time.Duration
+	queueLock      sync.Mutex
+	queues         map[string]*pathQueue
+	pending        sync.WaitGroup
+	actions        []Action
+	actionsOnce    sync.Once
+	taskEvents     TaskEventFunc
 	stopCh         chan struct{}
+	stopOnce       sync.Once
+	doneCh         chan struct{}
+	draining       atomic.Bool
+	runningLock    sync.Mutex
+	running        map[*exec.Cmd]*runningCommand
+	inflight       sync.WaitGroup
+	terminating    bool
+	paused         atomic.Bool
+	rescanCh       chan chan error
+	counters       counters
+	metrics        Metrics
+	written        *writeTracker
 }
 
 func NewFileWatcher(
@@ -32,13 +83,14 @@ func NewFileWatcher(
 	environment map[string]string,
 	ignorePatterns []string,
 	recursiveWatch bool,
+	opts ...Option,
 ) (*FileWatcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create watcher: %v", err)
 	}
 
-	return &FileWatcher{
+	fw := &FileWatcher{
 		watcher:        watcher,
 		logger:         logger,
 		paths:          paths,
@@ -48,15 +100,64 @@ func NewFileWatcher(
 		environment:    environment,
 		ignorePatterns: ignorePatterns,
 		recursiveWatch: recursiveWatch,
+		files:          make(map[string]bool),
+		links:          make(map[string]string),
+		targets:        make(map[string]string),
+		linkDirs:       make(map[string][]string),
 		stopCh:         make(chan struct{}),
-	}, nil
+		doneCh:         make(chan struct{}),
+		running:        make(map[*exec.Cmd]*runningCommand),
+		rescanCh:       make(chan chan error),
+		concurrency:    ConcurrencyQueue,
+		queues:         make(map[string]*pathQueue),
+		metrics:        nopMetrics{},
+		written:        newWriteTracker(),
+	}
+
+	for _, opt := range opts {
+		if err := opt(fw); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	// Tailed lines must be handed to the command in order
+	if fw.tail != nil && fw.concurrency != ConcurrencyQueue {
+		watcher.Close()
+		return nil, fmt.Errorf("tail requires the %s concurrency policy", ConcurrencyQueue)
+	}
+
+	if fw.maxConcurrent > 0 {
+		fw.slots = make(chan struct{}, fw.maxConcurrent)
+	}
+
+	fw.command, err = newCommandTemplate(execArgs, environment, fw.workingDir)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return fw, nil
 }
 
-func (fw *FileWatcher) Start() error {
+func (fw *FileWatcher) Start() (err error) {
 	if fw.watcher == nil {
 		return fmt.Errorf("watcher not initialized")
 	}
 
+	// Release the sink, tail state, match timers and actions set up so far
+	defer func() {
+		if err != nil {
+			fw.Cleanup()
+		}
+	}()
+
+	if fw.tail != nil {
+		if err := fw.tail.restore(); err != nil {
+			return err
+		}
+	}
+
 	// Add paths to watch
 	for _, path := range fw.paths {
 		if !filepath.IsAbs(path) {
@@ -70,6 +171,28 @@ func (fw *FileWatcher) Start() error {
 		if err := fw.addWatch(path); err != nil {
 			return err
 		}
+
+		if fw.hashes != nil {
+			fw.walkFiles(path, fw.hashes.prime)
+		}
+
+		if fw.tail != nil {
+			fw.walkFiles(path, fw.tail.seek)
+		}
+	}
+
+	if fw.sink != nil {
+		fw.sink.start()
+	}
+
+	if err := fw.startActions(); err != nil {
+		return err
+	}
+
+	if fw.service != nil {
+		if err := fw.service.start(); err != nil {
+			return err
+		}
 	}
 
 	go fw.watch()
@@ -77,6 +200,31 @@ func (fw *FileWatcher) Start() error {
 }
 
 func (fw *FileWatcher) addWatch(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if fw.followSymlinks {
+		if err := fw.addSymlinkWatches(path); err != nil {
+			return err
+		}
+	}
+
+	// Single files are watched through their parent directory so that the
+	// watch follows the path when the file is renamed or replaced, e.g. by
+	// logrotate, instead of sticking to the old inode
+	if !info.IsDir() {
+		fw.files[path] = true
+		return fw.watcher.Add(filepath.Dir(path))
+	}
+
+	if !containsString(fw.dirs, path) {
+		fw.dirs = append(fw.dirs, path)
+	}
+	if fw.recursiveWatch && fw.followSymlinks {
+		return walkDirs(path, fw.watcher.Add)
+	}
 	if fw.recursiveWatch {
 		return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
 			if err != nil {
@@ -91,38 +239,177 @@ func (fw *FileWatcher) addWatch(path string) error {
 	return fw.watcher.Add(path)
 }
 
+// walkFiles calls fn for every regular file covered by the watch on path
+func (fw *FileWatcher) walkFiles(path string, fn func(string)) {
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if p != path && !fw.recursiveWatch {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			fn(p)
+		}
+		return nil
+	})
+}
+
 func (fw *FileWatcher) watch() {
+	defer close(fw.doneCh)
+
 	for {
 		select {
 		case event, ok := <-fw.watcher.Events:
 			if !ok {
 				return
 			}
-			if fw.shouldHandle(event) {
-				fw.handleEvent(event)
-			}
+			fw.process(event)
 		case err, ok := <-fw.watcher.Errors:
 			if !ok {
 				return
 			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				fw.metrics.Overflow()
+			}
 			fw.logger.Error("watcher error", "error", err)
+		case reply := <-fw.rescanCh:
+			reply <- fw.rescan()
 		case <-fw.stopCh:
+			if fw.draining.Load() {
+				fw.drain()
+			}
 			return
 		}
 	}
 }
 
+// drain handles the events already received before the watcher stopped
+func (fw *FileWatcher) drain() {
+	for fw.draining.Load() {
+		select {
+		case event, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			fw.process(event)
+		default:
+			return
+		}
+	}
+}
+
+func (fw *FileWatcher) process(event fsnotify.Event) {
+	if fw.stopping() && !fw.draining.Load() {
+		return
+	}
+
+	if fw.followSymlinks {
+		fw.checkLinks(event)
+		event.Name = fw.linkName(event.Name)
+	}
+	fw.trackRename(event)
+	fw.deliver(event)
+}
+
+// deliver filters event and hands it to the handlers unless dispatch is
+// paused
+func (fw *FileWatcher) deliver(event fsnotify.Event) {
+	if !fw.shouldHandle(event) {
+		return
+	}
+	if fw.paused.Load() {
+		fw.counters.suppressed.Add(1)
+		fw.metrics.EventFiltered(fw.rootFor(event.Name), eventToString(event))
+		fw.logger.Debug("dispatch paused, skipping event", "path", event.Name)
+		return
+	}
+	fw.handleEvent(event)
+}
+
+func (fw *FileWatcher) stopping() bool {
+	select {
+	case <-fw.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// isWatched reports whether name is covered by one of the configured paths,
+// filtering out siblings of single files seen through the parent watch
+func (fw *FileWatcher) isWatched(name string) bool {
+	if fw.files[name] {
+		return true
+	}
+
+	for _, dir := range fw.dirs {
+		if name == dir || filepath.Dir(name) == dir {
+			return true
+		}
+		if fw.recursiveWatch && strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored reports whether the name of path matches an ignore pattern
+func (fw *FileWatcher) ignored(path string) bool {
+	for _, pattern := range fw.ignorePatterns {
+		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func (fw *FileWatcher) shouldHandle(event fsnotify.Event) bool {
+	if !fw.isWatched(event.Name) {
+		return false
+	}
+
+	eventType, rule := eventToString(event), fw.rootFor(event.Name)
+	fw.metrics.EventReceived(rule, eventType)
+	if !fw.accepts(event, eventType) {
+		fw.metrics.EventFiltered(rule, eventType)
+		return false
+	}
+	return true
+}
+
+// accepts applies the event type, ignore pattern and content hash filters
+func (fw *FileWatcher) accepts(event fsnotify.Event, eventType string) bool {
 	// Check if event type is in our list
-	eventType := eventToString(event)
 	if !containsString(fw.events, eventType) {
 		return false
 	}
 
-	// Check ignore patterns
-	for _, pattern := range fw.ignorePatterns {
-		if matched, _ := filepath.Match(pattern, filepath.Base(event.Name)); matched {
-			return false
+	if fw.ignored(event.Name) {
+		return false
+	}
+
+	if fw.written.contains(event.Name) {
+		fw.logger.Debug("file written by the watcher, suppressing event", "path", event.Name)
+		return false
+	}
+
+	// Drop modify and chmod events that changed neither the content nor the
+	// permissions of the file
+	if fw.hashes != nil {
+		switch eventType {
+		case "modify", "chmod":
+			if !fw.hashes.changed(event.Name) {
+				fw.logger.Debug("content unchanged, suppressing event", "path", event.Name)
+				return false
+			}
+		case "create":
+			fw.hashes.changed(event.Name)
+		case "remove", "rename":
+			fw.hashes.remove(event.Name)
 		}
 	}
 
@@ -135,39 +422,266 @@ func (fw *FileWatcher) handleEvent(event fsnotify.Event) {
 		"operation", event.Op.String(),
 	)
 
-	if fw.execCommand == "" {
+	if fw.service == nil && fw.sink == nil && fw.execCommand == "" && len(fw.actions) == 0 {
+		return
+	}
+
+	fw.counters.events.Add(1)
+	ev := fw.newEvent(event)
+	fw.metrics.EventDispatched(ev.Root, string(ev.Type))
+
+	// The sink is fed from the watch loop to keep the order of the events
+	if fw.sink != nil {
+		fw.sink.publish(ev)
+	}
+
+	if fw.service != nil {
+		fw.service.notify(ev)
+		return
+	}
+
+	if fw.execCommand == "" && len(fw.actions) == 0 {
+		return
+	}
+
+	fw.dispatch(ev)
+}
+
+// handleTailEvent runs the command with the lines appended to the file since
+// the previous event on stdin
+func (fw *FileWatcher) handleTailEvent(event *Event) {
+	if event.flushOf != nil {
+		fw.runMatches(event, fw.match.flush(event.flushOf))
+		return
+	}
+
+	switch event.Type {
+	case EventCreate, EventModify:
+	case EventRemove, EventRename:
+		fw.dispatchLines(event, fw.tail.release(event.Path), true)
+		fw.runCommand(event, nil, nil)
+		return
+	default:
+		fw.runCommand(event, nil, nil)
+		return
+	}
+
+	for {
+		lines, more, err := fw.tail.read(event.Path)
+		if err != nil {
+			fw.logger.Error("failed to read appended lines",
+				"path", event.Path,
+				"error", err,
+			)
+		}
+
+		fw.dispatchLines(event, lines, false)
+		if !more || err != nil {
+			return
+		}
+	}
+}
+
+// dispatchLines runs the command for tailed lines, either for every matched
+// record or in batches. final is set for the last lines of a removed or
+// renamed file.
+func (fw *FileWatcher) dispatchLines(event *Event, lines []string, final bool) {
+	if fw.match != nil {
+		fw.runMatches(event, fw.match.match(event, lines, final))
 		return
 	}
 
-	// Execute command
-	cmd := exec.Command(fw.execCommand, fw.execArgs...)
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("WATCHER_EVENT_PATH=%s", event.Name),
-		fmt.Sprintf("WATCHER_EVENT_OP=%s", event.Op.String()),
+	if len(lines) == 0 {
+		return
+	}
+
+	for _, batch := range fw.tail.batches(lines) {
+		stdin := strings.NewReader(strings.Join(batch, "\n") + "\n")
+		fw.runCommand(event, stdin, []string{
+			fmt.Sprintf("WATCHER_TAIL_LINES=%d", len(batch)),
+		})
+	}
+}
+
+// runMatches runs the command for every matched record
+func (fw *FileWatcher) runMatches(event *Event, matches []Match) {
+	for _, match := range matches {
+		stdin := strings.NewReader(strings.Join(match.Lines, "\n") + "\n")
+		env := append([]string{
+			fmt.Sprintf("WATCHER_TAIL_LINES=%d", len(match.Lines)),
+		}, match.env()...)
+		fw.runCommand(event, stdin, env)
+	}
+}
+
+// flushRecord queues the multiline record held back after reading the lines
+// of event once no further lines arrived, behind the events of its path
+func (fw *FileWatcher) flushRecord(event *Event) {
+	if fw.stopping() && !fw.draining.Load() {
+		return
+	}
+
+	flush := *event
+	flush.flushOf = event
+	fw.dispatch(&flush)
+}
+
+// runCommand executes the configured command for event
+func (fw *FileWatcher) runCommand(event *Event, stdin io.Reader, extraEnv []string) {
+	args, env, dir, err := fw.command.render(event.templateData())
+	if err != nil {
+		fw.logger.Error("failed to render command", "path", event.Path, "error", err)
+		return
+	}
+
+	if stdin == nil && fw.stdin == StdinEventJSON {
+		stdin = strings.NewReader(event.String() + "\n")
+	}
+
+	cmd := exec.Command(fw.execCommand, args...)
+	cmd.Dir = fw.commandDir(dir)
+	cmd.Stdin = stdin
+	cmd.Env = append(fw.baseEnv(),
+		fmt.Sprintf("WATCHER_EVENT_PATH=%s", event.Path),
+		fmt.Sprintf("WATCHER_EVENT_OP=%s", event.Op),
 	)
+	cmd.Env = append(cmd.Env, extraEnv...)
+
+	if event.linkTarget != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("WATCHER_EVENT_LINK_TARGET=%s", event.linkTarget))
+	}
+
+	if event.hashed {
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("WATCHER_EVENT_OLD_HASH=%s", event.oldHash),
+			fmt.Sprintf("WATCHER_EVENT_NEW_HASH=%s", event.newHash),
+		)
+	}
 
 	// Add custom environment variables
-	for k, v := range fw.environment {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	cmd.Env = append(cmd.Env, env...)
+
+	if fw.exec != nil {
+		if err := fw.exec.prepare(cmd); err != nil {
+			fw.logger.Error("failed to prepare command", "path", event.Path, "error", err)
+			return
+		}
 	}
 
-	output, err := cmd.CombinedOutput()
+	if fw.output != nil {
+		fw.runToTaskOutput(cmd, event)
+		return
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = fw.execute(cmd, event)
+	if err == errCommandCancelled {
+		fw.logger.Info("command cancelled by a newer event", "path", event.Path)
+		return
+	}
 	if err != nil {
 		fw.logger.Error("command execution failed",
 			"error", err,
-			"output", string(output),
+			"output", output.String(),
 		)
 		return
 	}
 
 	fw.logger.Info("command executed successfully",
-		"output", string(output),
+		"output", output.String(),
+	)
+}
+
+// runToTaskOutput runs cmd streaming its output to the task log, framed by
+// structured event lines
+func (fw *FileWatcher) runToTaskOutput(cmd *exec.Cmd, event *Event) {
+	stdout, stderr := fw.output.writers(event)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	fw.output.events.Info("file event",
+		"sequence", event.Sequence,
+		"type", event.Type,
+		"path", event.Path,
+	)
+
+	start := time.Now()
+	err := fw.execute(cmd, event)
+	stdout.Flush()
+	stderr.Flush()
+
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	if err == errCommandCancelled {
+		fw.output.events.Info("command cancelled",
+			"sequence", event.Sequence,
+			"duration", time.Since(start).String(),
+		)
+		return
+	}
+
+	if err != nil {
+		fw.output.events.Error("command failed",
+			"sequence", event.Sequence,
+			"exit_code", exitCode,
+			"duration", time.Since(start).String(),
+			"error", err.Error(),
+		)
+		fw.logger.Error("command execution failed",
+			"path", event.Path,
+			"error", err,
+		)
+		return
+	}
+
+	fw.output.events.Info("command finished",
+		"sequence", event.Sequence,
+		"exit_code", exitCode,
+		"duration", time.Since(start).String(),
 	)
+	fw.logger.Debug("command executed successfully", "path", event.Path)
+}
+
+// trackRename pairs a create event directly following a rename, which is
+// how fsnotify reports a move within the watched paths
+func (fw *FileWatcher) trackRename(event fsnotify.Event) {
+	fw.renamedFrom = ""
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		if fw.lastRename != "" && time.Since(fw.lastRenameAt) < renamePairWindow {
+			fw.renamedFrom = fw.lastRename
+		}
+		fw.lastRename = ""
+	case event.Op&fsnotify.Rename == fsnotify.Rename:
+		fw.lastRename = event.Name
+		fw.lastRenameAt = time.Now()
+	default:
+		fw.lastRename = ""
+	}
 }
 
 func (fw *FileWatcher) Stop() {
-	close(fw.stopCh)
+	fw.stopOnce.Do(func() { close(fw.stopCh) })
 	fw.watcher.Close()
+
+	if fw.tail != nil {
+		fw.tail.close()
+	}
+
+	if fw.match != nil {
+		fw.match.close()
+	}
+
+	fw.actionsOnce.Do(fw.closeActions)
+
+	if fw.sink != nil {
+		fw.sink.close()
+	}
 }
 
 func eventToString(event fsnotify.Event) string {
@@ -201,5 +715,18 @@ func (fw *FileWatcher) Cleanup() error {
 			return fmt.Errorf("failed to close watcher: %v", err)
 		}
 	}
+
+	// Release the connections of actions and the open files when the
+	// watcher failed to start
+	if fw.tail != nil {
+		fw.tail.close()
+	}
+	if fw.match != nil {
+		fw.match.close()
+	}
+	fw.actionsOnce.Do(fw.closeActions)
+	if fw.sink != nil {
+		fw.sink.close()
+	}
 	return nil
 }
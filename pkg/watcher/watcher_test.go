@@ -0,0 +1,80 @@
+package watcher
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// newTestWatcher returns a watcher that is not started, for driving the
+// actions directly
+func newTestWatcher(t *testing.T, opts ...Option) *FileWatcher {
+	t.Helper()
+
+	fw, err := NewFileWatcher(hclog.NewNullLogger(), nil, nil, "true", nil, nil, nil, false, opts...)
+	if err != nil {
+		t.Fatalf("failed to create watcher: %v", err)
+	}
+	t.Cleanup(fw.Stop)
+	return fw
+}
+
+// stopTestWatcher closes the stop channel like Shutdown does, without
+// closing the actions
+func stopTestWatcher(fw *FileWatcher) {
+	fw.stopOnce.Do(func() { close(fw.stopCh) })
+}
+
+func testEvent(path string) *Event {
+	return &Event{
+		SchemaVersion: EventSchemaVersion,
+		Type:          EventCreate,
+		Op:            string(EventCreate),
+		Path:          path,
+		Timestamp:     time.Now(),
+	}
+}
+
+// testMetrics counts the retries and timeouts reported by the actions
+type testMetrics struct {
+	nopMetrics
+	retries  atomic.Int64
+	timeouts atomic.Int64
+}
+
+func (m *testMetrics) Retry(string)   { m.retries.Add(1) }
+func (m *testMetrics) Timeout(string) { m.timeouts.Add(1) }
+
+// taskEvents records the task events emitted by the actions
+type taskEvents struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (e *taskEvents) emit(message string, annotations map[string]string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.messages = append(e.messages, message)
+}
+
+func (e *taskEvents) list() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string{}, e.messages...)
+}
+
+// waitFor polls cond until it holds or timeout elapses
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %v", timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,385 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout       = 10 * time.Second
+	defaultWebhookRetryBackoff  = time.Second
+	defaultWebhookBatchInterval = time.Second
+	maxWebhookRetryBackoff      = 30 * time.Second
+
+	// webhookCloseTimeout bounds the retries of the batch sent on close, when
+	// the watcher is already stopping
+	webhookCloseTimeout = 5 * time.Second
+
+	// maxWebhookResponse bounds the response body read to reuse connections
+	maxWebhookResponse = 64 * 1024
+)
+
+// WebhookConfig describes an HTTP endpoint receiving the event documents
+type WebhookConfig struct {
+	URL           string
+	Method        string            // Defaults to POST
+	Headers       map[string]string // Extra request headers
+	Body          string            // Body template, defaults to the event JSON
+	AuthHeader    string            // Header carrying the credential, e.g. Authorization
+	AuthEnv       string            // Task environment variable holding the credential
+	TLS           WebhookTLSConfig
+	Timeout       time.Duration // Timeout of a single request
+	MaxRetries    int           // Retries on timeouts, 429 and 5xx responses
+	RetryBackoff  time.Duration // Delay before the first retry, doubled for every retry
+	BatchSize     int           // Events sent per request, batches are JSON arrays
+	BatchInterval time.Duration // Maximum time an event waits for its batch to fill
+}
+
+// WebhookTLSConfig configures TLS for https endpoints
+type WebhookTLSConfig struct {
+	CACert     string // PEM file of the CA verifying the server
+	ClientCert string // PEM file of the client certificate
+	ClientKey  string // PEM file of the client key
+	ServerName string // Server name used for verification
+	SkipVerify bool   // Do not verify the server certificate
+}
+
+// Validate reports whether the webhook configuration is usable
+func (c WebhookConfig) Validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid webhook url %q: scheme must be http or https", c.URL)
+	}
+	switch c.Method {
+	case "", http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return fmt.Errorf("invalid webhook method: %s", c.Method)
+	}
+	if c.Body != "" {
+		data := WebhookData{Event: sampleEvent, Events: []*Event{sampleEvent}}
+		if err := validateTemplate(c.Body, data); err != nil {
+			return fmt.Errorf("invalid webhook body: %v", err)
+		}
+	}
+	if (c.AuthHeader == "") != (c.AuthEnv == "") {
+		return fmt.Errorf("webhook auth header and auth env must be set together")
+	}
+	if (c.TLS.ClientCert == "") != (c.TLS.ClientKey == "") {
+		return fmt.Errorf("webhook client cert and client key must be set together")
+	}
+	if c.Timeout < 0 || c.RetryBackoff < 0 || c.BatchInterval < 0 {
+		return fmt.Errorf("webhook durations must be non-negative")
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("webhook max retries must be non-negative")
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("webhook batch size must be non-negative")
+	}
+	return nil
+}
+
+// WebhookData is the data available to the webhook body template
+type WebhookData struct {
+	Event  *Event   // First event of the request
+	Events []*Event // All events of the request
+}
+
+type webhook struct {
+	fw     *FileWatcher
+	cfg    WebhookConfig
+	client *http.Client
+	body   *template.Template
+
+	lock       sync.Mutex
+	batch      []*Event
+	timer      *time.Timer
+	lastStatus int
+}
+
+func newWebhook(fw *FileWatcher, cfg WebhookConfig) (*webhook, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultWebhookTimeout
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = defaultWebhookRetryBackoff
+	}
+	if cfg.BatchInterval == 0 {
+		cfg.BatchInterval = defaultWebhookBatchInterval
+	}
+
+	tlsConfig, err := cfg.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	w := &webhook{
+		fw:  fw,
+		cfg: cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+		},
+	}
+
+	if cfg.Body != "" {
+		if w.body, err = parseTemplate("webhook.body", cfg.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+func (c WebhookTLSConfig) config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.SkipVerify,
+	}
+
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook ca cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load webhook client cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Handle sends event, or adds it to the current batch
+func (w *webhook) Handle(event *Event) error {
+	if w.cfg.BatchSize <= 1 {
+		return w.send([]*Event{event}, w.fw.stopCh)
+	}
+
+	w.lock.Lock()
+	w.batch = append(w.batch, event)
+	if len(w.batch) >= w.cfg.BatchSize {
+		events := w.takeLocked()
+		w.lock.Unlock()
+		return w.send(events, w.fw.stopCh)
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.cfg.BatchInterval, w.flush)
+	}
+	w.lock.Unlock()
+	return nil
+}
+
+// Close sends the pending batch. The watcher is stopping at this point, so
+// its delivery is retried until webhookCloseTimeout rather than until stop.
+func (w *webhook) Close() error {
+	w.lock.Lock()
+	events := w.takeLocked()
+	w.lock.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookCloseTimeout)
+	defer cancel()
+	return w.send(events, ctx.Done())
+}
+
+// flush sends a batch that did not fill up within the batch interval
+func (w *webhook) flush() {
+	w.lock.Lock()
+	events := w.takeLocked()
+	w.lock.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+	if err := w.send(events, w.fw.stopCh); err != nil {
+		w.fw.logger.Error("webhook failed", "error", err)
+	}
+}
+
+func (w *webhook) takeLocked() []*Event {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	events := w.batch
+	w.batch = nil
+	return events
+}
+
+// send delivers events, retrying network errors, 429 and 5xx responses with
+// exponential backoff until stop is closed
+func (w *webhook) send(events []*Event, stop <-chan struct{}) error {
+	body, err := w.render(events)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := w.post(body)
+		if err == nil && status < 300 {
+			w.report(status, attempt, len(events), nil)
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("unexpected status %d", status)
+		} else if isTimeout(err) {
+			w.fw.metrics.Timeout("webhook")
+		}
+
+		retryable := status == http.StatusTooManyRequests || status >= 500 || (status == 0 && retryableError(err))
+		if !retryable || attempt > w.cfg.MaxRetries {
+			w.report(status, attempt, len(events), err)
+			return fmt.Errorf("webhook %s failed after %d attempts: %v", w.cfg.URL, attempt, err)
+		}
+
+		w.fw.logger.Warn("webhook failed, retrying", "url", w.cfg.URL, "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			w.report(status, attempt, len(events), err)
+			return fmt.Errorf("webhook %s failed after %d attempts, not retrying while stopping: %v", w.cfg.URL, attempt, err)
+		}
+		w.fw.metrics.Retry("webhook")
+		if backoff *= 2; backoff > maxWebhookRetryBackoff {
+			backoff = maxWebhookRetryBackoff
+		}
+	}
+}
+
+// render builds the request body of events
+func (w *webhook) render(events []*Event) ([]byte, error) {
+	if w.body != nil {
+		var buf bytes.Buffer
+		if err := w.body.Execute(&buf, WebhookData{Event: events[0], Events: events}); err != nil {
+			return nil, fmt.Errorf("failed to render webhook body: %v", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	if w.cfg.BatchSize <= 1 {
+		return json.Marshal(events[0])
+	}
+	return json.Marshal(events)
+}
+
+func (w *webhook) post(body []byte) (int, error) {
+	req, err := http.NewRequest(w.cfg.Method, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, webhookConfigError{err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.cfg.AuthHeader != "" {
+		value, ok := w.fw.lookupEnv(w.cfg.AuthEnv)
+		if !ok {
+			return 0, webhookConfigError{fmt.Errorf("webhook auth env %s is not set", w.cfg.AuthEnv)}
+		}
+		req.Header.Set(w.cfg.AuthHeader, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+	return resp.StatusCode, nil
+}
+
+// webhookConfigError marks request failures caused by the configuration,
+// which fail the same way on every attempt
+type webhookConfigError struct {
+	err error
+}
+
+func (e webhookConfigError) Error() string { return e.err.Error() }
+func (e webhookConfigError) Unwrap() error { return e.err }
+
+// retryableError reports whether a request that got no response may succeed
+// when repeated. Configuration errors and rejected certificates are final.
+func retryableError(err error) bool {
+	var configErr webhookConfigError
+	var verifyErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return !errors.As(err, &configErr) &&
+		!errors.As(err, &verifyErr) &&
+		!errors.As(err, &alertErr) &&
+		!errors.As(err, &authorityErr) &&
+		!errors.As(err, &hostnameErr) &&
+		!errors.As(err, &invalidErr)
+}
+
+// report records failures and status changes of the endpoint in the task
+// events
+func (w *webhook) report(status, attempts, events int, err error) {
+	w.lock.Lock()
+	changed := status != w.lastStatus
+	w.lastStatus = status
+	w.lock.Unlock()
+
+	annotations := map[string]string{
+		"url":      w.cfg.URL,
+		"status":   fmt.Sprintf("%d", status),
+		"attempts": fmt.Sprintf("%d", attempts),
+		"events":   fmt.Sprintf("%d", events),
+	}
+
+	if err != nil {
+		w.fw.logger.Error("webhook failed", "url", w.cfg.URL, "status", status, "attempts", attempts, "error", err)
+		annotations["error"] = err.Error()
+		w.fw.emitTaskEvent("Webhook delivery failed", annotations)
+		return
+	}
+
+	w.fw.logger.Debug("webhook delivered", "url", w.cfg.URL, "status", status, "events", events)
+	if changed {
+		w.fw.emitTaskEvent(fmt.Sprintf("Webhook responded with status %d", status), annotations)
+	}
+}
@@ -0,0 +1,351 @@
+package watcher
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the requests of a webhook and answers them with the
+// next status of a script, repeating the last one
+type webhookServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+	times    []time.Time
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.lock.Lock()
+		status := s.statuses[min(len(s.bodies), len(s.statuses)-1)]
+		s.bodies = append(s.bodies, string(body))
+		s.headers = append(s.headers, r.Header.Clone())
+		s.times = append(s.times, time.Now())
+		s.lock.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookServer) requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.bodies)
+}
+
+func (s *webhookServer) body(i int) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bodies[i]
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	server := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	metrics := &testMetrics{}
+	fw := newTestWatcher(t, WithMetrics(metrics))
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:          server.URL,
+		MaxRetries:   3,
+		RetryBackoff: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Handle(testEvent("/data/a")); err != nil {
+		t.Fatalf("expected delivery after retries, got %v", err)
+	}
+	if n := server.requests(); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+	if n := metrics.retries.Load(); n != 2 {
+		t.Fatalf("expected 2 retries, got %d", n)
+	}
+
+	// The backoff doubles with every retry
+	first := server.times[1].Sub(server.times[0])
+	second := server.times[2].Sub(server.times[1])
+	if first < 20*time.Millisecond || second < 40*time.Millisecond {
+		t.Fatalf("expected backoffs of at least 20ms and 40ms, got %v and %v", first, second)
+	}
+}
+
+func TestWebhookGivesUpAfterMaxRetries(t *testing.T) {
+	server := newWebhookServer(t, http.StatusInternalServerError)
+	events := &taskEvents{}
+	fw := newTestWatcher(t, WithTaskEvents(events.emit))
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:          server.URL,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Handle(testEvent("/data/a")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := server.requests(); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+	if got := events.list(); len(got) != 1 || got[0] != "Webhook delivery failed" {
+		t.Fatalf("expected a delivery failed task event, got %q", got)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	server := newWebhookServer(t, http.StatusBadRequest)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:          server.URL,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Handle(testEvent("/data/a")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := server.requests(); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+}
+
+func TestWebhookFailsFastOnMissingAuthEnv(t *testing.T) {
+	server := newWebhookServer(t, http.StatusOK)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:          server.URL,
+		AuthHeader:   "Authorization",
+		AuthEnv:      "FILEWATCHER_TEST_UNSET_TOKEN",
+		MaxRetries:   3,
+		RetryBackoff: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.Handle(testEvent("/data/a")) }()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "FILEWATCHER_TEST_UNSET_TOKEN") {
+			t.Fatalf("expected a missing auth env error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missing auth env was retried")
+	}
+	if n := server.requests(); n != 0 {
+		t.Fatalf("expected no requests, got %d", n)
+	}
+}
+
+func TestWebhookSendsAuthHeader(t *testing.T) {
+	t.Setenv("FILEWATCHER_TEST_TOKEN", "Bearer secret")
+	server := newWebhookServer(t, http.StatusNoContent)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:        server.URL,
+		Headers:    map[string]string{"X-Source": "filewatcher"},
+		AuthHeader: "Authorization",
+		AuthEnv:    "FILEWATCHER_TEST_TOKEN",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Handle(testEvent("/data/a")); err != nil {
+		t.Fatal(err)
+	}
+	header := server.headers[0]
+	if got := header.Get("Authorization"); got != "Bearer secret" {
+		t.Fatalf("expected the auth header from the environment, got %q", got)
+	}
+	if got := header.Get("X-Source"); got != "filewatcher" {
+		t.Fatalf("expected the configured header, got %q", got)
+	}
+}
+
+func TestWebhookStopsRetryingOnStop(t *testing.T) {
+	server := newWebhookServer(t, http.StatusBadGateway)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:          server.URL,
+		MaxRetries:   5,
+		RetryBackoff: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.Handle(testEvent("/data/a")) }()
+
+	waitFor(t, 5*time.Second, func() bool { return server.requests() == 1 })
+	stopTestWatcher(fw)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry backoff ignored the stop")
+	}
+	if n := server.requests(); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+}
+
+func TestWebhookBatchesBySize(t *testing.T) {
+	server := newWebhookServer(t, http.StatusOK)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     3,
+		BatchInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/data/a", "/data/b"} {
+		if err := w.Handle(testEvent(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.requests(); n != 0 {
+		t.Fatalf("expected the batch to be held back, got %d requests", n)
+	}
+
+	if err := w.Handle(testEvent("/data/c")); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.requests(); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+
+	var batch []Event
+	if err := json.Unmarshal([]byte(server.body(0)), &batch); err != nil {
+		t.Fatalf("expected a JSON array: %v", err)
+	}
+	if len(batch) != 3 || batch[0].Path != "/data/a" || batch[2].Path != "/data/c" {
+		t.Fatalf("unexpected batch: %+v", batch)
+	}
+}
+
+func TestWebhookFlushesBatchAfterInterval(t *testing.T) {
+	server := newWebhookServer(t, http.StatusOK)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     10,
+		BatchInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/data/a", "/data/b"} {
+		if err := w.Handle(testEvent(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, 5*time.Second, func() bool { return server.requests() == 1 })
+
+	var batch []Event
+	if err := json.Unmarshal([]byte(server.body(0)), &batch); err != nil {
+		t.Fatalf("expected a JSON array: %v", err)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(batch))
+	}
+}
+
+func TestWebhookCloseSendsPendingBatch(t *testing.T) {
+	server := newWebhookServer(t, http.StatusOK)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     10,
+		BatchInterval: time.Hour,
+		Body:          `{"count": {{ len .Events }}, "first": "{{ .Event.Path }}"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/data/a", "/data/b"} {
+		if err := w.Handle(testEvent(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := server.requests(); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+	if got, want := server.body(0), `{"count": 2, "first": "/data/a"}`; got != want {
+		t.Fatalf("expected body %s, got %s", want, got)
+	}
+}
+
+func TestWebhookCloseRetriesAfterStop(t *testing.T) {
+	server := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusOK)
+	fw := newTestWatcher(t)
+
+	w, err := newWebhook(fw, WebhookConfig{
+		URL:           server.URL,
+		MaxRetries:    3,
+		RetryBackoff:  20 * time.Millisecond,
+		BatchSize:     10,
+		BatchInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Handle(testEvent("/data/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close runs after the watcher stopped, the pending batch is still
+	// retried
+	stopTestWatcher(fw)
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected the pending batch to be delivered, got %v", err)
+	}
+	if n := server.requests(); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}